@@ -0,0 +1,55 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ilyakaznacheev/secret/internal/config"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+)
+
+// APIKeys manages API keys of tenants in the API key file.
+//
+// Commands:
+//
+//	create <tenant> <name>  create a new key and print it
+//	list                    print names of all keys
+//	revoke <tenant> <name>  delete the key
+//
+// The running service picks up changes of the file without a restart.
+func APIKeys(conf config.Config, args []string, out io.Writer) error {
+	if conf.Tenant.KeysFile == "" {
+		return errors.New("API key file is not set")
+	}
+	keys, err := tenant.LoadKeyFile(conf.Tenant.KeysFile)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New("API key command is missing, expected create, list or revoke")
+	}
+	switch cmd := args[0]; {
+	case cmd == "create" && len(args) == 3:
+		key, err := keys.Create(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, key)
+		return nil
+	case cmd == "list" && len(args) == 1:
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TENANT\tNAME")
+		for _, k := range keys.Keys() {
+			fmt.Fprintf(w, "%s\t%s\n", k.Tenant, k.Name)
+		}
+		return w.Flush()
+	case cmd == "revoke" && len(args) == 3:
+		return keys.Revoke(args[1], args[2])
+	default:
+		return fmt.Errorf("wrong API key command %q, expected create <tenant> <name>, list or revoke <tenant> <name>", strings.Join(args, " "))
+	}
+}
@@ -0,0 +1,145 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ilyakaznacheev/secret/internal/audit"
+	"github.com/ilyakaznacheev/secret/internal/config"
+	"github.com/ilyakaznacheev/secret/internal/database"
+)
+
+// Audit checks the audit trail.
+//
+// Commands:
+//
+//	verify [file]  verify hash chains of the file, or of all configured readable sinks
+//
+// Entries of the trail are printed nowhere, only a summary of every checked sink.
+func Audit(conf config.Config, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "verify" || len(args) > 2 {
+		return fmt.Errorf("wrong audit command %q, expected verify [file]", strings.Join(args, " "))
+	}
+	key := []byte(conf.Audit.Key)
+
+	if len(args) == 2 {
+		return verifyAudit(out, args[1], key, func(fn func(e *audit.Entry) error) error {
+			return audit.ReadFile(args[1], fn)
+		})
+	}
+
+	if conf.Audit.File == "" && conf.Audit.RedisStream == "" {
+		return errors.New("audit file and Redis stream are not set, syslog can't be verified")
+	}
+	if conf.Audit.File != "" {
+		err := verifyAudit(out, conf.Audit.File, key, func(fn func(e *audit.Entry) error) error {
+			return audit.ReadFile(conf.Audit.File, fn)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if conf.Audit.RedisStream != "" {
+		db, err := openDatabase(conf)
+		if err != nil {
+			return err
+		}
+		defer closeDatabase(db)
+
+		stream, err := auditStream(conf.Audit, db)
+		if err != nil {
+			return err
+		}
+		return verifyAudit(out, "redis stream "+conf.Audit.RedisStream, key, audit.NewStreamSink(stream).ForEach)
+	}
+	return nil
+}
+
+// verifyAudit verifies entries of the named trail and prints the summary
+func verifyAudit(out io.Writer, name string, key []byte, forEach func(fn func(e *audit.Entry) error) error) error {
+	v := audit.NewVerifier(key)
+	if err := forEach(v.Add); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	rep := v.Report()
+	fmt.Fprintf(out, "%s: %d entries of %d sources (%s) in %d chains are valid\n",
+		name, rep.Entries, len(rep.Sources), strings.Join(rep.Sources, ", "), rep.Chains)
+	return nil
+}
+
+// newAuditLog creates an audit log writing to the configured sinks.
+//
+// The chain of this source is resumed from the file, or from the Redis stream if there is no file.
+// Returns nil if no sinks are configured.
+func newAuditLog(conf config.AuditConfig, db database.Database) (*audit.Log, error) {
+	var (
+		sinks  []audit.Sink
+		tailer audit.Tailer
+	)
+	// sinks opened before a failure are closed by the log only, so close them here
+	fail := func(err error) (*audit.Log, error) {
+		for _, s := range sinks {
+			s.Close()
+		}
+		return nil, err
+	}
+
+	if conf.File != "" {
+		sink, err := audit.NewFileSink(conf.File)
+		if err != nil {
+			return fail(fmt.Errorf("audit file: %v", err))
+		}
+		sinks = append(sinks, sink)
+		tailer = sink
+	}
+	if conf.RedisStream != "" {
+		stream, err := auditStream(conf, db)
+		if err != nil {
+			return fail(err)
+		}
+		sink := audit.NewStreamSink(stream)
+		sinks = append(sinks, sink)
+		if tailer == nil {
+			tailer = sink
+		}
+	}
+	if conf.Syslog != "" {
+		sink, err := audit.NewSyslogSink(conf.Syslog, "secret")
+		if err != nil {
+			return fail(fmt.Errorf("audit syslog: %v", err))
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	source := conf.Source
+	if source == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fail(fmt.Errorf("audit source: %v", err))
+		}
+		source = host
+	}
+
+	l := audit.New(source, sinks, audit.WithKey([]byte(conf.Key)), audit.WithQueue(conf.QueueSize))
+	if tailer != nil {
+		if err := l.Resume(tailer); err != nil {
+			return fail(fmt.Errorf("audit chain can't be resumed: %v", err))
+		}
+	}
+	return l, nil
+}
+
+// auditStream returns the configured Redis stream of audit entries
+func auditStream(conf config.AuditConfig, db database.Database) (*database.RedisStream, error) {
+	rdb, ok := db.(*database.RedisDB)
+	if !ok {
+		return nil, fmt.Errorf("audit Redis stream requires storage driver %s", database.DriverRedis)
+	}
+	return rdb.NewStream(conf.RedisStream), nil
+}
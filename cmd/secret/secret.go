@@ -2,12 +2,27 @@
 Package main is a secret service entry-point.
 
 The secres servise helps to store secrets and get them by unique address.
+
+Usage:
+
+	secret [flags] [command]
+
+Commands:
+
+	rotate-keys                    re-wrap data keys of all secrets with the primary key-encryption key
+	api-key create <tenant> <name> create a new API key of the tenant and print it
+	api-key list                   print all API keys
+	api-key revoke <tenant> <name> delete the API key
+	audit verify [file]            verify hash chains of the audit trail
+
+Without a command the server is started.
 */
 package main
 
 import (
 	"flag"
 	"log"
+	"os"
 
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/ilyakaznacheev/secret"
@@ -24,8 +39,25 @@ func main() {
 	// read config
 	cleanenv.ReadEnv(&conf)
 
-	// Run service
-	if err := secret.Run(conf); err != nil {
-		log.Fatal(err)
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		// Run service
+		if err := secret.Run(conf); err != nil {
+			log.Fatal(err)
+		}
+	case "rotate-keys":
+		if err := secret.RotateKeys(conf); err != nil {
+			log.Fatal(err)
+		}
+	case "api-key":
+		if err := secret.APIKeys(conf, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "audit":
+		if err := secret.Audit(conf, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown command %q", cmd)
 	}
 }
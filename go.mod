@@ -3,6 +3,7 @@ module github.com/ilyakaznacheev/secret
 go 1.12
 
 require (
+	github.com/alicebob/miniredis/v2 v2.10.1
 	github.com/gin-gonic/gin v1.4.0
 	github.com/go-openapi/errors v0.19.2
 	github.com/go-openapi/strfmt v0.19.2
@@ -10,11 +11,15 @@ require (
 	github.com/go-openapi/validate v0.19.2
 	github.com/go-redis/redis v6.15.2+incompatible
 	github.com/ilyakaznacheev/cleanenv v1.1.0
+	github.com/lib/pq v1.1.1
 	github.com/mattn/go-isatty v0.0.8 // indirect
+	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/onsi/ginkgo v1.8.0 // indirect
 	github.com/onsi/gomega v1.5.0 // indirect
 	github.com/prometheus/client_golang v1.0.0
 	github.com/stretchr/testify v1.3.0
+	go.etcd.io/bbolt v1.3.3
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
 	golang.org/x/sys v0.0.0-20190621062556-bf70e4678053 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1
@@ -0,0 +1,267 @@
+/*
+Package audit keeps a tamper-evident trail of secret lifecycle events.
+
+Every entry contains the hash of the previous entry of the same source (service replica),
+so a changed, removed or inserted entry breaks the chain. With a key, hashes are HMAC-SHA256,
+so the chain can't be rebuilt without the key. Entries never contain secret content or keys,
+secrets are identified by their public lookup id. Legacy tokens are lookup ids and keys at once,
+such secrets are identified by a fingerprint of the token.
+
+Entries are written in background to one or several sinks: a JSONL file, syslog or a Redis stream.
+*/
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/logging"
+)
+
+// Action is a secret lifecycle action
+type Action string
+
+// secret lifecycle actions
+const (
+	ActionCreated Action = "created"
+	ActionViewed  Action = "viewed"
+	ActionBurned  Action = "burned"
+	ActionExpired Action = "expired"
+	ActionRevoked Action = "revoked"
+)
+
+// genesisHash is a previous hash of the first entry of a chain
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// ErrClosed the log doesn't accept events after it was closed
+var ErrClosed = errors.New("audit log is closed")
+
+// Event is a secret lifecycle event
+type Event struct {
+	Time     time.Time `json:"time"`
+	Action   Action    `json:"action"`
+	SecretID string    `json:"secretId"`
+	Tenant   string    `json:"tenant,omitempty"`
+	// Actor identifies who caused the event: an API key, a client certificate or a background job
+	Actor string `json:"actor,omitempty"`
+	IP    string `json:"ip,omitempty"`
+}
+
+// Entry is a chained audit log entry
+type Entry struct {
+	Source string `json:"source"`
+	Seq    uint64 `json:"seq"`
+	Event
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// sum calculates the entry hash. The hash field itself isn't hashed
+func sum(key []byte, e Entry) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fingerprintLength is a number of hex characters of a secret fingerprint
+const fingerprintLength = 16
+
+// Fingerprint returns a truncated HMAC-SHA256 of the secret id, or plain SHA-256 without a key.
+//
+// It identifies secrets whose lookup id can't be disclosed.
+func Fingerprint(key []byte, id string) string {
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(id))
+	return "fp:" + hex.EncodeToString(h.Sum(nil))[:fingerprintLength]
+}
+
+// Log chains events and writes them to sinks in background
+type Log struct {
+	source string
+	key    []byte
+	sinks  []Sink
+	queue  chan Event
+
+	// stop is closed to write the rest of the queue and stop, done is closed when Run returns
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// chain head of the source, sinks are written under the lock to keep the order
+	mu     sync.Mutex
+	seq    uint64
+	prev   string
+	closed bool
+
+	nowFunc func() time.Time
+}
+
+// Option is a Log configuration option
+type Option func(*Log)
+
+// WithKey sets an HMAC key of entry hashes
+func WithKey(key []byte) Option {
+	return func(l *Log) {
+		l.key = key
+	}
+}
+
+// WithQueue sets the number of events waiting to be written. Record blocks when the queue is full
+func WithQueue(size int) Option {
+	return func(l *Log) {
+		l.queue = make(chan Event, size)
+	}
+}
+
+// New creates a log of the source writing entries to the sinks
+func New(source string, sinks []Sink, opts ...Option) *Log {
+	l := &Log{
+		source:  source,
+		sinks:   sinks,
+		queue:   make(chan Event, 1000),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		prev:    genesisHash,
+		nowFunc: time.Now,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Resume continues the chain from the last entry of the source written by a previous run
+func (l *Log) Resume(t Tailer) error {
+	last, err := t.Last(l.source)
+	if err != nil || last == nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq, l.prev = last.Seq, last.Hash
+	return nil
+}
+
+// Record queues the event. Events with no time are recorded with the current time.
+//
+// If the queue is full, it waits to keep the trail complete at the cost of the request latency.
+func (l *Log) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = l.nowFunc()
+	}
+	select {
+	case l.queue <- e:
+	case <-l.done:
+		l.write(e)
+	}
+}
+
+// Run writes queued events until the context is done or the log is closed.
+//
+// After Close the rest of the queue is written and sinks are closed.
+// If the context is done first, the queued events are lost.
+func (l *Log) Run(ctx context.Context) {
+	defer close(l.done)
+	defer l.closeSinks()
+	for {
+		// cancellation takes priority over the queue
+		if ctx.Err() != nil {
+			l.drop()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			l.drop()
+			return
+		case e := <-l.queue:
+			l.write(e)
+		case <-l.stop:
+			for {
+				select {
+				case e := <-l.queue:
+					l.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops Run after the queued events are written
+func (l *Log) Close() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// write chains the event and writes the entry to all sinks.
+//
+// A failed sink misses the entry, which shows up as a broken chain on verification.
+func (l *Log) write(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		logging.Error("audit event was lost", logging.Err(ErrClosed), logging.Any("action", e.Action))
+		return
+	}
+
+	e.Time = e.Time.UTC().Round(0)
+	entry := Entry{
+		Source:   l.source,
+		Seq:      l.seq + 1,
+		Event:    e,
+		PrevHash: l.prev,
+	}
+	entry.Hash = sum(l.key, entry)
+	l.seq, l.prev = entry.Seq, entry.Hash
+
+	for _, s := range l.sinks {
+		if err := s.Write(&entry); err != nil {
+			logging.Error("audit entry can't be written",
+				logging.Any("seq", entry.Seq),
+				logging.Err(err),
+			)
+		}
+	}
+}
+
+// drop reports queued events that won't be written
+func (l *Log) drop() {
+	if n := len(l.queue); n > 0 {
+		logging.Error("audit events were lost", logging.Int("events", n))
+	}
+}
+
+func (l *Log) closeSinks() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil {
+			logging.Error("audit sink can't be closed", logging.Err(err))
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStream is an in-memory stream
+type testStream struct {
+	items [][]byte
+}
+
+func (s *testStream) Append(data []byte) error {
+	s.items = append(s.items, append([]byte{}, data...))
+	return nil
+}
+
+func (s *testStream) Range(reverse bool, fn func(data []byte) error) error {
+	for i := range s.items {
+		if reverse {
+			i = len(s.items) - 1 - i
+		}
+		if err := fn(s.items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLog records the events and stops the log
+func runLog(t *testing.T, l *Log, events ...Event) {
+	done := make(chan struct{})
+	go func() {
+		l.Run(context.Background())
+		close(done)
+	}()
+	for _, e := range events {
+		l.Record(e)
+	}
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit log wasn't stopped")
+	}
+}
+
+func testEvents(ids ...string) []Event {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+	var events []Event
+	for i, id := range ids {
+		events = append(events, Event{
+			Time:     now.Add(time.Duration(i) * time.Second),
+			Action:   ActionViewed,
+			SecretID: id,
+			Actor:    "api-key:ci",
+			IP:       "192.0.2.1",
+		})
+	}
+	return events
+}
+
+func TestLog_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	key := []byte("audit key")
+
+	events := testEvents("a", "b", "c", "d", "e")
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+	runLog(t, New("replica-1", []Sink{sink}, WithKey(key), WithQueue(1)), events[:3]...)
+
+	// the chain is resumed after a restart
+	sink, err = NewFileSink(path)
+	require.NoError(t, err)
+	l := New("replica-1", []Sink{sink}, WithKey(key))
+	require.NoError(t, l.Resume(sink))
+	runLog(t, l, events[3])
+
+	// other sources have their own chains
+	sink, err = NewFileSink(path)
+	require.NoError(t, err)
+	runLog(t, New("replica-2", []Sink{sink}, WithKey(key)), events[4])
+
+	rep, err := Verify(sink, key)
+	require.NoError(t, err)
+	assert.Equal(t, Report{Entries: 5, Sources: []string{"replica-1", "replica-2"}, Chains: 2}, rep)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 5)
+	assert.Contains(t, lines[0], `"source":"replica-1","seq":1,"time":"2020-02-01T10:10:10Z","action":"viewed","secretId":"a"`)
+	assert.Contains(t, lines[3], `"seq":4`)
+
+	_, err = Verify(sink, []byte("wrong key"))
+	assert.EqualError(t, err, "entry 1 of replica-1: hash mismatch, the entry was modified or the key is wrong")
+
+	tampered := func(lines ...string) Reader {
+		p := filepath.Join(dir, "tampered.jsonl")
+		require.NoError(t, ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")), 0600))
+		sink, err := NewFileSink(p)
+		require.NoError(t, err)
+		return sink
+	}
+
+	_, err = Verify(tampered(lines[0], strings.Replace(lines[1], `"viewed"`, `"created"`, 1), lines[2]), key)
+	assert.EqualError(t, err, "entry 2 of replica-1: hash mismatch, the entry was modified or the key is wrong")
+
+	_, err = Verify(tampered(lines[0], lines[2]), key)
+	assert.EqualError(t, err, "entry 3 of replica-1: expected entry 2, entries were removed or reordered")
+
+	_, err = Verify(tampered(lines[1], lines[0]), key)
+	assert.EqualError(t, err, "entry 1 of replica-1: new chain starts before entry 2, entries were reordered")
+
+	_, err = Verify(tampered(lines[0], lines[2], lines[1]), key)
+	assert.EqualError(t, err, "entry 3 of replica-1: expected entry 2, entries were removed or reordered")
+
+	// a truncated trail starts from any entry
+	rep, err = Verify(tampered(lines[2], lines[3]), key)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rep.Entries)
+}
+
+func TestLog_Restart(t *testing.T) {
+	stream := &testStream{}
+	sink := NewStreamSink(stream)
+
+	// without a resume a new chain starts
+	events := testEvents("a", "b", "c")
+	runLog(t, New("replica-1", []Sink{sink}), events[:2]...)
+	runLog(t, New("replica-1", []Sink{sink}), events[2:]...)
+
+	rep, err := Verify(sink, nil)
+	require.NoError(t, err)
+	assert.Equal(t, Report{Entries: 3, Sources: []string{"replica-1"}, Chains: 2}, rep)
+}
+
+func TestStreamSink_Last(t *testing.T) {
+	stream := &testStream{}
+	sink := NewStreamSink(stream)
+
+	last, err := sink.Last("replica-1")
+	assert.NoError(t, err)
+	assert.Nil(t, last)
+
+	runLog(t, New("replica-1", []Sink{sink}), testEvents("a", "b")...)
+	runLog(t, New("replica-2", []Sink{sink}), testEvents("c")...)
+
+	last, err = sink.Last("replica-1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), last.Seq)
+	assert.Equal(t, "b", last.SecretID)
+
+	stream.items = append(stream.items, []byte("{broken"))
+	_, err = sink.Last("replica-1")
+	assert.Error(t, err)
+}
+
+func TestLog_Cancel(t *testing.T) {
+	stream := &testStream{}
+	l := New("replica-1", []Sink{NewStreamSink(stream)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, e := range testEvents("a", "b") {
+		l.Record(e)
+	}
+	l.Run(ctx)
+	assert.Empty(t, stream.items)
+
+	// the log is closed after Run
+	l.Record(testEvents("c")[0])
+	assert.Empty(t, stream.items)
+}
+
+func TestSyslogSink(t *testing.T) {
+	_, err := NewSyslogSink("localhost:514", "secret")
+	assert.Error(t, err)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("udp://"+conn.LocalAddr().String(), "secret")
+	require.NoError(t, err)
+	runLog(t, New("replica-1", []Sink{sink}), testEvents("a")...)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	assert.Contains(t, msg, "secret")
+	assert.Contains(t, msg, `"action":"viewed","secretId":"a"`)
+}
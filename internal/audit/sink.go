@@ -0,0 +1,223 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Sink stores audit entries
+type Sink interface {
+	Write(e *Entry) error
+	Close() error
+}
+
+// Reader reads stored entries in the order they were written
+type Reader interface {
+	ForEach(fn func(e *Entry) error) error
+}
+
+// Tailer finds the last stored entry of the source. It returns nil if the source has no entries
+type Tailer interface {
+	Last(source string) (*Entry, error)
+}
+
+// errStop stops an iteration over entries
+var errStop = errors.New("stop")
+
+// FileSink appends entries to a file as JSON lines
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// NewFileSink opens a JSONL file for appending, the file is created if it doesn't exist
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, f: f}, nil
+}
+
+// Write appends the entry. The file is synced, so written entries survive a crash
+func (s *FileSink) Write(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// ForEach reads entries of the file
+func (s *FileSink) ForEach(fn func(e *Entry) error) error {
+	return ReadFile(s.path, fn)
+}
+
+// Last finds the last entry of the source in the file
+func (s *FileSink) Last(source string) (*Entry, error) {
+	return last(s, source)
+}
+
+// ReadFile reads entries of a JSONL file
+func ReadFile(path string, fn func(e *Entry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readLines(f, fn)
+}
+
+// readLines decodes JSON lines of entries
+func readLines(r io.Reader, fn func(e *Entry) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// last finds the last entry of the source by a full scan
+func last(r Reader, source string) (*Entry, error) {
+	var res *Entry
+	err := r.ForEach(func(e *Entry) error {
+		if e.Source == source {
+			res = e
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SyslogSink sends entries to syslog as JSON messages. Syslog can't be read back, so it doesn't resume chains
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to a syslog daemon.
+//
+// Address is "local" for the local daemon or network://host:port, e.g. udp://localhost:514.
+func NewSyslogSink(address, tag string) (*SyslogSink, error) {
+	var network, raddr string
+	if address != "local" {
+		parts := strings.SplitN(address, "://", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid syslog address %q, expected local or network://host:port", address)
+		}
+		network, raddr = parts[0], parts[1]
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+// Write sends the entry
+func (s *SyslogSink) Write(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(data))
+}
+
+// Close closes the connection
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
+
+// Stream is an append-only storage of encoded entries, like a Redis stream
+type Stream interface {
+	Append(data []byte) error
+	// Range calls fn for stored items from the oldest, or from the newest if reverse is set.
+	// Errors of fn stop the iteration and are returned
+	Range(reverse bool, fn func(data []byte) error) error
+}
+
+// StreamSink writes entries to a stream as JSON
+type StreamSink struct {
+	stream Stream
+}
+
+// NewStreamSink creates a sink of the stream
+func NewStreamSink(stream Stream) *StreamSink {
+	return &StreamSink{stream: stream}
+}
+
+// Write appends the entry
+func (s *StreamSink) Write(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.stream.Append(data)
+}
+
+// Close does nothing, the stream connection is shared with the storage
+func (s *StreamSink) Close() error {
+	return nil
+}
+
+// ForEach reads entries of the stream
+func (s *StreamSink) ForEach(fn func(e *Entry) error) error {
+	return s.stream.Range(false, func(data []byte) error {
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		return fn(&e)
+	})
+}
+
+// Last finds the last entry of the source reading the stream from the end
+func (s *StreamSink) Last(source string) (*Entry, error) {
+	var res *Entry
+	err := s.stream.Range(true, func(data []byte) error {
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.Source != source {
+			return nil
+		}
+		res = &e
+		return errStop
+	})
+	if err == errStop {
+		err = nil
+	}
+	return res, err
+}
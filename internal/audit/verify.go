@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Report is a summary of a verified audit trail
+type Report struct {
+	Entries int
+	// Sources are replicas that wrote the trail
+	Sources []string
+	// Chains is a number of chains. A source starts a new chain if its previous entries couldn't be resumed
+	Chains int
+}
+
+// Verifier checks entry chains of all sources. Entries of every source must be added in the order they were written
+type Verifier struct {
+	key    []byte
+	heads  map[string]*Entry
+	report Report
+}
+
+// NewVerifier creates a verifier of hashes calculated with the key
+func NewVerifier(key []byte) *Verifier {
+	return &Verifier{
+		key:   key,
+		heads: make(map[string]*Entry),
+	}
+}
+
+// Add checks the entry hash and its link to the previous entry of the source.
+//
+// The first entry of a source may continue a chain truncated by rotation.
+func (v *Verifier) Add(e *Entry) error {
+	if e.Hash != sum(v.key, *e) {
+		return fmt.Errorf("entry %d of %s: hash mismatch, the entry was modified or the key is wrong", e.Seq, e.Source)
+	}
+
+	head, ok := v.heads[e.Source]
+	switch {
+	case !ok:
+		v.report.Chains++
+		v.report.Sources = append(v.report.Sources, e.Source)
+	case e.Seq == 1 && e.PrevHash == genesisHash:
+		// a restarted source can't go back in time
+		if e.Time.Before(head.Time) {
+			return fmt.Errorf("entry 1 of %s: new chain starts before entry %d, entries were reordered", e.Source, head.Seq)
+		}
+		v.report.Chains++
+	case e.Seq != head.Seq+1:
+		return fmt.Errorf("entry %d of %s: expected entry %d, entries were removed or reordered", e.Seq, e.Source, head.Seq+1)
+	case e.PrevHash != head.Hash:
+		return fmt.Errorf("entry %d of %s: previous hash mismatch, the chain was modified", e.Seq, e.Source)
+	}
+
+	v.heads[e.Source] = e
+	v.report.Entries++
+	return nil
+}
+
+// Report returns the summary of added entries
+func (v *Verifier) Report() Report {
+	rep := v.report
+	rep.Sources = append([]string{}, rep.Sources...)
+	sort.Strings(rep.Sources)
+	return rep
+}
+
+// Verify checks all entries of the reader
+func Verify(r Reader, key []byte) (Report, error) {
+	v := NewVerifier(key)
+	err := r.ForEach(v.Add)
+	return v.Report(), err
+}
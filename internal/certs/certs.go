@@ -0,0 +1,241 @@
+/*
+Package certs serves TLS certificates of the HTTP server.
+
+Certificates are read from files and reloaded when the files change, so they can be renewed without a restart.
+Client certificates can be verified against a CA bundle (mutual TLS).
+*/
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ilyakaznacheev/secret/internal/logging"
+)
+
+// client certificate verification modes
+const (
+	ClientAuthNone    = "none"
+	ClientAuthVerify  = "verify"
+	ClientAuthRequire = "require"
+)
+
+// reloadInterval is a minimal interval between checks of certificate file changes
+const reloadInterval = 10 * time.Second
+
+// ParseClientAuth returns a client certificate verification type of the mode.
+//
+// Mode none doesn't request client certificates, verify checks them if they are sent and require rejects clients without them.
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthVerify:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q, expected none, verify or require", mode)
+	}
+}
+
+// Reloader is a TLS configuration with certificates reloaded on file change
+type Reloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+
+	mu      sync.RWMutex
+	config  *tls.Config
+	modTime map[string]time.Time
+	checked time.Time
+
+	nowFunc func() time.Time
+}
+
+// New loads the server certificate and the client CA bundle.
+//
+// The CA bundle is required if client certificates are verified.
+func New(certFile, keyFile, caFile string, clientAuth tls.ClientAuthType) (*Reloader, error) {
+	switch {
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("both TLS certificate and key files must be set")
+	case clientAuth != tls.NoClientCert && caFile == "":
+		return nil, errors.New("client CA file must be set to verify client certificates")
+	case clientAuth == tls.NoClientCert && caFile != "":
+		return nil, errors.New("client CA file is set, but client certificates aren't verified")
+	}
+
+	r := &Reloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     caFile,
+		clientAuth: clientAuth,
+		nowFunc:    time.Now,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked = r.nowFunc()
+	return r, nil
+}
+
+// TLSConfig returns a server TLS configuration using the actual certificates for every connection.
+//
+// The configuration has a certificate callback too, because http.Server.ServeTLS requires one without certificate files.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfig,
+		GetCertificate:     r.getCertificate,
+	}
+}
+
+// getCertificate returns the actual server certificate, reloading the files if they were changed
+func (r *Reloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	conf, err := r.getConfig(hello)
+	if err != nil {
+		return nil, err
+	}
+	return &conf.Certificates[0], nil
+}
+
+// getConfig returns the actual TLS configuration, reloading the files if they were changed
+func (r *Reloader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.reload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config, nil
+}
+
+// reload reads the files again if any of them was changed since the last read
+func (r *Reloader) reload() {
+	now := r.nowFunc()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.checked) < reloadInterval {
+		return
+	}
+	r.checked = now
+
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTime[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		// keep the previous certificates until the files are fixed
+		logging.Error("TLS certificates can't be reloaded", logging.Err(err))
+		return
+	}
+	logging.Info("TLS certificates were reloaded")
+}
+
+// load reads the certificates, the caller must hold the write lock
+func (r *Reloader) load() error {
+	modTime := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTime[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("TLS certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+	}
+	if r.caFile != "" {
+		pool, err := loadPool(r.caFile)
+		if err != nil {
+			return fmt.Errorf("client CA: %v", err)
+		}
+		config.ClientCAs = pool
+	}
+
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
+
+// ClientConfig creates a TLS configuration of connections to a server.
+//
+// The server certificate is verified with the CA bundle, or with system CAs if the bundle isn't set.
+// The client certificate is optional, certFile and keyFile must be set together.
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA: %v", err)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadPool reads a PEM CA bundle
+func loadPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// files returns paths of all watched files
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// ClientSubject returns a subject of the verified client certificate of the request.
+//
+// Returns false if the client didn't send a certificate or it wasn't verified.
+func ClientSubject(c *gin.Context) (string, bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return state.VerifiedChains[0][0].Subject.String(), true
+}
@@ -0,0 +1,270 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate signed by the parent, or a self-signed CA if the parent is nil
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Secret"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.ExtKeyUsage = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+// write saves the certificate and its key as PEM files
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		require.NoError(t, err)
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	}
+}
+
+// tlsCert returns the certificate with its key
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestReloader(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	dir, err := ioutil.TempDir("", "secret-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	ca := newTestCert(t, "Test CA", nil, 0)
+	ca.write(t, caFile, "")
+	newTestCert(t, "server-1", ca, x509.ExtKeyUsageServerAuth).write(t, certFile, keyFile)
+	client := newTestCert(t, "billing-service", ca, x509.ExtKeyUsageClientAuth)
+	stranger := newTestCert(t, "stranger", newTestCert(t, "Other CA", nil, 0), x509.ExtKeyUsageClientAuth)
+
+	r, err := New(certFile, keyFile, caFile, tls.VerifyClientCertIfGiven)
+	require.NoError(t, err)
+	now := time.Now()
+	r.nowFunc = func() time.Time { return now }
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		subject, ok := ClientSubject(c)
+		if !ok {
+			subject = "anonymous"
+		}
+		c.String(http.StatusOK, subject)
+	})
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	get := func(cert *testCert) (string, string, error) {
+		conf := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if cert != nil {
+			// send the certificate even if it isn't issued by a CA accepted by the server
+			tc := cert.tlsCert()
+			conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tc, nil
+			}
+		}
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+		resp, err := hc.Get(srv.URL)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	// client certificate subject is available to handlers
+	body, server, err := get(client)
+	require.NoError(t, err)
+	assert.Equal(t, "CN=billing-service,O=Secret", body)
+	assert.Equal(t, "server-1", server)
+
+	body, _, err = get(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+
+	// certificates of unknown CAs are rejected
+	_, _, err = get(stranger)
+	assert.Error(t, err)
+
+	// the renewed certificate is used after the reload interval
+	newTestCert(t, "server-2", ca, x509.ExtKeyUsageServerAuth).write(t, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	_, server, err = get(client)
+	require.NoError(t, err)
+	assert.Equal(t, "server-1", server)
+
+	now = now.Add(reloadInterval)
+	_, server, err = get(client)
+	require.NoError(t, err)
+	assert.Equal(t, "server-2", server)
+
+	// broken files don't replace working certificates
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	require.NoError(t, os.Chtimes(keyFile, later, later.Add(time.Minute)))
+	now = now.Add(reloadInterval)
+	_, server, err = get(client)
+	require.NoError(t, err)
+	assert.Equal(t, "server-2", server)
+}
+
+func TestReloader_ServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	ca := newTestCert(t, "Test CA", nil, 0)
+	newTestCert(t, "server-1", ca, x509.ExtKeyUsageServerAuth).write(t, certFile, keyFile)
+	r, err := New(certFile, keyFile, "", tls.NoClientCert)
+	require.NoError(t, err)
+
+	// ServeTLS without certificate files requires a certificate in the configuration itself
+	conf := r.TLSConfig()
+	require.NotNil(t, conf.GetCertificate)
+	cert, err := conf.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "server-1", leaf.Subject.CommonName)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }),
+		TLSConfig: conf,
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeTLS(ln, "", "") }()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}}
+	resp, err := hc.Get("https://" + ln.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	require.NoError(t, srv.Close())
+	assert.Equal(t, http.ErrServerClosed, <-served)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	_, err := New("tls.crt", "", "", tls.NoClientCert)
+	assert.Error(t, err)
+	_, err = New("tls.crt", "tls.key", "", tls.RequireAndVerifyClientCert)
+	assert.Error(t, err)
+	_, err = New("tls.crt", "tls.key", "ca.crt", tls.NoClientCert)
+	assert.Error(t, err)
+	_, err = New("missing.crt", "missing.key", "", tls.NoClientCert)
+	assert.Error(t, err)
+
+	_, err = ParseClientAuth("sometimes")
+	assert.Error(t, err)
+}
+
+func TestClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	ca := newTestCert(t, "ca", nil, 0)
+	ca.write(t, path("ca.crt"), "")
+	server := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	client.write(t, path("client.crt"), path("client.key"))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCert()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	handshake := func(config *tls.Config) error {
+		sc, cc := net.Pipe()
+		defer sc.Close()
+		defer cc.Close()
+		go tls.Server(sc, serverConfig).Handshake()
+		return tls.Client(cc, config).Handshake()
+	}
+
+	config, err := ClientConfig(path("ca.crt"), path("client.crt"), path("client.key"), "localhost")
+	require.NoError(t, err)
+	assert.NoError(t, handshake(config))
+
+	config, err = ClientConfig(path("ca.crt"), path("client.crt"), path("client.key"), "redis.example.com")
+	require.NoError(t, err)
+	assert.Error(t, handshake(config))
+
+	// the server isn't trusted by system CAs
+	config, err = ClientConfig("", path("client.crt"), path("client.key"), "localhost")
+	require.NoError(t, err)
+	assert.Error(t, handshake(config))
+
+	_, err = ClientConfig(path("ca.crt"), path("client.crt"), "", "localhost")
+	assert.Error(t, err)
+	_, err = ClientConfig(path("client.key"), "", "", "localhost")
+	assert.Error(t, err)
+}
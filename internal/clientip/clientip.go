@@ -0,0 +1,182 @@
+/*
+Package clientip resolves client IP addresses of requests passed through reverse proxies.
+
+Forwarding headers are only read from trusted proxies, and only the header the proxies set:
+Forwarded or X-Forwarded-For. The chain of the header is walked from the nearest hop,
+and the first address that isn't a trusted proxy is the client, so clients can't spoof their address
+by sending the headers themselves.
+*/
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextKey is a gin context key of the resolved address
+const contextKey = "clientip"
+
+// forwarding headers set by proxies
+const (
+	HeaderXForwardedFor = "x-forwarded-for"
+	HeaderForwarded     = "forwarded"
+)
+
+// Resolver resolves client addresses of requests
+type Resolver struct {
+	trusted []*net.IPNet
+	// forwarded reads the Forwarded header instead of X-Forwarded-For
+	forwarded bool
+}
+
+// New creates a resolver trusting the forwarding header of proxies in the networks.
+//
+// Networks are CIDRs or single IP addresses. Headers are ignored if no networks are given.
+// The header is HeaderXForwardedFor or HeaderForwarded, the other one is never read,
+// because proxies pass it from clients as is.
+func New(trusted []string, header string) (*Resolver, error) {
+	r := &Resolver{}
+	switch strings.ToLower(header) {
+	case HeaderXForwardedFor:
+	case HeaderForwarded:
+		r.forwarded = true
+	default:
+		return nil, fmt.Errorf("unknown forwarding header %q, expected %s or %s", header, HeaderXForwardedFor, HeaderForwarded)
+	}
+
+	for _, cidr := range trusted {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// Resolve returns the client address of the request
+func (r *Resolver) Resolve(req *http.Request) string {
+	ip := remoteIP(req)
+	if ip == nil {
+		return ""
+	}
+	if !r.isTrusted(ip) {
+		return ip.String()
+	}
+
+	// the last hop is added by the nearest proxy, the first one may be written by the client
+	hops := forwardedFor(req.Header, r.forwarded)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if hop == nil {
+			// the chain before an invalid hop can't be trusted
+			break
+		}
+		ip = hop
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Middleware resolves the client address of every request. It must be the first middleware
+func (r *Resolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(contextKey, r.Resolve(c.Request))
+		c.Next()
+	}
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromContext returns the client address resolved by the middleware.
+//
+// Without the middleware it's the address of the connection peer, forwarding headers are never trusted.
+func FromContext(c *gin.Context) string {
+	if ip := c.GetString(contextKey); ip != "" {
+		return ip
+	}
+	if ip := remoteIP(c.Request); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// remoteIP returns the address of the connection peer
+func remoteIP(req *http.Request) net.IP {
+	return parseIP(req.RemoteAddr)
+}
+
+// forwardedFor returns the chain of client and proxy addresses from the first hop to the last
+// of the standard Forwarded header or of X-Forwarded-For
+func forwardedFor(h http.Header, forwarded bool) []string {
+	var hops []string
+	if forwarded {
+		// Forwarded: for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"
+		for _, v := range h["Forwarded"] {
+			for _, elem := range strings.Split(v, ",") {
+				hop := ""
+				for _, pair := range strings.Split(elem, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hop = strings.Trim(kv[1], `"`)
+					}
+				}
+				// an element without an address still is a hop
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	for _, v := range h["X-Forwarded-For"] {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseIP parses an address with an optional port. Obfuscated identifiers like "unknown" are invalid
+func parseIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,167 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", " "}, HeaderXForwardedFor)
+	assert.NoError(t, err)
+	_, err = New(nil, "Forwarded")
+	assert.NoError(t, err)
+
+	_, err = New([]string{"10.0.0.0/33"}, HeaderXForwardedFor)
+	assert.Error(t, err)
+	_, err = New([]string{"proxy.local"}, HeaderXForwardedFor)
+	assert.Error(t, err)
+	_, err = New(nil, "x-real-ip")
+	assert.Error(t, err)
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	xff, err := New([]string{"10.0.0.0/8", "2001:db8::1"}, HeaderXForwardedFor)
+	require.NoError(t, err)
+	fwd, err := New([]string{"10.0.0.0/8", "2001:db8::1"}, HeaderForwarded)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		forwarded bool
+		remote    string
+		header    http.Header
+		want      string
+	}{
+		{
+			name:   "direct client",
+			remote: "203.0.113.5:4000",
+			want:   "203.0.113.5",
+		},
+		{
+			name:   "untrusted peer can't spoof",
+			remote: "203.0.113.5:4000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "203.0.113.5",
+		},
+		{
+			name:   "trusted proxy",
+			remote: "10.0.0.1:4000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "spoofed first hop is skipped",
+			remote: "10.0.0.1:4000",
+			header: http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "several header lines",
+			remote: "10.0.0.1:4000",
+			header: http.Header{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "only trusted hops",
+			remote: "10.0.0.1:4000",
+			header: http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:   "10.0.0.3",
+		},
+		{
+			name:   "invalid hop",
+			remote: "10.0.0.1:4000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}},
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "no header",
+			remote: "10.0.0.1:4000",
+			want:   "10.0.0.1",
+		},
+		{
+			// the proxy only appends to X-Forwarded-For and passes Forwarded of the client as is
+			name:   "forged forwarded behind x-forwarded-for proxy",
+			remote: "10.0.0.1:4000",
+			header: http.Header{
+				"Forwarded":       {"for=1.2.3.4"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:   "forged forwarded without x-forwarded-for",
+			remote: "10.0.0.1:4000",
+			header: http.Header{"Forwarded": {"for=1.2.3.4"}},
+			want:   "10.0.0.1",
+		},
+		{
+			name:      "forwarded",
+			forwarded: true,
+			remote:    "[2001:db8::1]:4000",
+			header:    http.Header{"Forwarded": {`for=1.1.1.1, for="[2001:db8:cafe::17]:4711";proto=https, For=10.0.0.2;by=10.0.0.1`}},
+			want:      "2001:db8:cafe::17",
+		},
+		{
+			name:      "forged x-forwarded-for behind forwarded proxy",
+			forwarded: true,
+			remote:    "10.0.0.1:4000",
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.1:80"},
+				"X-Forwarded-For": {"1.1.1.1"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:      "obfuscated forwarded hop",
+			forwarded: true,
+			remote:    "10.0.0.1:4000",
+			header:    http.Header{"Forwarded": {"for=1.1.1.1, for=unknown"}},
+			want:      "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			r := xff
+			if tt.forwarded {
+				r = fwd
+			}
+			assert.Equal(t, tt.want, r.Resolve(req))
+		})
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r, err := New([]string{"10.0.0.0/8"}, HeaderXForwardedFor)
+	require.NoError(t, err)
+
+	var got string
+	handler := func(c *gin.Context) { got = FromContext(c) }
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	// headers aren't trusted without the middleware
+	router := gin.New()
+	router.GET("/", handler)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "10.0.0.1", got)
+
+	router = gin.New()
+	router.Use(r.Middleware())
+	router.GET("/", handler)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "198.51.100.1", got)
+}
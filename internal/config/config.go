@@ -1,16 +1,59 @@
 package config
 
+import "time"
+
 // RedisConfig is a redis-related configuration
 type RedisConfig struct {
 	URL  string `env:"REDIS_URL" env-description:"URL of Redis server including options"`
 	Port string `env:"REDIS_PORT" env-description:"Redis port"`
 	Host string `env:"REDIS_HOST" env-description:"Redis host"`
+
+	Mode       string   `env:"REDIS_MODE" env-default:"single" env-description:"Redis deployment: single server, sentinel-managed failover or cluster"`
+	Addrs      []string `env:"REDIS_ADDRS" env-description:"Comma-separated list of sentinel addresses in sentinel mode or seed node addresses in cluster mode"`
+	MasterName string   `env:"REDIS_MASTER_NAME" env-description:"Name of the master monitored by sentinels"`
+
+	TLS           bool   `env:"REDIS_TLS" env-default:"false" env-description:"Connect with TLS, a rediss:// URL enables it too"`
+	TLSCA         string `env:"REDIS_TLS_CA" env-description:"Path to a PEM CA bundle verifying the server certificate. System CAs are used if empty"`
+	TLSCert       string `env:"REDIS_TLS_CERT" env-description:"Path to a PEM client certificate file"`
+	TLSKey        string `env:"REDIS_TLS_KEY" env-description:"Path to a PEM client private key file"`
+	TLSServerName string `env:"REDIS_TLS_SERVER_NAME" env-description:"Server name verified in the server certificate. The host is used in single mode if empty, required in sentinel and cluster modes"`
+
+	Username string `env:"REDIS_USERNAME" env-description:"ACL user name, requires Redis 6. The default user is used if empty"`
+	Password string `env:"REDIS_PASSWORD" env-description:"Password of the user"`
+	DB       int    `env:"REDIS_DB" env-default:"0" env-description:"Database index, only 0 in cluster mode"`
+
+	PoolSize     int           `env:"REDIS_POOL_SIZE" env-default:"0" env-description:"Maximum number of connections per node, 0 means 10 per CPU"`
+	DialTimeout  time.Duration `env:"REDIS_DIAL_TIMEOUT" env-default:"5s" env-description:"Timeout of establishing a connection"`
+	ReadTimeout  time.Duration `env:"REDIS_READ_TIMEOUT" env-default:"3s" env-description:"Timeout of reading a reply"`
+	WriteTimeout time.Duration `env:"REDIS_WRITE_TIMEOUT" env-default:"3s" env-description:"Timeout of writing a command"`
+	MaxRetries   int           `env:"REDIS_MAX_RETRIES" env-default:"0" env-description:"Number of retries of a failed command, 0 disables retries"`
+}
+
+// StorageConfig contains storage driver settings
+type StorageConfig struct {
+	Driver string `env:"STORAGE_DRIVER" env-default:"redis" env-description:"Storage driver: redis, memory, bolt, postgres or sqlite3"`
+	Path   string `env:"STORAGE_PATH" env-default:"secret.db" env-description:"Database file path for bolt driver"`
+	DSN    string `env:"STORAGE_DSN" env-description:"Data source name for postgres and sqlite3 drivers"`
 }
 
 // ServerConfig is a server-related configuration
 type ServerConfig struct {
-	Port string `env:"SERVER_PORT,PORT" env-default:"8080" env-description:"Server port"`
-	Host string `env:"SERVER_HOST" env-description:"Server host"`
+	Port          string `env:"SERVER_PORT,PORT" env-default:"8080" env-description:"Server port"`
+	Host          string `env:"SERVER_HOST" env-description:"Server host"`
+	TLSCert       string `env:"SERVER_TLS_CERT" env-description:"Path to a PEM TLS certificate file. The server uses plain HTTP if empty"`
+	TLSKey        string `env:"SERVER_TLS_KEY" env-description:"Path to a PEM TLS private key file"`
+	TLSClientCA   string `env:"SERVER_TLS_CLIENT_CA" env-description:"Path to a PEM CA bundle verifying client certificates"`
+	TLSClientAuth string `env:"SERVER_TLS_CLIENT_AUTH" env-default:"none" env-description:"Client certificate verification: none, verify (if sent) or require"`
+
+	ReadTimeout     time.Duration `env:"SERVER_READ_TIMEOUT" env-default:"1m" env-description:"Maximum duration of reading a request including the body"`
+	WriteTimeout    time.Duration `env:"SERVER_WRITE_TIMEOUT" env-default:"1m" env-description:"Maximum duration of writing a response"`
+	IdleTimeout     time.Duration `env:"SERVER_IDLE_TIMEOUT" env-default:"2m" env-description:"Maximum time to wait for the next request on a keep-alive connection"`
+	ShutdownTimeout time.Duration `env:"SERVER_SHUTDOWN_TIMEOUT" env-default:"30s" env-description:"Maximum duration of a graceful shutdown: draining requests and flushing webhook events"`
+	ShutdownDelay   time.Duration `env:"SERVER_SHUTDOWN_DELAY" env-default:"0s" env-description:"Time to keep serving requests with failing readiness before the shutdown, so load balancers can notice it"`
+	ReadyTimeout    time.Duration `env:"SERVER_READY_TIMEOUT" env-default:"2s" env-description:"Timeout of every dependency check of the readiness probe"`
+
+	TrustedProxies  []string `env:"SERVER_TRUSTED_PROXIES" env-description:"Comma-separated list of CIDRs or IP addresses of reverse proxies allowed to set the forwarding header"`
+	ForwardedHeader string   `env:"SERVER_FORWARDED_HEADER" env-default:"x-forwarded-for" env-description:"Header set by trusted proxies: x-forwarded-for or forwarded"`
 }
 
 // RedirectConfig contains redirection settings
@@ -19,9 +62,92 @@ type RedirectConfig struct {
 	API  string `env:"REDIRECT_API" env-default:"http://bit.ly/2MrGGf8" env-description:"Redirect to API documentation"`
 }
 
+// KeyringConfig contains server-side key-encryption key settings
+type KeyringConfig struct {
+	Keys    string `env:"KEK_KEYS" env-description:"Comma-separated list of key-encryption keys in format id:base64key"`
+	File    string `env:"KEK_FILE" env-description:"Path to a file with key-encryption keys, one id:base64key per line"`
+	Primary string `env:"KEK_PRIMARY" env-description:"ID of the key-encryption key used for new secrets. The first key is used by default"`
+}
+
+// JanitorConfig contains settings of the expired secret sweeper
+type JanitorConfig struct {
+	Interval  time.Duration `env:"JANITOR_INTERVAL" env-default:"10m" env-description:"Interval between sweeps of expired secrets, 0 disables sweeping"`
+	BatchSize int           `env:"JANITOR_BATCH_SIZE" env-default:"100" env-description:"Number of secrets deleted at once"`
+}
+
+// WebhookConfig contains settings of secret lifecycle event webhooks
+type WebhookConfig struct {
+	Secret       string        `env:"WEBHOOK_SECRET" env-description:"Key of HMAC-SHA256 webhook signatures. Webhooks are disabled if empty"`
+	Retries      int           `env:"WEBHOOK_RETRIES" env-default:"5" env-description:"Number of delivery attempts before an event becomes a dead letter"`
+	Backoff      time.Duration `env:"WEBHOOK_BACKOFF" env-default:"1s" env-description:"Initial delay between delivery attempts, doubled after each attempt"`
+	Timeout      time.Duration `env:"WEBHOOK_TIMEOUT" env-default:"10s" env-description:"Timeout of a single delivery attempt"`
+	QueueSize    int           `env:"WEBHOOK_QUEUE_SIZE" env-default:"1000" env-description:"Number of events waiting for delivery"`
+	Workers      int           `env:"WEBHOOK_WORKERS" env-default:"4" env-description:"Number of concurrent deliveries"`
+	AllowPrivate bool          `env:"WEBHOOK_ALLOW_PRIVATE" env-default:"false" env-description:"Allow deliveries to loopback, link-local and private addresses"`
+}
+
+// FileConfig contains file secret settings
+type FileConfig struct {
+	MaxBytes  int64 `env:"FILE_MAX_BYTES" env-default:"10485760" env-description:"Maximum size of a file secret in bytes"`
+	ChunkSize int   `env:"FILE_CHUNK_SIZE" env-default:"262144" env-description:"Size of stored file chunks in bytes"`
+}
+
+// PolicyConfig contains secret creation and access policy settings
+type PolicyConfig struct {
+	PassphraseAttempts  int           `env:"PASSPHRASE_MAX_ATTEMPTS" env-default:"5" env-description:"Number of wrong passphrase attempts before the secret is deleted"`
+	MaxBytes            int           `env:"SECRET_MAX_BYTES" env-default:"0" env-description:"Maximum size of a secret text in bytes, 0 means no limit"`
+	MaxViews            int           `env:"SECRET_MAX_VIEWS" env-default:"0" env-description:"Maximum number of views of a secret, 0 means no limit"`
+	MaxTTL              time.Duration `env:"SECRET_MAX_TTL" env-default:"0" env-description:"Maximum lifetime of a secret, 0 means no limit"`
+	DefaultTTL          time.Duration `env:"SECRET_DEFAULT_TTL" env-default:"0" env-description:"Lifetime of a secret created without expiration time, 0 means it never expires"`
+	AllowNeverExpire    bool          `env:"SECRET_ALLOW_NEVER_EXPIRE" env-default:"true" env-description:"Allow secrets that never expire"`
+	AllowedContentTypes []string      `env:"SECRET_ALLOWED_CONTENT_TYPES" env-description:"Comma-separated list of allowed content types of file secrets, e.g. text/plain,text/*. Any type is allowed if empty"`
+}
+
+// RateLimitConfig contains request rate limit settings
+type RateLimitConfig struct {
+	Store  string            `env:"RATE_LIMIT_STORE" env-default:"memory" env-description:"Rate limit bucket store: memory for a single replica or redis to share limits between replicas"`
+	Routes map[string]string `env:"RATE_LIMIT_ROUTES" env-description:"Comma-separated list of endpoint limits in format endpoint:limit/period, e.g. secret_post:10/m,secret_get:60/m. Endpoints aren't limited if empty"`
+}
+
+// TenantConfig contains API key authentication and tenant settings
+type TenantConfig struct {
+	KeysFile     string            `env:"API_KEYS_FILE" env-description:"Path to the API key file managed by the api-key command. Authentication is disabled if empty"`
+	ReadRequired bool              `env:"API_KEYS_REQUIRED_FOR_READ" env-default:"false" env-description:"Require API keys for reading secrets, not only for creating them"`
+	Quotas       map[string]string `env:"TENANT_QUOTAS" env-description:"Comma-separated list of secret creation quotas in format tenant:limit/period, e.g. team-a:1000/h"`
+	DefaultQuota string            `env:"TENANT_DEFAULT_QUOTA" env-description:"Secret creation quota of tenants without their own quota, e.g. 100/h. No quota if empty"`
+}
+
+// LogConfig contains logging settings
+type LogConfig struct {
+	Level          string `env:"LOG_LEVEL" env-default:"info" env-description:"Minimal log level: debug, info, warn or error"`
+	Format         string `env:"LOG_FORMAT" env-default:"json" env-description:"Log format: json or text"`
+	Redaction      string `env:"LOG_REDACTION" env-default:"mask" env-description:"Redaction of secret hashes in logs: mask keeps the first characters, fingerprint replaces them with a keyed hash"`
+	FingerprintKey string `env:"LOG_FINGERPRINT_KEY" env-description:"Key of hash fingerprints. A random key is used if empty, so fingerprints don't match across restarts and replicas"`
+}
+
+// AuditConfig contains settings of the audit trail of secret lifecycle events
+type AuditConfig struct {
+	File        string `env:"AUDIT_FILE" env-description:"Path to a JSONL file of audit entries"`
+	Syslog      string `env:"AUDIT_SYSLOG" env-description:"Syslog address of audit entries: local or network://host:port, e.g. udp://localhost:514"`
+	RedisStream string `env:"AUDIT_REDIS_STREAM" env-description:"Name of a Redis stream of audit entries, requires redis storage"`
+	Key         string `env:"AUDIT_KEY" env-description:"Key of HMAC-SHA256 entry hashes and of fingerprints of legacy secrets. Plain SHA-256 is used if empty, so the chain can be rebuilt by anyone who can edit the trail"`
+	Source      string `env:"AUDIT_SOURCE" env-description:"Name of this replica in audit entries, the host name is used if empty"`
+	QueueSize   int    `env:"AUDIT_QUEUE_SIZE" env-default:"1000" env-description:"Number of events waiting to be written, requests wait if the queue is full"`
+}
+
 // Config is an application configuration structure
 type Config struct {
-	Redis    RedisConfig
-	Server   ServerConfig
-	Redirect RedirectConfig
+	Storage   StorageConfig
+	Redis     RedisConfig
+	Server    ServerConfig
+	Redirect  RedirectConfig
+	Keyring   KeyringConfig
+	Janitor   JanitorConfig
+	Policy    PolicyConfig
+	Webhook   WebhookConfig
+	File      FileConfig
+	RateLimit RateLimitConfig
+	Tenant    TenantConfig
+	Log       LogConfig
+	Audit     AuditConfig
 }
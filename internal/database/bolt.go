@@ -0,0 +1,171 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltSecretBucket = []byte("secret")
+
+// BoltDB is an embedded file database for single-node installations
+type BoltDB struct {
+	db *bolt.DB
+}
+
+// NewBoltDB opens or creates a database file
+func NewBoltDB(path string) (*BoltDB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSecretBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltDB{
+		db: db,
+	}, nil
+}
+
+// Close closes the database file
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+// GetSecret returns a secret or errors
+func (b *BoltDB) GetSecret(hash string) (*models.Secret, error) {
+	var s models.Secret
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return getBoltSecret(tx, hash, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateSecret creates a new secret
+func (b *BoltDB) CreateSecret(hash string, s models.Secret) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putBoltSecret(tx, hash, s)
+	})
+}
+
+// DeleteSecret removes existing secret
+func (b *BoltDB) DeleteSecret(hash string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSecretBucket).Delete([]byte(hash))
+	})
+}
+
+// UpdateSecret decreases secret view counter
+func (b *BoltDB) UpdateSecret(hash string, s models.Secret) error {
+	// write transactions are serialized, so the version check is atomic
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var current models.Secret
+		if err := getBoltSecret(tx, hash, &current); err != nil {
+			return err
+		}
+		if current.Version != s.Version {
+			return ErrSecretModified
+		}
+
+		s.Version++
+		return putBoltSecret(tx, hash, s)
+	})
+}
+
+// ConsumeSecret atomically checks the secret validity and decrements its view counter.
+//
+// The secret is deleted if it is outdated or has no views left after the decrement.
+func (b *BoltDB) ConsumeSecret(hash string, now time.Time) (*models.Secret, error) {
+	var (
+		s          models.Secret
+		errConsume error
+	)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := getBoltSecret(tx, hash, &s); err != nil {
+			return err
+		}
+		if errConsume = consume(&s, now); errConsume != nil || s.RemainingViews == 0 {
+			return tx.Bucket(boltSecretBucket).Delete([]byte(hash))
+		}
+
+		s.Version++
+		return putBoltSecret(tx, hash, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errConsume != nil {
+		// deletion of outdated secret must be committed before the error is returned
+		return nil, errConsume
+	}
+	return &s, nil
+}
+
+// ForEachSecret calls fn for every stored secret hash
+func (b *BoltDB) ForEachSecret(fn func(hash string) error) error {
+	// collect hashes first, fn can't be called inside a read transaction
+	// because it may need a write transaction
+	var hashes []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSecretBucket).ForEach(func(k, _ []byte) error {
+			hashes = append(hashes, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltRecord is a stored secret with its version
+type boltRecord struct {
+	models.SecretBase
+	Version int64 `json:"version"`
+}
+
+func getBoltSecret(tx *bolt.Tx, hash string, s *models.Secret) error {
+	data := tx.Bucket(boltSecretBucket).Get([]byte(hash))
+	if data == nil {
+		return ErrNotFound
+	}
+
+	var rec boltRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	*s = models.Secret{
+		SecretBase: rec.SecretBase,
+		Version:    rec.Version,
+	}
+	return nil
+}
+
+func putBoltSecret(tx *bolt.Tx, hash string, s models.Secret) error {
+	data, err := json.Marshal(boltRecord{
+		SecretBase: s.SecretBase,
+		Version:    s.Version,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltSecretBucket).Put([]byte(hash), data)
+}
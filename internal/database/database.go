@@ -0,0 +1,68 @@
+/*
+Package database contains secret storage drivers.
+
+Every driver stores secrets with a version tag and implements optimistic concurrency control:
+a secret can only be updated if its version wasn't changed since it was read.
+*/
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+// storage driver names
+const (
+	DriverRedis    = "redis"
+	DriverMemory   = "memory"
+	DriverBolt     = "bolt"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+var (
+	// ErrNotFound secret doesn't exist
+	ErrNotFound = errors.New("secret not found")
+	// ErrSecretModified secret version has changed since it was read
+	ErrSecretModified = errors.New("secret was modified from another session. Try again")
+	// ErrSecretOutdated secret in not valid anymore
+	ErrSecretOutdated = errors.New("secret isn't valid anymore")
+)
+
+// Database is a secret storage
+type Database interface {
+	GetSecret(hash string) (*models.Secret, error)
+	CreateSecret(hash string, s models.Secret) error
+	DeleteSecret(hash string) error
+	UpdateSecret(hash string, s models.Secret) error
+	ConsumeSecret(hash string, now time.Time) (*models.Secret, error)
+	ForEachSecret(fn func(hash string) error) error
+}
+
+// Pinger is a database with a network connection that can be checked
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Migrator is a database with a data layout migration
+type Migrator interface {
+	Migrate() (int, error)
+}
+
+// consume checks secret validity and decrements its view counter.
+//
+// Returns ErrSecretOutdated if the secret is expired or has no views left.
+// Such secret must be deleted.
+func consume(s *models.Secret, now time.Time) error {
+	if s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
+		return ErrSecretOutdated
+	}
+	if s.RemainingViews <= 0 {
+		return ErrSecretOutdated
+	}
+	s.RemainingViews--
+	return nil
+}
@@ -0,0 +1,409 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDatabase is a conformance test suite every driver must pass
+func testDatabase(t *testing.T, db Database) {
+	now := time.Now().UTC().Truncate(time.Second)
+	exp := now.Add(time.Hour)
+
+	newSecret := func(views int32) models.Secret {
+		return models.Secret{
+			SecretBase: models.SecretBase{
+				CreatedAt:      now,
+				ExpiresAt:      &exp,
+				RemainingViews: views,
+				SecretText:     "encrypted",
+				KeyHash:        "key hash",
+			},
+		}
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := db.GetSecret("conformance-missing")
+		assert.Equal(t, ErrNotFound, err)
+
+		err = db.UpdateSecret("conformance-missing", newSecret(1))
+		assert.Equal(t, ErrNotFound, err)
+
+		assert.NoError(t, db.DeleteSecret("conformance-missing"))
+	})
+
+	t.Run("create, get and delete", func(t *testing.T) {
+		hash := "conformance-crud"
+		require.NoError(t, db.CreateSecret(hash, newSecret(10)))
+		defer db.DeleteSecret(hash)
+
+		s, err := db.GetSecret(hash)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), s.Version)
+		assert.True(t, now.Equal(s.CreatedAt))
+		require.NotNil(t, s.ExpiresAt)
+		assert.True(t, exp.Equal(*s.ExpiresAt))
+		assert.Equal(t, int32(10), s.RemainingViews)
+		assert.Equal(t, "encrypted", s.SecretText)
+		assert.Equal(t, "key hash", s.KeyHash)
+
+		require.NoError(t, db.DeleteSecret(hash))
+		_, err = db.GetSecret(hash)
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("update increments version", func(t *testing.T) {
+		hash := "conformance-update"
+		require.NoError(t, db.CreateSecret(hash, newSecret(10)))
+		defer db.DeleteSecret(hash)
+
+		s, err := db.GetSecret(hash)
+		require.NoError(t, err)
+		s.RemainingViews--
+		require.NoError(t, db.UpdateSecret(hash, *s))
+
+		s, err = db.GetSecret(hash)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), s.Version)
+		assert.Equal(t, int32(9), s.RemainingViews)
+	})
+
+	t.Run("stale update is rejected", func(t *testing.T) {
+		hash := "conformance-stale"
+		require.NoError(t, db.CreateSecret(hash, newSecret(10)))
+		defer db.DeleteSecret(hash)
+
+		first, err := db.GetSecret(hash)
+		require.NoError(t, err)
+		second, err := db.GetSecret(hash)
+		require.NoError(t, err)
+
+		first.RemainingViews--
+		require.NoError(t, db.UpdateSecret(hash, *first))
+
+		second.RemainingViews--
+		assert.Equal(t, ErrSecretModified, db.UpdateSecret(hash, *second))
+
+		s, err := db.GetSecret(hash)
+		require.NoError(t, err)
+		assert.Equal(t, int32(9), s.RemainingViews)
+	})
+
+	t.Run("concurrent updates", func(t *testing.T) {
+		hash := "conformance-concurrent"
+		workers := 10
+		require.NoError(t, db.CreateSecret(hash, newSecret(int32(workers))))
+		defer db.DeleteSecret(hash)
+
+		// every worker retries until its decrement succeeds
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					s, err := db.GetSecret(hash)
+					if err != nil {
+						errs <- err
+						return
+					}
+					s.RemainingViews--
+					err = db.UpdateSecret(hash, *s)
+					if err == ErrSecretModified {
+						continue
+					}
+					errs <- err
+					return
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.NoError(t, err)
+		}
+
+		s, err := db.GetSecret(hash)
+		require.NoError(t, err)
+		assert.Equal(t, int32(0), s.RemainingViews)
+		assert.Equal(t, int64(workers), s.Version)
+	})
+
+	t.Run("consume", func(t *testing.T) {
+		hash := "conformance-consume"
+		require.NoError(t, db.CreateSecret(hash, newSecret(2)))
+		defer db.DeleteSecret(hash)
+
+		s, err := db.ConsumeSecret(hash, now)
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), s.RemainingViews)
+		assert.Equal(t, "encrypted", s.SecretText)
+		require.NotNil(t, s.ExpiresAt)
+		assert.True(t, exp.Equal(*s.ExpiresAt))
+
+		stored, err := db.GetSecret(hash)
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), stored.RemainingViews)
+		assert.Equal(t, s.Version, stored.Version)
+
+		// the last view deletes the secret
+		s, err = db.ConsumeSecret(hash, now)
+		require.NoError(t, err)
+		assert.Equal(t, int32(0), s.RemainingViews)
+
+		_, err = db.GetSecret(hash)
+		assert.Equal(t, ErrNotFound, err)
+		_, err = db.ConsumeSecret(hash, now)
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("consume expired", func(t *testing.T) {
+		hash := "conformance-consume-expired"
+		require.NoError(t, db.CreateSecret(hash, newSecret(2)))
+		defer db.DeleteSecret(hash)
+
+		_, err := db.ConsumeSecret(hash, exp.Add(time.Millisecond))
+		assert.Equal(t, ErrSecretOutdated, err)
+
+		_, err = db.GetSecret(hash)
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("consume expired with time zone", func(t *testing.T) {
+		hash := "conformance-consume-zone"
+		s := newSecret(2)
+		zoneExp := exp.In(time.FixedZone("test", -5*60*60))
+		s.ExpiresAt = &zoneExp
+		require.NoError(t, db.CreateSecret(hash, s))
+		defer db.DeleteSecret(hash)
+
+		_, err := db.ConsumeSecret(hash, exp.Add(-time.Millisecond))
+		assert.NoError(t, err)
+		_, err = db.ConsumeSecret(hash, exp.Add(time.Millisecond))
+		assert.Equal(t, ErrSecretOutdated, err)
+	})
+
+	t.Run("consume without views", func(t *testing.T) {
+		hash := "conformance-consume-views"
+		require.NoError(t, db.CreateSecret(hash, newSecret(0)))
+		defer db.DeleteSecret(hash)
+
+		_, err := db.ConsumeSecret(hash, now)
+		assert.Equal(t, ErrSecretOutdated, err)
+
+		_, err = db.GetSecret(hash)
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("concurrent consume", func(t *testing.T) {
+		hash := "conformance-consume-concurrent"
+		views, readers := 5, 20
+		require.NoError(t, db.CreateSecret(hash, newSecret(int32(views))))
+		defer db.DeleteSecret(hash)
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			success int
+		)
+		for i := 0; i < readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.ConsumeSecret(hash, now)
+				if err != nil && err != ErrNotFound && err != ErrSecretOutdated {
+					t.Errorf("ConsumeSecret() unexpected error %v", err)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					success++
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, views, success)
+		_, err := db.GetSecret(hash)
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("for each", func(t *testing.T) {
+		hashes := []string{"conformance-each-1", "conformance-each-2", "conformance-each-3"}
+		for _, hash := range hashes {
+			require.NoError(t, db.CreateSecret(hash, newSecret(1)))
+			defer db.DeleteSecret(hash)
+		}
+
+		var got []string
+		err := db.ForEachSecret(func(hash string) error {
+			// modification inside the iteration must be possible
+			if hash == hashes[0] {
+				if err := db.DeleteSecret(hash); err != nil {
+					return err
+				}
+			}
+			for _, h := range hashes {
+				if h == hash {
+					got = append(got, hash)
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Strings(got)
+		assert.Equal(t, hashes, got)
+	})
+}
+
+func TestMemoryDB(t *testing.T) {
+	testDatabase(t, NewMemoryDB())
+}
+
+func TestBoltDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-bolt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewBoltDB(filepath.Join(dir, "secret.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	testDatabase(t, db)
+}
+
+func TestSQLDB_SQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-sqlite")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewSQLDB(DriverSQLite, filepath.Join(dir, "secret.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	testDatabase(t, db)
+	// hashes of the longest tenant name fit the hash column
+	testDatabase(t, Namespace(db, strings.Repeat("t", 63)))
+}
+
+func TestSQLLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-sqlite")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewSQLDB(DriverSQLite, filepath.Join(dir, "secret.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC)
+	first, second := db.NewLock("test"), db.NewLock("test")
+	first.nowFunc = func() time.Time { return now }
+	second.nowFunc = func() time.Time { return now }
+
+	ok, err := first.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = second.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// other locks are independent
+	ok, err = db.NewLock("other").TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the lock expires
+	now = now.Add(time.Minute)
+	ok, err = second.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = first.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSQLDB_Postgres(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := NewSQLDB(DriverPostgres, dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	testDatabase(t, db)
+	// hashes of the longest tenant name fit the hash column
+	testDatabase(t, Namespace(db, strings.Repeat("t", 63)))
+}
+
+func TestRedisDB(t *testing.T) {
+	// use an embedded Redis server if a real one isn't provided
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		mr, err := miniredis.Run()
+		require.NoError(t, err)
+		defer mr.Close()
+		url = "redis://" + mr.Addr()
+	}
+
+	db, err := NewRedisDBWithOpts(url)
+	require.NoError(t, err)
+
+	testDatabase(t, db)
+}
+
+func TestNamespace(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	rdb, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	for name, db := range map[string]Database{
+		"memory": NewMemoryDB(),
+		"redis":  rdb,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testDatabase(t, Namespace(db, "acme"))
+
+			// tenants don't see secrets of each other
+			acme, other := Namespace(db, "acme"), Namespace(db, "other")
+			require.NoError(t, acme.CreateSecret("ns", models.Secret{SecretBase: models.SecretBase{RemainingViews: 1}}))
+			defer acme.DeleteSecret("ns")
+
+			_, err := acme.GetSecret("ns")
+			assert.NoError(t, err)
+			_, err = other.GetSecret("ns")
+			assert.Equal(t, ErrNotFound, err)
+			_, err = db.GetSecret("ns")
+			assert.Equal(t, ErrNotFound, err)
+
+			var got []string
+			require.NoError(t, other.ForEachSecret(func(hash string) error {
+				got = append(got, hash)
+				return nil
+			}))
+			assert.Empty(t, got)
+		})
+	}
+
+	// all Redis keys of the tenant are prefixed
+	rdb.Namespace("acme").CreateSecret("ns", models.Secret{SecretBase: models.SecretBase{RemainingViews: 1}})
+	assert.True(t, mr.Exists("tenant:acme:secret:{ns}"))
+}
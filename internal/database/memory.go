@@ -0,0 +1,124 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+// MemoryDB is a thread-safe in-memory database for development and tests
+type MemoryDB struct {
+	mu      sync.RWMutex
+	secrets map[string]models.Secret
+}
+
+// NewMemoryDB creates a new empty in-memory database
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		secrets: make(map[string]models.Secret),
+	}
+}
+
+// GetSecret returns a secret or errors
+func (m *MemoryDB) GetSecret(hash string) (*models.Secret, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.secrets[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s = copySecret(s)
+	return &s, nil
+}
+
+// CreateSecret creates a new secret
+func (m *MemoryDB) CreateSecret(hash string, s models.Secret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.secrets[hash] = copySecret(s)
+	return nil
+}
+
+// DeleteSecret removes existing secret
+func (m *MemoryDB) DeleteSecret(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.secrets, hash)
+	return nil
+}
+
+// UpdateSecret decreases secret view counter
+func (m *MemoryDB) UpdateSecret(hash string, s models.Secret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.secrets[hash]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.Version != s.Version {
+		return ErrSecretModified
+	}
+
+	s = copySecret(s)
+	s.Version++
+	m.secrets[hash] = s
+	return nil
+}
+
+// ConsumeSecret atomically checks the secret validity and decrements its view counter.
+//
+// The secret is deleted if it is outdated or has no views left after the decrement.
+func (m *MemoryDB) ConsumeSecret(hash string, now time.Time) (*models.Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.secrets[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if err := consume(&s, now); err != nil {
+		delete(m.secrets, hash)
+		return nil, err
+	}
+
+	if s.RemainingViews == 0 {
+		delete(m.secrets, hash)
+	} else {
+		s.Version++
+		m.secrets[hash] = s
+	}
+	s = copySecret(s)
+	return &s, nil
+}
+
+// ForEachSecret calls fn for every stored secret hash
+func (m *MemoryDB) ForEachSecret(fn func(hash string) error) error {
+	// collect hashes first to allow fn to modify the database
+	m.mu.RLock()
+	hashes := make([]string, 0, len(m.secrets))
+	for hash := range m.secrets {
+		hashes = append(hashes, hash)
+	}
+	m.mu.RUnlock()
+
+	for _, hash := range hashes {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySecret returns a deep copy of the secret to prevent sharing of pointer fields
+func copySecret(s models.Secret) models.Secret {
+	if s.ExpiresAt != nil {
+		exp := *s.ExpiresAt
+		s.ExpiresAt = &exp
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+// namespaceSeparator separates a tenant name from secret hashes in databases without native namespaces
+const namespaceSeparator = "/"
+
+// Namespacer is a database with native tenant namespaces
+type Namespacer interface {
+	Namespace(tenant string) Database
+}
+
+// Namespace returns a database of the tenant namespace.
+//
+// Databases without native namespaces store secrets of the tenant under hashes prefixed with the tenant name.
+// Such secrets are still visible in the default namespace, so the janitor and key rotation process them.
+// Empty tenant is the default namespace.
+func Namespace(db Database, tenant string) Database {
+	if tenant == "" {
+		return db
+	}
+	if n, ok := db.(Namespacer); ok {
+		return n.Namespace(tenant)
+	}
+	return &namespaceDB{
+		db:     db,
+		prefix: tenant + namespaceSeparator,
+	}
+}
+
+// namespaceDB is a tenant namespace of a database based on hash prefixes
+type namespaceDB struct {
+	db     Database
+	prefix string
+}
+
+// GetSecret returns a secret or errors
+func (n *namespaceDB) GetSecret(hash string) (*models.Secret, error) {
+	return n.db.GetSecret(n.prefix + hash)
+}
+
+// CreateSecret creates a new secret
+func (n *namespaceDB) CreateSecret(hash string, s models.Secret) error {
+	return n.db.CreateSecret(n.prefix+hash, s)
+}
+
+// DeleteSecret removes existing secret
+func (n *namespaceDB) DeleteSecret(hash string) error {
+	return n.db.DeleteSecret(n.prefix + hash)
+}
+
+// UpdateSecret updates a secret if its version wasn't changed
+func (n *namespaceDB) UpdateSecret(hash string, s models.Secret) error {
+	return n.db.UpdateSecret(n.prefix+hash, s)
+}
+
+// ConsumeSecret checks the secret validity and decrements its view counter
+func (n *namespaceDB) ConsumeSecret(hash string, now time.Time) (*models.Secret, error) {
+	return n.db.ConsumeSecret(n.prefix+hash, now)
+}
+
+// ForEachSecret calls fn for every secret hash of the namespace
+func (n *namespaceDB) ForEachSecret(fn func(hash string) error) error {
+	return n.db.ForEachSecret(func(hash string) error {
+		if !strings.HasPrefix(hash, n.prefix) {
+			return nil
+		}
+		return fn(strings.TrimPrefix(hash, n.prefix))
+	})
+}
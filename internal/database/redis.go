@@ -1,108 +1,454 @@
 package database
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/ilyakaznacheev/secret/internal/logging"
 	"github.com/ilyakaznacheev/secret/internal/models"
 )
 
 const (
-	hashSecretKey  = "secret"
-	hashVersionKey = "secret_version"
+	// secretKeyPrefix is a prefix of per-secret keys. The secret id follows it as a hash tag
+	secretKeyPrefix = "secret:"
+
+	// fields of a secret key
+	fieldData    = "data"
+	fieldVersion = "version"
+	fieldExpires = "expires"
+
+	// legacy layout keeps all secrets in one hash map with separate version keys
+	legacyHashSecretKey  = "secret"
+	legacyHashVersionKey = "secret_version"
+
+	// lockKeyPrefix is a prefix of distributed lock keys
+	lockKeyPrefix = "lock:"
+	// rateLimitKeyPrefix is a prefix of rate limit token bucket keys
+	rateLimitKeyPrefix = "ratelimit:"
+	// tenantKeyPrefix is a prefix of all keys of a tenant namespace
+	tenantKeyPrefix = "tenant:"
+
+	// scanBatchSize is a number of elements requested per scan iteration
+	scanBatchSize = 100
 )
 
-// RedisDB is a database interaction manager for Redis
+// consumeScript atomically checks the secret validity, decrements its view counter
+// and deletes it when it is outdated or has no views left.
+//
+// KEYS[1] is the secret key.
+// ARGV[1] is the current Unix time in milliseconds.
+//
+// Returns a status ("ok", "not_found" or "outdated"), the updated secret data and its version.
+var consumeScript = redis.NewScript(`
+local rec = redis.call('HMGET', KEYS[1], 'data', 'version', 'expires')
+local data, version, expires = rec[1], rec[2], rec[3]
+if not data then
+	return {'not_found'}
+end
+
+local s = cjson.decode(data)
+local expired = expires and tonumber(expires) < tonumber(ARGV[1])
+if expired or s['remainingViews'] <= 0 then
+	redis.call('DEL', KEYS[1])
+	return {'outdated'}
+end
+
+s['remainingViews'] = s['remainingViews'] - 1
+data = cjson.encode(s)
+if s['remainingViews'] == 0 then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('HSET', KEYS[1], 'data', data)
+	version = redis.call('HINCRBY', KEYS[1], 'version', 1)
+end
+return {'ok', data, tostring(version)}
+`)
+
+// migrateScript moves a secret from the legacy layout into a per-secret key.
+//
+// KEYS[1] is the legacy hash map, KEYS[2] is the legacy version key, KEYS[3] is the new secret key.
+// ARGV[1] is the secret hash, ARGV[2] is the expiration Unix time in milliseconds or 0.
+//
+// Returns 1 if the secret was moved.
+var migrateScript = redis.NewScript(`
+local data = redis.call('HGET', KEYS[1], ARGV[1])
+if not data then
+	return 0
+end
+local version = redis.call('GET', KEYS[2]) or '0'
+
+redis.call('HSET', KEYS[3], 'data', data)
+redis.call('HSET', KEYS[3], 'version', version)
+if ARGV[2] ~= '0' then
+	redis.call('HSET', KEYS[3], 'expires', ARGV[2])
+	redis.call('PEXPIREAT', KEYS[3], ARGV[2])
+end
+
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+// tagScript moves a secret key without a hash tag to the tagged key.
+//
+// KEYS[1] is the untagged key, KEYS[2] is the tagged key.
+//
+// Returns 1 if the key was moved.
+var tagScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+return redis.call('RENAMENX', KEYS[1], KEYS[2])
+`)
+
+// takeTokenScript takes a token from a token bucket refilled continuously.
+//
+// KEYS[1] is the bucket key.
+// ARGV[1] is the bucket capacity, ARGV[2] is the refill period of the whole capacity in milliseconds,
+// ARGV[3] is the current Unix time in milliseconds.
+//
+// Returns 1 if the token was taken or 0 otherwise, and the number of remaining tokens.
+var takeTokenScript = redis.NewScript(`
+local limit, period, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local rec = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(rec[1]) or limit
+local ts = tonumber(rec[2]) or now
+
+if now > ts then
+	tokens = math.min(limit, tokens + (now - ts) * limit / period)
+end
+
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens))
+redis.call('HSET', KEYS[1], 'ts', tostring(math.max(now, ts)))
+redis.call('PEXPIRE', KEYS[1], period)
+return {taken, math.floor(tokens)}
+`)
+
+// RedisDB is a database interaction manager for Redis.
+//
+// It works with a single server, a Sentinel-managed failover group or a cluster.
+// Every secret is stored in one key, so all operations on a secret are cluster-safe.
 type RedisDB struct {
-	client *redis.Client
+	client redis.UniversalClient
+
+	// expirationGrace keeps expired secret keys for a while, so the janitor can report their expiration
+	expirationGrace time.Duration
+	// prefix of all keys of the tenant namespace, empty for the default namespace
+	prefix string
 }
 
-// NewRedisDBWithOpts creates a new database connection to Redis with url options
-func NewRedisDBWithOpts(address string) (*RedisDB, error) {
-	opts, err := redis.ParseURL(address)
-	if err != nil {
-		return nil, err
+// RedisOption is a Redis connection option
+type RedisOption func(*redisOptions)
+
+// redisOptions are connection settings common to all Redis deployments. Zero values keep driver defaults
+type redisOptions struct {
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	poolSize int
+
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxRetries   int
+}
+
+// WithRedisTLS enables TLS with the configuration
+func WithRedisTLS(config *tls.Config) RedisOption {
+	return func(o *redisOptions) {
+		o.tls = config
 	}
-	client := redis.NewClient(opts)
+}
 
-	if err := checkRedisConnection(client); err != nil {
-		return nil, err
+// WithRedisAuth sets credentials. The username is an ACL user of Redis 6, an empty username is the default user
+func WithRedisAuth(username, password string) RedisOption {
+	return func(o *redisOptions) {
+		o.username = username
+		o.password = password
 	}
+}
 
-	return &RedisDB{
-		client: client,
-	}, nil
+// WithRedisDB selects the database index
+func WithRedisDB(db int) RedisOption {
+	return func(o *redisOptions) {
+		o.db = db
+	}
 }
 
-// NewRedisDB creates a new database connection to Redis
-func NewRedisDB(address string) (*RedisDB, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr: address,
-	})
+// WithRedisPool sets the maximum number of connections
+func WithRedisPool(size int) RedisOption {
+	return func(o *redisOptions) {
+		o.poolSize = size
+	}
+}
 
-	if err := checkRedisConnection(client); err != nil {
-		return nil, err
+// WithRedisTimeouts sets timeouts of connecting, reading a reply and writing a command
+func WithRedisTimeouts(dial, read, write time.Duration) RedisOption {
+	return func(o *redisOptions) {
+		o.dialTimeout = dial
+		o.readTimeout = read
+		o.writeTimeout = write
 	}
+}
 
-	return &RedisDB{
-		client: client,
-	}, nil
+// WithRedisRetries sets the number of retries of a failed command
+func WithRedisRetries(n int) RedisOption {
+	return func(o *redisOptions) {
+		o.maxRetries = n
+	}
+}
+
+// newRedisOptions collects the options
+func newRedisOptions(opts []RedisOption) *redisOptions {
+	o := &redisOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// client returns options of a single-server client.
+//
+// The password, the database and TLS may be set by a URL already, the options can't override them.
+func (o *redisOptions) client(c *redis.Options) (*redis.Options, error) {
+	if o.password != "" {
+		if c.Password != "" {
+			return nil, errors.New("redis password is set twice")
+		}
+		c.Password = o.password
+	}
+	if o.db != 0 {
+		if c.DB != 0 {
+			return nil, errors.New("redis database is set twice")
+		}
+		c.DB = o.db
+	}
+	if o.tls != nil {
+		config := o.tls.Clone()
+		if c.TLSConfig != nil && config.ServerName == "" {
+			// keep the host of the URL
+			config.ServerName = c.TLSConfig.ServerName
+		}
+		c.TLSConfig = config
+	}
+	if o.username != "" {
+		// the driver authenticates with a password only, so the ACL user is authenticated on connect
+		c.OnConnect = authUser(o.username, c.Password, c.DB)
+		c.Password, c.DB = "", 0
+	}
+
+	c.PoolSize = o.poolSize
+	c.DialTimeout = o.dialTimeout
+	c.ReadTimeout = o.readTimeout
+	c.WriteTimeout = o.writeTimeout
+	c.MaxRetries = o.maxRetries
+	return c, nil
+}
+
+// authUser returns a connection hook authenticating the ACL user and selecting the database
+func authUser(username, password string, db int) func(*redis.Conn) error {
+	return func(cn *redis.Conn) error {
+		auth := redis.NewStatusCmd("auth", username, password)
+		if err := cn.Process(auth); err != nil {
+			return err
+		}
+		if db != 0 {
+			return cn.Select(db).Err()
+		}
+		return nil
+	}
 }
 
-func checkRedisConnection(c *redis.Client) error {
-	pong, err := c.Ping().Result()
+// NewRedisDBWithOpts creates a new database connection to Redis with url options.
+//
+// The password, the database and TLS of the URL can't be set by options again.
+// The username of the URL is ignored, because hosting providers put placeholders there,
+// an ACL user is set by WithRedisAuth.
+func NewRedisDBWithOpts(address string, opts ...RedisOption) (*RedisDB, error) {
+	parsed, err := redis.ParseURL(address)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	client, err := newRedisOptions(opts).client(parsed)
+	if err != nil {
+		return nil, err
+	}
+	return newRedisDB(redis.NewClient(client), parsed.Addr)
+}
 
-	log.Println(pong)
-	return nil
+// NewRedisDB creates a new database connection to Redis
+func NewRedisDB(address string, opts ...RedisOption) (*RedisDB, error) {
+	client, err := newRedisOptions(opts).client(&redis.Options{
+		Addr: address,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newRedisDB(redis.NewClient(client), address)
 }
 
-// GetSecret returns a secret or errors
-func (r *RedisDB) GetSecret(hash string) (*models.Secret, error) {
-	version, err := r.client.Get(versionKey(hash)).Int64()
+// NewRedisFailoverDB creates a new database connection to the Redis master monitored by sentinels.
+//
+// The connection follows the master on failover. Options apply to connections to the master,
+// sentinels are queried without TLS and authentication.
+func NewRedisFailoverDB(masterName string, sentinelAddrs []string, opts ...RedisOption) (*RedisDB, error) {
+	if masterName == "" || len(sentinelAddrs) == 0 {
+		return nil, errors.New("redis sentinel requires a master name and sentinel addresses")
+	}
+	c, err := newRedisOptions(opts).client(&redis.Options{})
 	if err != nil {
 		return nil, err
 	}
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddrs,
+		OnConnect:     c.OnConnect,
+		Password:      c.Password,
+		DB:            c.DB,
+		MaxRetries:    c.MaxRetries,
+		DialTimeout:   c.DialTimeout,
+		ReadTimeout:   c.ReadTimeout,
+		WriteTimeout:  c.WriteTimeout,
+		PoolSize:      c.PoolSize,
+		TLSConfig:     c.TLSConfig,
+	})
+	return newRedisDB(client, masterName)
+}
 
-	// get secret from the hash map
-	str, err := r.client.HGet(hashSecretKey, hash).Result()
+// NewRedisClusterDB creates a new database connection to the Redis cluster.
+//
+// Addresses are seed nodes, the rest of the cluster is discovered from them.
+// A cluster has only one database, so it can't be selected.
+func NewRedisClusterDB(addrs []string, opts ...RedisOption) (*RedisDB, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("redis cluster requires node addresses")
+	}
+	o := newRedisOptions(opts)
+	if o.db != 0 {
+		return nil, errors.New("redis cluster supports only database 0")
+	}
+	c, err := o.client(&redis.Options{})
 	if err != nil {
 		return nil, err
 	}
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:        addrs,
+		OnConnect:    c.OnConnect,
+		Password:     c.Password,
+		MaxRetries:   c.MaxRetries,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		PoolSize:     c.PoolSize,
+		TLSConfig:    c.TLSConfig,
+	})
+	return newRedisDB(client, strings.Join(addrs, ","))
+}
 
-	var sec models.SecretBase
-	if err := json.Unmarshal([]byte(str), &sec); err != nil {
+// newRedisDB checks the client connection and creates a database of it.
+//
+// The client is closed if the connection fails.
+func newRedisDB(client redis.UniversalClient, address string) (*RedisDB, error) {
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
 		return nil, err
 	}
-	return &models.Secret{
-		SecretBase: sec,
-		Version:    version,
+	logging.Debug("redis connection checked", logging.String("address", address))
+
+	return &RedisDB{
+		client: client,
 	}, nil
 }
 
-// CreateSecret creates a new secret
+// SetExpirationGrace delays native expiration of secret keys after the secret expiration time.
+//
+// Expired secrets still can't be read, but they stay visible to the janitor during the grace period.
+func (r *RedisDB) SetExpirationGrace(d time.Duration) {
+	r.expirationGrace = d
+}
+
+// Namespace returns a database of the tenant namespace.
+//
+// All keys of the namespace are prefixed with the tenant name, so tenants can't access data of each other.
+// The namespace shares the connection with the default one.
+func (r *RedisDB) Namespace(tenant string) Database {
+	ns := *r
+	ns.prefix = tenantKeyPrefix + tenant + ":"
+	return &ns
+}
+
+// Close closes the connection. Namespaces share it, so they can't be used after that
+func (r *RedisDB) Close() error {
+	return r.client.Close()
+}
+
+// Ping checks the connection. A cluster is checked by one of its nodes
+func (r *RedisDB) Ping(ctx context.Context) error {
+	switch c := r.client.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx).Ping().Err()
+	case *redis.ClusterClient:
+		return c.WithContext(ctx).Ping().Err()
+	default:
+		return r.client.Ping().Err()
+	}
+}
+
+// GetSecret returns a secret or errors
+func (r *RedisDB) GetSecret(hash string) (*models.Secret, error) {
+	res, err := r.client.HMGet(r.secretKey(hash), fieldData, fieldVersion).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseSecret(res[0], res[1])
+}
+
+// CreateSecret creates a new secret.
+//
+// The secret key expires at the secret expiration time, so Redis purges it without a read.
 func (r *RedisDB) CreateSecret(hash string, s models.Secret) error {
 	str, err := json.Marshal(s.SecretBase)
 	if err != nil {
 		return err
 	}
 
+	fields := map[string]interface{}{
+		fieldData:    str,
+		fieldVersion: s.Version,
+	}
+	if s.ExpiresAt != nil {
+		fields[fieldExpires] = unixMSec(*s.ExpiresAt)
+	}
+
 	// open transaction
 	tx := r.client.TxPipeline()
 	defer tx.Discard()
 
-	// set data
-	if err := tx.HSet(hashSecretKey, hash, str).Err(); err != nil {
+	// set data and version
+	if err := tx.HMSet(r.secretKey(hash), fields).Err(); err != nil {
 		return err
 	}
-	// set version
-	if err := tx.Set(versionKey(hash), s.Version, 0).Err(); err != nil {
-		return err
+	// set expiration
+	if s.ExpiresAt != nil {
+		if err := tx.PExpireAt(r.secretKey(hash), s.ExpiresAt.Add(r.expirationGrace)).Err(); err != nil {
+			return err
+		}
 	}
 	// execute transaction
 	_, err = tx.Exec()
@@ -111,11 +457,20 @@ func (r *RedisDB) CreateSecret(hash string, s models.Secret) error {
 
 // DeleteSecret removes existing secret
 func (r *RedisDB) DeleteSecret(hash string) error {
-	if err := r.client.HDel(hashSecretKey, hash).Err(); err != nil {
-		return err
-	}
+	return r.client.Del(r.secretKey(hash)).Err()
+}
 
-	return r.client.Del(versionKey(hash)).Err()
+// DeleteSecrets removes several secrets at once.
+//
+// Keys of the secrets are in different cluster slots, so they are deleted one by one in a pipeline.
+func (r *RedisDB) DeleteSecrets(hashes []string) error {
+	_, err := r.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, hash := range hashes {
+			pipe.Del(r.secretKey(hash))
+		}
+		return nil
+	})
+	return err
 }
 
 // UpdateSecret decreases secret view counter
@@ -125,35 +480,434 @@ func (r *RedisDB) UpdateSecret(hash string, s models.Secret) error {
 		return err
 	}
 
-	// execute transaction by watching at version id
-	return r.client.Watch(func(tx *redis.Tx) error {
+	// execute transaction by watching at the secret key
+	err = r.client.Watch(func(tx *redis.Tx) error {
 		// get version id
 		// it must be the same as version id in the incoming data set
 		// otherwise the data was changed by concurrent session
-		if versionCurrent, err := tx.Get(versionKey(hash)).Int64(); err != nil {
+		if versionCurrent, err := tx.HGet(r.secretKey(hash), fieldVersion).Int64(); err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
 			return err
 		} else if versionCurrent != s.Version {
-			return errors.New("secret was modified from another session. Try again")
+			return ErrSecretModified
 		}
 
 		// change the data
 		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
 			// set data
-			if err := pipe.HSet(hashSecretKey, hash, str).Err(); err != nil {
+			if err := pipe.HSet(r.secretKey(hash), fieldData, str).Err(); err != nil {
 				return err
 			}
 
 			// increment version
-			if err := pipe.Incr(versionKey(hash)).Err(); err != nil {
+			if err := pipe.HIncrBy(r.secretKey(hash), fieldVersion, 1).Err(); err != nil {
 				return err
 			}
 			return nil
 		})
 		return err
-	}, versionKey(hash))
+	}, r.secretKey(hash))
+	if err == redis.TxFailedErr {
+		// secret key was changed during the transaction
+		return ErrSecretModified
+	}
+	return err
+}
+
+// ConsumeSecret atomically checks the secret validity and decrements its view counter.
+//
+// The secret is deleted if it is outdated or has no views left after the decrement.
+// The whole operation is done in a single round trip with a Lua script.
+func (r *RedisDB) ConsumeSecret(hash string, now time.Time) (*models.Secret, error) {
+	res, err := consumeScript.Run(r.client, []string{r.secretKey(hash)}, unixMSec(now)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) == 0 {
+		return nil, fmt.Errorf("unexpected consume script result %v", res)
+	}
+	switch vals[0] {
+	case "not_found":
+		return nil, ErrNotFound
+	case "outdated":
+		return nil, ErrSecretOutdated
+	case "ok":
+	default:
+		return nil, fmt.Errorf("unexpected consume script status %v", vals[0])
+	}
+	if len(vals) != 3 {
+		return nil, fmt.Errorf("unexpected consume script result %v", res)
+	}
+
+	return parseSecret(vals[1], vals[2])
 }
 
-// versionKey returns a Redis version counter key
-func versionKey(hash string) string {
-	return fmt.Sprintf("%s:%s", hashVersionKey, hash)
+// ForEachSecret calls fn for every stored secret hash
+func (r *RedisDB) ForEachSecret(fn func(hash string) error) error {
+	return r.scan(r.prefix+secretKeyPrefix+"{*}", func(key string) error {
+		hash := strings.TrimPrefix(key, r.prefix+secretKeyPrefix)
+		return fn(strings.TrimSuffix(strings.TrimPrefix(hash, "{"), "}"))
+	})
+}
+
+// scan calls fn for every key matching the pattern. Nodes of a cluster are scanned one by one
+func (r *RedisDB) scan(match string, fn func(key string) error) error {
+	cc, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(r.client, match, fn)
+	}
+
+	var (
+		mu      sync.Mutex
+		masters []*redis.Client
+	)
+	err := cc.ForEachMaster(func(c *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		masters = append(masters, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range masters {
+		if err := scanKeys(c, match, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanKeys calls fn for every key of the server matching the pattern
+func scanKeys(c redis.Cmdable, match string, fn func(key string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(cursor, match, scanBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Migrate moves secrets from the legacy layout, where all secrets are stored in one hash map,
+// into per-secret keys with native expiration. Then it adds hash tags to secret keys of all namespaces
+// created before cluster support.
+//
+// Secrets that are already expired are deleted. Returns the number of moved secrets.
+// It is safe to run the migration concurrently. Tenant namespaces have no legacy data,
+// their keys are tagged by the migration of the default namespace.
+//
+// Neither layout was ever used with a cluster, so a cluster has nothing to migrate.
+func (r *RedisDB) Migrate() (int, error) {
+	if r.prefix != "" {
+		return 0, nil
+	}
+
+	var (
+		cursor uint64
+		moved  int
+	)
+	for {
+		// HSCAN returns field and value pairs
+		res, next, err := r.client.HScan(legacyHashSecretKey, cursor, "", scanBatchSize).Result()
+		if err != nil {
+			return moved, err
+		}
+		for idx := 0; idx+1 < len(res); idx += 2 {
+			ok, err := r.migrateSecret(res[idx], res[idx+1])
+			if err != nil {
+				return moved, err
+			}
+			if ok {
+				moved++
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	err := r.scan("*"+secretKeyPrefix+"*", func(key string) error {
+		tagged, ok := tagSecretKey(key)
+		if !ok {
+			return nil
+		}
+		n, err := tagScript.Run(r.client, []string{key, tagged}).Int64()
+		if n == 1 {
+			moved++
+		}
+		return err
+	})
+	return moved, err
+}
+
+// tagSecretKey returns a key with a hash tag of an untagged secret key of any namespace.
+//
+// Returns false if the key is tagged or isn't a secret key.
+func tagSecretKey(key string) (string, bool) {
+	idx := strings.Index(key, secretKeyPrefix)
+	if idx < 0 {
+		return "", false
+	}
+	// tenant names have no colons
+	prefix, hash := key[:idx], key[idx+len(secretKeyPrefix):]
+	if prefix != "" && (!strings.HasPrefix(prefix, tenantKeyPrefix) || strings.Count(prefix, ":") != 2 || !strings.HasSuffix(prefix, ":")) {
+		return "", false
+	}
+	if hash == "" || strings.HasPrefix(hash, "{") {
+		return "", false
+	}
+	return prefix + secretKeyPrefix + "{" + hash + "}", true
+}
+
+// migrateSecret moves one secret from the legacy layout
+func (r *RedisDB) migrateSecret(hash, data string) (bool, error) {
+	var sec models.SecretBase
+	if err := json.Unmarshal([]byte(data), &sec); err != nil {
+		return false, err
+	}
+
+	var expires int64
+	if sec.ExpiresAt != nil {
+		expires = unixMSec(*sec.ExpiresAt)
+		if expires <= unixMSec(time.Now()) {
+			// nothing to migrate, the secret is outdated
+			legacyVersionKey := fmt.Sprintf("%s:%s", legacyHashVersionKey, hash)
+			if err := r.client.HDel(legacyHashSecretKey, hash).Err(); err != nil {
+				return false, err
+			}
+			return false, r.client.Del(legacyVersionKey).Err()
+		}
+	}
+
+	keys := []string{
+		legacyHashSecretKey,
+		fmt.Sprintf("%s:%s", legacyHashVersionKey, hash),
+		r.secretKey(hash),
+	}
+	moved, err := migrateScript.Run(r.client, keys, hash, expires).Int64()
+	return moved == 1, err
+}
+
+// RedisLock is a distributed lock based on a Redis key
+type RedisLock struct {
+	client redis.UniversalClient
+	key    string
+}
+
+// NewLock creates a named distributed lock
+func (r *RedisDB) NewLock(name string) *RedisLock {
+	return &RedisLock{
+		client: r.client,
+		key:    r.prefix + lockKeyPrefix + name,
+	}
+}
+
+// TryLock acquires the lock for ttl. Returns false if the lock is held by another owner
+func (l *RedisLock) TryLock(ttl time.Duration) (bool, error) {
+	return l.client.SetNX(l.key, time.Now().Unix(), ttl).Result()
+}
+
+// RedisTokenBucket is a set of rate limit token buckets shared by replicas
+type RedisTokenBucket struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewTokenBucket creates rate limit token buckets
+func (r *RedisDB) NewTokenBucket() *RedisTokenBucket {
+	return &RedisTokenBucket{
+		client: r.client,
+		prefix: r.prefix + rateLimitKeyPrefix,
+	}
+}
+
+// Take takes a token from the bucket with capacity limit refilled every period.
+//
+// Returns the number of remaining tokens and false if the bucket is empty.
+func (b *RedisTokenBucket) Take(key string, limit int, period time.Duration, now time.Time) (int, bool, error) {
+	res, err := takeTokenScript.Run(b.client, []string{b.prefix + key},
+		limit, int64(period/time.Millisecond), unixMSec(now)).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return 0, false, fmt.Errorf("unexpected take token script result %v", res)
+	}
+	taken, _ := vals[0].(int64)
+	remaining, _ := vals[1].(int64)
+	return int(remaining), taken == 1, nil
+}
+
+// secretKey returns a Redis key of the secret.
+//
+// The hash is a hash tag, so a cluster keeps every key derived from the secret in the slot of the secret.
+func (r *RedisDB) secretKey(hash string) string {
+	return r.prefix + secretKeyPrefix + "{" + hash + "}"
+}
+
+// parseSecret creates a secret from data and version values returned by Redis
+func parseSecret(data, version interface{}) (*models.Secret, error) {
+	if data == nil || version == nil {
+		return nil, ErrNotFound
+	}
+
+	dataStr, ok := data.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected secret data type %T", data)
+	}
+	versionStr, ok := version.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected secret version type %T", version)
+	}
+
+	ver, err := strconv.ParseInt(versionStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	var sec models.SecretBase
+	if err := json.Unmarshal([]byte(dataStr), &sec); err != nil {
+		return nil, err
+	}
+	return &models.Secret{
+		SecretBase: sec,
+		Version:    ver,
+	}, nil
+}
+
+// unixMSec returns Unix time in milliseconds
+func unixMSec(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+const (
+	// streamField is a stream entry field of the item data
+	streamField = "data"
+	// streamPageSize is a number of stream entries read at once
+	streamPageSize = 500
+)
+
+// RedisStream is an append-only Redis stream of data items
+type RedisStream struct {
+	client redis.UniversalClient
+	key    string
+}
+
+// NewStream creates a stream with the name
+func (r *RedisDB) NewStream(name string) *RedisStream {
+	return &RedisStream{
+		client: r.client,
+		key:    r.prefix + name,
+	}
+}
+
+// Append adds the item to the end of the stream
+func (s *RedisStream) Append(data []byte) error {
+	return s.client.XAdd(&redis.XAddArgs{
+		Stream: s.key,
+		Values: map[string]interface{}{streamField: data},
+	}).Err()
+}
+
+// Range calls fn for items from the oldest, or from the newest if reverse is set.
+//
+// The stream is read in pages, errors of fn stop the iteration and are returned.
+func (s *RedisStream) Range(reverse bool, fn func(data []byte) error) error {
+	start, stop := "-", "+"
+	for {
+		var (
+			msgs []redis.XMessage
+			err  error
+		)
+		if reverse {
+			msgs, err = s.client.XRevRangeN(s.key, stop, start, streamPageSize).Result()
+		} else {
+			msgs, err = s.client.XRangeN(s.key, start, stop, streamPageSize).Result()
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			data, _ := m.Values[streamField].(string)
+			if err := fn([]byte(data)); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < streamPageSize {
+			return nil
+		}
+
+		// ranges are inclusive, so the next page starts from the neighbour entry id
+		var ok bool
+		if reverse {
+			stop, ok = prevStreamID(msgs[len(msgs)-1].ID)
+		} else {
+			start, ok = nextStreamID(msgs[len(msgs)-1].ID)
+		}
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// parseStreamID splits a stream entry id in format <ms>-<seq>
+func parseStreamID(id string) (ms, seq uint64, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid stream id %q", id)
+	}
+	if ms, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return ms, seq, nil
+}
+
+// nextStreamID returns the smallest id after the given one. Returns false if there is none
+func nextStreamID(id string) (string, bool) {
+	ms, seq, err := parseStreamID(id)
+	switch {
+	case err != nil:
+		return "", false
+	case seq < math.MaxUint64:
+		return fmt.Sprintf("%d-%d", ms, seq+1), true
+	case ms < math.MaxUint64:
+		return fmt.Sprintf("%d-0", ms+1), true
+	default:
+		return "", false
+	}
+}
+
+// prevStreamID returns the largest id before the given one. Returns false if there is none
+func prevStreamID(id string) (string, bool) {
+	ms, seq, err := parseStreamID(id)
+	switch {
+	case err != nil:
+		return "", false
+	case seq > 0:
+		return fmt.Sprintf("%d-%d", ms, seq-1), true
+	case ms > 0:
+		return fmt.Sprintf("%d-%d", ms-1, uint64(math.MaxUint64)), true
+	default:
+		return "", false
+	}
 }
@@ -0,0 +1,432 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisDB_Expiration(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	exp := time.Now().Add(time.Hour)
+	require.NoError(t, db.CreateSecret("ttl", models.Secret{
+		SecretBase: models.SecretBase{
+			ExpiresAt:      &exp,
+			RemainingViews: 1,
+		},
+	}))
+	require.NoError(t, db.CreateSecret("no-ttl", models.Secret{
+		SecretBase: models.SecretBase{
+			RemainingViews: 1,
+		},
+	}))
+
+	assert.True(t, mr.TTL(db.secretKey("ttl")) > 59*time.Minute)
+	assert.Equal(t, time.Duration(0), mr.TTL(db.secretKey("no-ttl")))
+
+	// the secret is purged without a read
+	mr.FastForward(time.Hour + time.Second)
+	assert.False(t, mr.Exists(db.secretKey("ttl")))
+	assert.True(t, mr.Exists(db.secretKey("no-ttl")))
+}
+
+func TestRedisDB_Ping(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var p Pinger = db
+	assert.NoError(t, p.Ping(context.Background()))
+
+	mr.Close()
+	assert.Error(t, p.Ping(context.Background()))
+}
+
+func TestRedisDB_ExpirationGrace(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+	db.SetExpirationGrace(10 * time.Minute)
+
+	exp := time.Now().Add(time.Hour)
+	require.NoError(t, db.CreateSecret("ttl", models.Secret{
+		SecretBase: models.SecretBase{
+			ExpiresAt:      &exp,
+			RemainingViews: 1,
+		},
+	}))
+	assert.True(t, mr.TTL(db.secretKey("ttl")) > 69*time.Minute)
+
+	// the expired secret is still visible, but can't be consumed
+	mr.FastForward(time.Hour + time.Second)
+	_, err = db.GetSecret("ttl")
+	assert.NoError(t, err)
+	_, err = db.ConsumeSecret("ttl", exp.Add(time.Second))
+	assert.Equal(t, ErrSecretOutdated, err)
+}
+
+func TestRedisDB_Migrate(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	past := time.Now().Add(-time.Hour)
+
+	legacy := map[string]models.SecretBase{
+		"future":  {ExpiresAt: &future, RemainingViews: 3, SecretText: "future"},
+		"past":    {ExpiresAt: &past, RemainingViews: 3, SecretText: "past"},
+		"forever": {RemainingViews: 3, SecretText: "forever"},
+	}
+	for hash, s := range legacy {
+		data, err := json.Marshal(s)
+		require.NoError(t, err)
+		mr.HSet(legacyHashSecretKey, hash, string(data))
+		mr.Set(legacyHashVersionKey+":"+hash, "5")
+	}
+
+	moved, err := db.Migrate()
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	// legacy keys are removed
+	assert.False(t, mr.Exists(legacyHashSecretKey))
+	for hash := range legacy {
+		assert.False(t, mr.Exists(legacyHashVersionKey+":"+hash))
+	}
+
+	s, err := db.GetSecret("future")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), s.Version)
+	assert.Equal(t, "future", s.SecretText)
+	assert.True(t, future.Equal(*s.ExpiresAt))
+	assert.True(t, mr.TTL(db.secretKey("future")) > 59*time.Minute)
+
+	s, err = db.GetSecret("forever")
+	require.NoError(t, err)
+	assert.Equal(t, "forever", s.SecretText)
+
+	_, err = db.GetSecret("past")
+	assert.Equal(t, ErrNotFound, err)
+
+	// migration is idempotent
+	moved, err = db.Migrate()
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestRedisDB_MigrateTags(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	// secret keys without hash tags
+	data, err := json.Marshal(models.SecretBase{RemainingViews: 3, SecretText: "untagged"})
+	require.NoError(t, err)
+	for _, key := range []string{"secret:a", "secret:a.0", "tenant:acme:secret:b"} {
+		mr.HSet(key, fieldData, string(data))
+		mr.HSet(key, fieldVersion, "2")
+	}
+	mr.SetTTL("secret:a", time.Hour)
+	mr.Set("ratelimit:secret_post:192.0.2.1", "1")
+
+	moved, err := db.Migrate()
+	require.NoError(t, err)
+	assert.Equal(t, 3, moved)
+
+	s, err := db.GetSecret("a")
+	require.NoError(t, err)
+	assert.Equal(t, "untagged", s.SecretText)
+	assert.Equal(t, int64(2), s.Version)
+	assert.True(t, mr.TTL(db.secretKey("a")) > 59*time.Minute)
+	_, err = db.GetSecret("a.0")
+	assert.NoError(t, err)
+	_, err = db.Namespace("acme").GetSecret("b")
+	assert.NoError(t, err)
+
+	assert.False(t, mr.Exists("secret:a"))
+	assert.True(t, mr.Exists("ratelimit:secret_post:192.0.2.1"))
+
+	moved, err = db.Migrate()
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestTagSecretKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"secret:a":                        "secret:{a}",
+		"secret:a.1":                      "secret:{a.1}",
+		"tenant:acme:secret:a":            "tenant:acme:secret:{a}",
+		"secret:{a}":                      "",
+		"tenant:acme:secret:{a}":          "",
+		"ratelimit:secret:a":              "",
+		"secret:":                         "",
+		"lock:janitor":                    "",
+		"tenant:acme:ratelimit:secret:ab": "",
+	} {
+		got, ok := tagSecretKey(key)
+		assert.Equal(t, want != "", ok, key)
+		assert.Equal(t, want, got, key)
+	}
+}
+
+// registerCommandInfo adds a minimal COMMAND reply to the server.
+//
+// Cluster clients find keys of commands by it, miniredis doesn't support it.
+func registerCommandInfo(t *testing.T, mr *miniredis.Miniredis) {
+	keyed := []string{"del", "exists", "hget", "hincrby", "hmget", "hmset", "hset", "pexpireat", "setnx", "xadd", "xrange", "xrevrange"}
+	require.NoError(t, mr.Server().Register("COMMAND", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(len(keyed))
+		for _, name := range keyed {
+			// name, arity, flags, first key, last key, step
+			c.WriteLen(6)
+			c.WriteBulk(name)
+			c.WriteInt(-2)
+			c.WriteLen(0)
+			c.WriteInt(1)
+			c.WriteInt(1)
+			c.WriteInt(1)
+		}
+	}))
+}
+
+func TestRedisDB_Cluster(t *testing.T) {
+	// two nodes share slots of the cluster
+	var nodes []redis.ClusterNode
+	for i := 0; i < 2; i++ {
+		mr, err := miniredis.Run()
+		require.NoError(t, err)
+		defer mr.Close()
+		registerCommandInfo(t, mr)
+		nodes = append(nodes, redis.ClusterNode{Addr: mr.Addr()})
+	}
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func() ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{
+				{Start: 0, End: 8191, Nodes: nodes[:1]},
+				{Start: 8192, End: 16383, Nodes: nodes[1:]},
+			}, nil
+		},
+	})
+	db, err := newRedisDB(client, "cluster")
+	require.NoError(t, err)
+	defer db.Close()
+
+	testDatabase(t, db)
+	testDatabase(t, db.Namespace("acme"))
+
+	// secrets are spread over nodes, so batches and scans touch all of them
+	var hashes []string
+	for i := 0; i < 20; i++ {
+		hash := fmt.Sprintf("cluster-%d", i)
+		require.NoError(t, db.CreateSecret(hash, models.Secret{SecretBase: models.SecretBase{RemainingViews: 1}}))
+		hashes = append(hashes, hash)
+	}
+	var got []string
+	require.NoError(t, db.ForEachSecret(func(hash string) error {
+		got = append(got, hash)
+		return nil
+	}))
+	assert.ElementsMatch(t, hashes, got)
+
+	require.NoError(t, db.DeleteSecrets(hashes))
+	for _, hash := range hashes {
+		_, err := db.GetSecret(hash)
+		assert.Equal(t, ErrNotFound, err, hash)
+	}
+	assert.NoError(t, db.Ping(context.Background()))
+}
+
+func TestRedisLock(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	first, second := db.NewLock("test"), db.NewLock("test")
+
+	ok, err := first.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = second.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// the lock expires
+	mr.FastForward(time.Minute)
+	ok, err = second.TryLock(time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRedisTokenBucket(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	db, err := NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+	b := db.NewTokenBucket()
+
+	now := time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC)
+	for i := 2; i >= 0; i-- {
+		remaining, ok, err := b.Take("client", 3, time.Minute, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, i, remaining)
+	}
+	_, ok, err := b.Take("client", 3, time.Minute, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// other clients have their own buckets
+	_, ok, err = b.Take("other", 3, time.Minute, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// a token is refilled every 20 seconds
+	remaining, ok, err := b.Take("client", 3, time.Minute, now.Add(20*time.Second))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0, remaining)
+
+	// the bucket expires when it's full
+	assert.Equal(t, time.Minute, mr.TTL(rateLimitKeyPrefix+"client"))
+}
+
+func TestStreamID(t *testing.T) {
+	next, ok := nextStreamID("1526919030474-55")
+	assert.True(t, ok)
+	assert.Equal(t, "1526919030474-56", next)
+	next, ok = nextStreamID("1526919030474-18446744073709551615")
+	assert.True(t, ok)
+	assert.Equal(t, "1526919030475-0", next)
+	_, ok = nextStreamID("18446744073709551615-18446744073709551615")
+	assert.False(t, ok)
+
+	prev, ok := prevStreamID("1526919030474-55")
+	assert.True(t, ok)
+	assert.Equal(t, "1526919030474-54", prev)
+	prev, ok = prevStreamID("1526919030474-0")
+	assert.True(t, ok)
+	assert.Equal(t, "1526919030473-18446744073709551615", prev)
+	_, ok = prevStreamID("0-0")
+	assert.False(t, ok)
+
+	_, ok = nextStreamID("invalid")
+	assert.False(t, ok)
+}
+
+// fakeRedis is a server accepting any command, it records commands of every connection
+type fakeRedis struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve reads RESP arrays of bulk strings and replies with PONG or OK
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args[i] = strings.TrimSpace(arg)
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		f.mu.Unlock()
+		if strings.EqualFold(args[0], "ping") {
+			conn.Write([]byte("+PONG\r\n"))
+		} else {
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+func TestRedisDB_ACL(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.ln.Close()
+
+	db, err := NewRedisDB(f.ln.Addr().String(), WithRedisAuth("app", "pass"), WithRedisDB(2))
+	require.NoError(t, err)
+	defer db.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	assert.Equal(t, []string{"auth app pass", "select 2", "ping"}, f.commands)
+}
+
+func TestNewRedisDBWithOpts_Conflicts(t *testing.T) {
+	_, err := NewRedisDBWithOpts("redis://:pass@localhost:6379", WithRedisAuth("", "other"))
+	assert.EqualError(t, err, "redis password is set twice")
+	_, err = NewRedisDBWithOpts("redis://localhost:6379/1", WithRedisDB(2))
+	assert.EqualError(t, err, "redis database is set twice")
+	_, err = NewRedisClusterDB([]string{"localhost:6379"}, WithRedisDB(2))
+	assert.EqualError(t, err, "redis cluster supports only database 0")
+}
@@ -0,0 +1,311 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+
+	// SQL drivers
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// hashes of file chunks in tenant namespaces are up to 63+1+16+1+10 characters long
+const sqlCreateTable = `CREATE TABLE IF NOT EXISTS secret (
+	hash    VARCHAR(255) PRIMARY KEY,
+	data    TEXT NOT NULL,
+	version BIGINT NOT NULL
+)`
+
+// sqlCreateLockTable creates a table of named locks shared by replicas
+const sqlCreateLockTable = `CREATE TABLE IF NOT EXISTS secret_lock (
+	name       VARCHAR(255) PRIMARY KEY,
+	expires_at BIGINT NOT NULL
+)`
+
+// sqlTryLock takes a free or expired lock, nothing is changed if the lock is held
+const sqlTryLock = `INSERT INTO secret_lock (name, expires_at) VALUES (?, ?)
+	ON CONFLICT (name) DO UPDATE SET expires_at = excluded.expires_at WHERE secret_lock.expires_at <= ?`
+
+// sqlHashWidth returns the width of the hash column in PostgreSQL
+const sqlHashWidth = `SELECT character_maximum_length FROM information_schema.columns
+	WHERE table_schema = current_schema() AND table_name = 'secret' AND column_name = 'hash'`
+
+// sqlWidenHash migrates tables created with a shorter hash column. SQLite doesn't limit VARCHAR length
+const sqlWidenHash = `ALTER TABLE secret ALTER COLUMN hash TYPE VARCHAR(255)`
+
+// hashWidth is the width of the hash column
+const hashWidth = 255
+
+// SQLDB is a database interaction manager for SQL databases
+type SQLDB struct {
+	db     *sql.DB
+	driver string
+}
+
+// NewSQLDB creates a new SQL database connection and prepares the schema.
+//
+// Supported drivers are postgres and sqlite3.
+func NewSQLDB(driver, dsn string) (*SQLDB, error) {
+	if driver != DriverPostgres && driver != DriverSQLite {
+		return nil, fmt.Errorf("unsupported SQL driver %q", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverSQLite {
+		// SQLite doesn't support concurrent writers
+		db.SetMaxOpenConns(1)
+	}
+
+	for _, query := range []string{sqlCreateTable, sqlCreateLockTable} {
+		if _, err := db.Exec(query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if driver == DriverPostgres {
+		if err := widenHash(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &SQLDB{
+		db:     db,
+		driver: driver,
+	}, nil
+}
+
+// widenHash widens the hash column of tables created with a shorter one.
+//
+// The column width is checked first, so the table is locked only once by the migration.
+func widenHash(db *sql.DB) error {
+	var width sql.NullInt64
+	if err := db.QueryRow(sqlHashWidth).Scan(&width); err != nil {
+		return err
+	}
+	if !width.Valid || width.Int64 >= hashWidth {
+		return nil
+	}
+	_, err := db.Exec(sqlWidenHash)
+	return err
+}
+
+// Close closes the database connection
+func (d *SQLDB) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks the connection
+func (d *SQLDB) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// GetSecret returns a secret or errors
+func (d *SQLDB) GetSecret(hash string) (*models.Secret, error) {
+	var (
+		data    string
+		version int64
+	)
+	err := d.db.QueryRow(d.rebind("SELECT data, version FROM secret WHERE hash = ?"), hash).Scan(&data, &version)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sec models.SecretBase
+	if err := json.Unmarshal([]byte(data), &sec); err != nil {
+		return nil, err
+	}
+	return &models.Secret{
+		SecretBase: sec,
+		Version:    version,
+	}, nil
+}
+
+// CreateSecret creates a new secret
+func (d *SQLDB) CreateSecret(hash string, s models.Secret) error {
+	data, err := json.Marshal(s.SecretBase)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(d.rebind("INSERT INTO secret (hash, data, version) VALUES (?, ?, ?)"), hash, string(data), s.Version)
+	return err
+}
+
+// DeleteSecret removes existing secret
+func (d *SQLDB) DeleteSecret(hash string) error {
+	_, err := d.db.Exec(d.rebind("DELETE FROM secret WHERE hash = ?"), hash)
+	return err
+}
+
+// UpdateSecret decreases secret view counter
+func (d *SQLDB) UpdateSecret(hash string, s models.Secret) error {
+	data, err := json.Marshal(s.SecretBase)
+	if err != nil {
+		return err
+	}
+
+	// update only if the version is the same as in the incoming data set
+	res, err := d.db.Exec(
+		d.rebind("UPDATE secret SET data = ?, version = version + 1 WHERE hash = ? AND version = ?"),
+		string(data), hash, s.Version,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	// nothing was updated, the secret was either deleted or modified
+	var exists int
+	err = d.db.QueryRow(d.rebind("SELECT 1 FROM secret WHERE hash = ?"), hash).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return ErrSecretModified
+}
+
+// ConsumeSecret atomically checks the secret validity and decrements its view counter.
+//
+// The secret is deleted if it is outdated or has no views left after the decrement.
+// Concurrent modifications are resolved by retrying with the actual version.
+func (d *SQLDB) ConsumeSecret(hash string, now time.Time) (*models.Secret, error) {
+	for {
+		s, err := d.GetSecret(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		errConsume := consume(s, now)
+		if errConsume != nil || s.RemainingViews == 0 {
+			err = d.deleteVersion(hash, s.Version)
+		} else {
+			err = d.UpdateSecret(hash, *s)
+			s.Version++
+		}
+
+		switch err {
+		case nil:
+			if errConsume != nil {
+				return nil, errConsume
+			}
+			return s, nil
+		case ErrSecretModified:
+			continue
+		default:
+			return nil, err
+		}
+	}
+}
+
+// deleteVersion removes the secret only if its version wasn't changed
+func (d *SQLDB) deleteVersion(hash string, version int64) error {
+	res, err := d.db.Exec(d.rebind("DELETE FROM secret WHERE hash = ? AND version = ?"), hash, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSecretModified
+	}
+	return nil
+}
+
+// ForEachSecret calls fn for every stored secret hash
+func (d *SQLDB) ForEachSecret(fn func(hash string) error) error {
+	// collect hashes first to release the connection before fn is called
+	rows, err := d.db.Query("SELECT hash FROM secret")
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SQLLock is a named lock shared by replicas using the same database
+type SQLLock struct {
+	db      *SQLDB
+	name    string
+	nowFunc func() time.Time
+}
+
+// NewLock creates a named lock
+func (d *SQLDB) NewLock(name string) *SQLLock {
+	return &SQLLock{
+		db:      d,
+		name:    name,
+		nowFunc: time.Now,
+	}
+}
+
+// TryLock acquires the lock for ttl. Returns false if the lock is held by another owner.
+//
+// Lock expiration is checked with the clock of the replica, so replica clocks should be synchronized.
+func (l *SQLLock) TryLock(ttl time.Duration) (bool, error) {
+	now := l.nowFunc()
+	res, err := l.db.db.Exec(l.db.rebind(sqlTryLock), l.name, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// rebind replaces ? placeholders with driver-specific ones
+func (d *SQLDB) rebind(query string) string {
+	if d.driver != DriverPostgres {
+		return query
+	}
+
+	var (
+		b   strings.Builder
+		idx int
+	)
+	for _, r := range query {
+		if r == '?' {
+			idx++
+			fmt.Fprintf(&b, "$%d", idx)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
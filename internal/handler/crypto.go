@@ -3,50 +3,386 @@ package handler
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// idLength is a length of the public lookup part of a token
+	idLength = 16
+	// keyLength is a length of the secret key part of a token
+	keyLength = 24
+	// dataKeyLength is a length of a random data key
+	dataKeyLength = 64
+	// manageTokenLength is a length of a secret management token
+	manageTokenLength = 32
+)
+
+// Argon2id parameters of passphrase key derivation
+const (
+	passphraseSaltLength = 16
+	passphraseTime       = 1
+	passphraseMemory     = 64 * 1024
+	passphraseThreads    = 4
+	// the first half of the derived key encrypts the secret, the second one verifies the passphrase
+	passphraseKeyLength = 64
+)
+
+// envelope cipher algorithms
+const (
+	algAESGCM            byte = 1
+	algXChaCha20Poly1305 byte = 2
+)
+
+// envelopePrefix marks an encrypted envelope.
+// Legacy AES-CFB values are plain base64 and never start with it.
+const envelopePrefix = "$"
+
+// verifierLabel separates key verifiers from other values derived from the key
+const verifierLabel = "secret key verifier"
+
+// verifierPrefix marks a key verifier, so its format can be told apart from other hashes
+const verifierPrefix = "$"
+
+var (
+	// ErrInvalidToken token has unknown format
+	ErrInvalidToken = errors.New("invalid secret token")
+	// ErrWrongKey token key doesn't match the secret
+	ErrWrongKey = errors.New("wrong secret key")
+	// ErrTampered ciphertext authentication failed
+	ErrTampered = errors.New("secret ciphertext is corrupted or was tampered with")
+	// ErrCiphertextTooShort ciphertext can't be decrypted
+	ErrCiphertextTooShort = errors.New("ciphertext block size is too short")
+	// ErrWrongPassphrase passphrase doesn't match the secret
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrWrongManageToken management token doesn't match the secret
+	ErrWrongManageToken = errors.New("wrong management token")
+	// ErrNoKeyring secret data key is wrapped, but there is no keyring to unwrap it
+	ErrNoKeyring = errors.New("secret data key is wrapped but no keyring is configured")
 )
 
 // generateKey generates a random encryption key
 func generateKey() string {
-	nonce := make([]byte, 12)
+	return generateRandomHex(keyLength / 2)
+}
+
+// generateID generates a random public lookup id
+func generateID() string {
+	return generateRandomHex(idLength / 2)
+}
+
+// generateManageToken generates a random secret management token
+func generateManageToken() string {
+	return generateRandomHex(manageTokenLength / 2)
+}
+
+// generateRandomHex returns n random bytes as a hex string
+func generateRandomHex(n int) string {
+	nonce := make([]byte, n)
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		panic(err.Error())
 	}
 	return fmt.Sprintf("%x", nonce)
 }
 
-// encryptSecret encrypts value with AES using key
+// makeToken joins lookup id and encryption key into a token returned to a client
+func makeToken(id, key string) string {
+	return id + key
+}
+
+// splitToken splits a client token into lookup id and encryption key.
+//
+// Legacy tokens were used both as an id and as a key, so they are returned as both parts.
+func splitToken(token string) (id, key string, err error) {
+	switch len(token) {
+	case keyLength:
+		return token, token, nil
+	case idLength + keyLength:
+		return token[:idLength], token[idLength:], nil
+	default:
+		return "", "", ErrInvalidToken
+	}
+}
+
+// lookupID returns a lookup id from a client token or from the id itself
+func lookupID(token string) (string, error) {
+	if len(token) == idLength {
+		return token, nil
+	}
+	id, _, err := splitToken(token)
+	return id, err
+}
+
+// hashKey returns a verifier of the key stored to check it.
+//
+// The verifier is an HMAC-SHA256 of the key hash with its own label, so it reveals nothing
+// about the key or about any other value derived from the key.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return keyVerifier(sum[:])
+}
+
+// keyVerifier returns a verifier of the key hash marked with verifierPrefix
+func keyVerifier(keyHash []byte) string {
+	mac := hmac.New(sha256.New, keyHash)
+	mac.Write([]byte(verifierLabel))
+	return verifierPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// MigrateKeyHashes replaces plain SHA-256 key and management token hashes
+// stored by earlier versions with key verifiers.
+//
+// Returns true if the secret was changed.
+func MigrateKeyHashes(s *models.SecretBase) (bool, error) {
+	keyHash, keyMigrated, err := migrateKeyHash(s.KeyHash)
+	if err != nil {
+		return false, err
+	}
+	manageHash, manageMigrated, err := migrateKeyHash(s.ManageHash)
+	if err != nil {
+		return false, err
+	}
+	s.KeyHash, s.ManageHash = keyHash, manageHash
+	return keyMigrated || manageMigrated, nil
+}
+
+// migrateKeyHash returns a verifier of the plain SHA-256 hash or the hash itself if it isn't plain
+func migrateKeyHash(hash string) (string, bool, error) {
+	if hash == "" || strings.HasPrefix(hash, verifierPrefix) {
+		return hash, false, nil
+	}
+	sum, err := hex.DecodeString(hash)
+	if err != nil || len(sum) != sha256.Size {
+		return "", false, errors.New("unknown key hash format")
+	}
+	return keyVerifier(sum), true, nil
+}
+
+// checkKey verifies the key against the stored hash.
+//
+// Empty hash means a legacy secret without key verification.
+func checkKey(key, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(hash)) != 1 {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// checkManageToken verifies the management token against the stored hash.
+//
+// Legacy secrets have no management token, so they can't be managed.
+func checkManageToken(token, hash string) error {
+	if hash == "" || subtle.ConstantTimeCompare([]byte(hashKey(token)), []byte(hash)) != 1 {
+		return ErrWrongManageToken
+	}
+	return nil
+}
+
+// encryptPassphrase encrypts value with a key derived from the passphrase
+// and stores the salt and the passphrase verifier in the secret
+func encryptPassphrase(s *models.SecretBase, passphrase, value string) (string, error) {
+	salt := make([]byte, passphraseSaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	key, check := derivePassphraseKey(passphrase, salt)
+	encValue, err := encryptSecret(key, value)
+	if err != nil {
+		return "", err
+	}
+
+	s.PassphraseSalt = base64.StdEncoding.EncodeToString(salt)
+	s.PassphraseCheck = check
+	return encValue, nil
+}
+
+// checkPassphrase verifies the passphrase against the secret and returns the derived key
+func checkPassphrase(s *models.SecretBase, passphrase string) (string, error) {
+	salt, err := base64.StdEncoding.DecodeString(s.PassphraseSalt)
+	if err != nil {
+		return "", err
+	}
+
+	key, check := derivePassphraseKey(passphrase, salt)
+	if subtle.ConstantTimeCompare([]byte(check), []byte(s.PassphraseCheck)) != 1 {
+		return "", ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// derivePassphraseKey derives an encryption key and a verifier from the passphrase with Argon2id
+func derivePassphraseKey(passphrase string, salt []byte) (key, check string) {
+	raw := argon2.IDKey([]byte(passphrase), salt, passphraseTime, passphraseMemory, passphraseThreads, passphraseKeyLength)
+	half := passphraseKeyLength / 2
+	return fmt.Sprintf("%x", raw[:half]), fmt.Sprintf("%x", raw[half:])
+}
+
+// encryptContent encrypts value and stores it in the secret.
+//
+// Without a keyring the value is encrypted with the token key directly.
+// Otherwise, it is encrypted with a random data key. The data key is encrypted with the token key
+// and then wrapped with the keyring, so it can be re-wrapped without access to the token.
+func (h *SecretHandler) encryptContent(s *models.SecretBase, key, value string) error {
+	if h.keyring == nil {
+		encValue, err := encryptSecret(key, value)
+		if err != nil {
+			return err
+		}
+		s.SecretText = encValue
+		return nil
+	}
+
+	dataKey := generateRandomHex(dataKeyLength / 2)
+	encValue, err := encryptSecret(dataKey, value)
+	if err != nil {
+		return err
+	}
+	encDataKey, err := encryptSecret(key, dataKey)
+	if err != nil {
+		return err
+	}
+	keyID, wrapped, err := h.keyring.Wrap([]byte(encDataKey))
+	if err != nil {
+		return err
+	}
+
+	s.SecretText = encValue
+	s.DataKey = base64.StdEncoding.EncodeToString(wrapped)
+	s.KeyID = keyID
+	return nil
+}
+
+// decryptContent decrypts the secret value with the token key.
+//
+// Only legacy secrets stored without a key hash may have AES-CFB values,
+// so a value of any other secret without an envelope is rejected as tampered.
+func (h *SecretHandler) decryptContent(s *models.SecretBase, key string) (string, error) {
+	if s.DataKey == "" {
+		if s.KeyHash == "" && !strings.HasPrefix(s.SecretText, envelopePrefix) {
+			return decryptLegacySecret(key, s.SecretText)
+		}
+		return decryptSecret(key, s.SecretText)
+	}
+	if h.keyring == nil {
+		return "", ErrNoKeyring
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(s.DataKey)
+	if err != nil {
+		return "", err
+	}
+	encDataKey, err := h.keyring.Unwrap(s.KeyID, wrapped)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := decryptSecret(key, string(encDataKey))
+	if err != nil {
+		return "", err
+	}
+	return decryptSecret(dataKey, s.SecretText)
+}
+
+// encryptSecret encrypts value with the default authenticated cipher using key
 func encryptSecret(key, value string) (string, error) {
-	rawKey := []byte(key)
-	rawText := []byte(value)
+	return encryptSecretWith(algAESGCM, key, value)
+}
 
-	block, err := aes.NewCipher(rawKey)
+// encryptSecretWith encrypts value with the algorithm alg using key.
+//
+// The result is an envelope: algorithm byte, nonce, ciphertext and tag, encoded with base64 and marked with envelopePrefix.
+func encryptSecretWith(alg byte, key, value string) (string, error) {
+	aead, err := newAEAD(alg, key)
 	if err != nil {
 		return "", err
 	}
 
-	//IV needs to be unique, but doesn't have to be secure.
-	//It's common to put it at the beginning of the ciphertext.
-	cipherText := make([]byte, aes.BlockSize+len(rawText))
-	iv := cipherText[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+	envelope := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(value)+aead.Overhead())
+	envelope[0] = alg
+	nonce := envelope[1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], rawText)
+	// algorithm byte is authenticated as additional data to prevent downgrade
+	envelope = aead.Seal(envelope, nonce, []byte(value), envelope[:1])
 
-	//returns to base64 encoded string
-	encText := base64.StdEncoding.EncodeToString(cipherText)
-	return encText, nil
+	return envelopePrefix + base64.StdEncoding.EncodeToString(envelope), nil
 }
 
-// decryptSecret decrypts value with AES using key
+// decryptSecret decrypts value using key.
+//
+// Values are decrypted with the algorithm stored in the envelope.
+// Values without an envelope are rejected, legacy AES-CFB values are decrypted by decryptLegacySecret only.
 func decryptSecret(key, value string) (string, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return "", ErrTampered
+	}
+
+	envelope, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, envelopePrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(envelope) < 1 {
+		return "", ErrCiphertextTooShort
+	}
+
+	aead, err := newAEAD(envelope[0], key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(envelope) < 1+aead.NonceSize()+aead.Overhead() {
+		return "", ErrCiphertextTooShort
+	}
+
+	nonce := envelope[1 : 1+aead.NonceSize()]
+	rawText, err := aead.Open(nil, nonce, envelope[1+aead.NonceSize():], envelope[:1])
+	if err != nil {
+		return "", ErrTampered
+	}
+
+	return string(rawText), nil
+}
+
+// newAEAD creates an authenticated cipher of the algorithm alg.
+//
+// The cipher key is derived from the key with SHA-256 to fit every supported algorithm.
+// Stored key verifiers are labeled HMACs of it (see hashKey), so they can't be used as the cipher key.
+func newAEAD(alg byte, key string) (cipher.AEAD, error) {
+	rawKey := sha256.Sum256([]byte(key))
+
+	switch alg {
+	case algAESGCM:
+		block, err := aes.NewCipher(rawKey[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case algXChaCha20Poly1305:
+		return chacha20poly1305.NewX(rawKey[:])
+	default:
+		return nil, fmt.Errorf("unknown cipher algorithm %d", alg)
+	}
+}
+
+// decryptLegacySecret decrypts value with AES-CFB using key
+func decryptLegacySecret(key, value string) (string, error) {
 	rawKey := []byte(key)
 
 	rawText, err := base64.StdEncoding.DecodeString(value)
@@ -60,8 +396,7 @@ func decryptSecret(key, value string) (string, error) {
 	}
 
 	if len(rawText) < aes.BlockSize {
-		err = errors.New("ciphertext block size is too short")
-		return "", err
+		return "", ErrCiphertextTooShort
 	}
 
 	//IV needs to be unique, but doesn't have to be secure.
@@ -1,10 +1,36 @@
 package handler
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// encryptLegacySecret encrypts value with AES-CFB as it was done before the envelope format
+func encryptLegacySecret(key, value string) string {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		panic(err)
+	}
+	cipherText := make([]byte, aes.BlockSize+len(value))
+	iv := cipherText[:aes.BlockSize]
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		panic(err)
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(cipherText[aes.BlockSize:], []byte(value))
+	return base64.StdEncoding.EncodeToString(cipherText)
+}
+
 func Test_crypto(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -58,3 +84,256 @@ func Test_crypto(t *testing.T) {
 		}
 	}
 }
+
+func Test_splitToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		id      string
+		key     string
+		wantErr bool
+	}{
+		{
+			name:  "token",
+			token: makeToken("0123456789abcdef", "5621caf61d79545957a49c7d"),
+			id:    "0123456789abcdef",
+			key:   "5621caf61d79545957a49c7d",
+		},
+		{
+			name:  "legacy",
+			token: "5621caf61d79545957a49c7d",
+			id:    "5621caf61d79545957a49c7d",
+			key:   "5621caf61d79545957a49c7d",
+		},
+		{
+			name:    "wrong length",
+			token:   "12345",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, key, err := splitToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("splitToken() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if id != tt.id || key != tt.key {
+				t.Errorf("splitToken() = %s, %s, want %s, %s", id, key, tt.id, tt.key)
+			}
+		})
+	}
+}
+
+func Test_checkKey(t *testing.T) {
+	key := "5621caf61d79545957a49c7d"
+	hash := hashKey(key)
+
+	if err := checkKey(key, hash); err != nil {
+		t.Errorf("checkKey() error = %v", err)
+	}
+	if err := checkKey("000000000000000000000001", hash); err != ErrWrongKey {
+		t.Errorf("checkKey() error = %v, want %v", err, ErrWrongKey)
+	}
+	if err := checkKey(key, ""); err != nil {
+		t.Errorf("checkKey() of a legacy secret error = %v", err)
+	}
+	if plain := fmt.Sprintf("%x", sha256.Sum256([]byte(key))); strings.Contains(hash, plain) {
+		t.Errorf("hashKey() = %s contains the plain key hash", hash)
+	}
+}
+
+func TestMigrateKeyHashes(t *testing.T) {
+	key := "5621caf61d79545957a49c7d"
+	token := "0123456789abcdef0123456789abcdef"
+	plain := func(v string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(v)))
+	}
+
+	s := models.SecretBase{KeyHash: plain(key), ManageHash: plain(token)}
+	changed, err := MigrateKeyHashes(&s)
+	if err != nil || !changed {
+		t.Fatalf("MigrateKeyHashes() = %v, %v, want true", changed, err)
+	}
+	if err := checkKey(key, s.KeyHash); err != nil {
+		t.Errorf("checkKey() of a migrated secret error = %v", err)
+	}
+	if err := checkManageToken(token, s.ManageHash); err != nil {
+		t.Errorf("checkManageToken() of a migrated secret error = %v", err)
+	}
+
+	// migrated and legacy secrets without hashes are left as is
+	for _, s := range []models.SecretBase{s, {}} {
+		want := s
+		if changed, err := MigrateKeyHashes(&s); err != nil || changed || s != want {
+			t.Errorf("MigrateKeyHashes() = %v, %v, secret %+v, want unchanged", changed, err, s)
+		}
+	}
+
+	if _, err := MigrateKeyHashes(&models.SecretBase{KeyHash: "not a hash"}); err == nil {
+		t.Error("MigrateKeyHashes() of an unknown format error = nil")
+	}
+}
+
+func Test_decryptSecret(t *testing.T) {
+	key := "5621caf61d79545957a49c7d"
+
+	encWith := func(alg byte) string {
+		res, err := encryptSecretWith(alg, key, "test_secret")
+		if err != nil {
+			panic(err)
+		}
+		return res
+	}
+
+	// flip the last byte of the envelope to emulate tampering
+	tamper := func(value string) string {
+		raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, envelopePrefix))
+		raw[len(raw)-1] ^= 0xff
+		return envelopePrefix + base64.StdEncoding.EncodeToString(raw)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "aes-gcm",
+			key:   key,
+			value: encWith(algAESGCM),
+			want:  "test_secret",
+		},
+		{
+			name:  "xchacha20-poly1305",
+			key:   key,
+			value: encWith(algXChaCha20Poly1305),
+			want:  "test_secret",
+		},
+		{
+			// the envelope can't be stripped to downgrade to unauthenticated AES-CFB
+			name:    "legacy aes-cfb",
+			key:     key,
+			value:   encryptLegacySecret(key, "test_secret"),
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "tampered",
+			key:     key,
+			value:   tamper(encWith(algAESGCM)),
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "wrong key",
+			key:     "000000000000000000000000",
+			value:   encWith(algXChaCha20Poly1305),
+			wantErr: ErrTampered,
+		},
+		{
+			name:    "too short",
+			key:     key,
+			value:   envelopePrefix + base64.StdEncoding.EncodeToString([]byte{algAESGCM, 1, 2, 3}),
+			wantErr: ErrCiphertextTooShort,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptSecret(tt.key, tt.value)
+			if err != tt.wantErr {
+				t.Errorf("decryptSecret() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("decryptSecret() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_keyVerifier checks that the stored key verifier can't be used to decrypt the secret
+func Test_keyVerifier(t *testing.T) {
+	key := "5621caf61d79545957a49c7d"
+	hash := hashKey(key)
+
+	for _, alg := range []byte{algAESGCM, algXChaCha20Poly1305} {
+		value, err := encryptSecretWith(alg, key, "test_secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := decryptSecret(hash, value); err != ErrTampered {
+			t.Errorf("decryptSecret() with the verifier error = %v, want %v", err, ErrTampered)
+		}
+
+		// the verifier is not the cipher key itself
+		rawHash, err := hex.DecodeString(strings.TrimPrefix(hash, verifierPrefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, envelopePrefix))
+		var aead cipher.AEAD
+		if alg == algAESGCM {
+			block, _ := aes.NewCipher(rawHash)
+			aead, _ = cipher.NewGCM(block)
+		} else {
+			aead, _ = chacha20poly1305.NewX(rawHash)
+		}
+		nonce := envelope[1 : 1+aead.NonceSize()]
+		if _, err := aead.Open(nil, nonce, envelope[1+aead.NonceSize():], envelope[:1]); err == nil {
+			t.Errorf("the verifier opens the envelope of algorithm %d", alg)
+		}
+	}
+}
+
+func TestSecretHandler_decryptContent(t *testing.T) {
+	key := "5621caf61d79545957a49c7d"
+	enveloped, err := encryptSecret(key, "test_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := encryptLegacySecret(key, "test_secret")
+
+	tests := []struct {
+		name    string
+		secret  models.SecretBase
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "enveloped",
+			secret: models.SecretBase{SecretText: enveloped, KeyHash: hashKey(key)},
+			want:   "test_secret",
+		},
+		{
+			name:   "legacy",
+			secret: models.SecretBase{SecretText: legacy},
+			want:   "test_secret",
+		},
+		{
+			name:   "legacy enveloped",
+			secret: models.SecretBase{SecretText: enveloped},
+			want:   "test_secret",
+		},
+		{
+			// a stored value of a new secret replaced with AES-CFB to skip authentication
+			name:    "downgraded",
+			secret:  models.SecretBase{SecretText: legacy, KeyHash: hashKey(key)},
+			wantErr: ErrTampered,
+		},
+	}
+	h := NewSecretHandler(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.decryptContent(&tt.secret, key)
+			if err != tt.wantErr {
+				t.Errorf("decryptContent() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("decryptContent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+// stable API error codes
+const (
+	CodeInvalidRequest      = "invalid_request"
+	CodeValidationFailed    = "validation_failed"
+	CodeNotFound            = "not_found"
+	CodePassphraseRequired  = "passphrase_required"
+	CodeWrongPassphrase     = "wrong_passphrase"
+	CodeManageTokenRequired = "manage_token_required"
+	CodeWrongManageToken    = "wrong_manage_token"
+	CodeSecretOutdated      = "secret_outdated"
+	CodeFileSecret          = "file_secret"
+	CodePayloadTooLarge     = "payload_too_large"
+	CodeConflict            = "conflict"
+	CodeStorageUnavailable  = "storage_unavailable"
+	CodeDecryptionFailed    = "decryption_failed"
+	CodeInternalError       = "internal_error"
+)
+
+// APIError is an error returned to API clients with HTTP status and stable code
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Details []models.ErrorDetail
+
+	// cause is an internal error, it isn't disclosed to clients
+	cause error
+}
+
+// Error interface implementation
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// newRequestError creates an error of a malformed request
+func newRequestError(details ...models.ErrorDetail) *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidRequest,
+		Message: "invalid request parameters",
+		Details: details,
+	}
+}
+
+// newValidationError creates an error of a well-formed request with invalid values
+func newValidationError(details ...models.ErrorDetail) *APIError {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeValidationFailed,
+		Message: "request validation failed",
+		Details: details,
+	}
+}
+
+// newNotFoundError creates an error of a missing secret.
+//
+// Unknown tokens and wrong keys are reported the same way to not disclose existing secrets.
+func newNotFoundError() *APIError {
+	return &APIError{
+		Status:  http.StatusNotFound,
+		Code:    CodeNotFound,
+		Message: "secret not found",
+	}
+}
+
+// newPassphraseRequiredError creates an error of a missing passphrase
+func newPassphraseRequiredError() *APIError {
+	return &APIError{
+		Status:  http.StatusUnauthorized,
+		Code:    CodePassphraseRequired,
+		Message: "the secret is protected with a passphrase",
+	}
+}
+
+// newWrongPassphraseError creates an error of a wrong passphrase with the number of remaining attempts
+func newWrongPassphraseError(attemptsLeft int) *APIError {
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    CodeWrongPassphrase,
+		Message: fmt.Sprintf("wrong passphrase, %d attempts left", attemptsLeft),
+	}
+}
+
+// newManageTokenError creates an error of a missing or wrong management token
+func newManageTokenError(missing bool) *APIError {
+	if missing {
+		return &APIError{
+			Status:  http.StatusUnauthorized,
+			Code:    CodeManageTokenRequired,
+			Message: "management token is required",
+		}
+	}
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    CodeWrongManageToken,
+		Message: "wrong management token",
+	}
+}
+
+// newFileSecretError creates an error of a file secret requested as a text
+func newFileSecretError() *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeFileSecret,
+		Message: "the secret is a file, download it from the file endpoint",
+	}
+}
+
+// newTooLargeError creates an error of a too large request
+func newTooLargeError(limit int64) *APIError {
+	return &APIError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    CodePayloadTooLarge,
+		Message: fmt.Sprintf("the secret exceeds the size limit of %d bytes", limit),
+	}
+}
+
+// newOutdatedError creates an error of an expired or burned secret
+func newOutdatedError() *APIError {
+	return &APIError{
+		Status:  http.StatusGone,
+		Code:    CodeSecretOutdated,
+		Message: ErrSecretOutdated.Error(),
+	}
+}
+
+// newDecryptionError creates an error of a secret that can't be decrypted
+func newDecryptionError(cause error) *APIError {
+	return &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeDecryptionFailed,
+		Message: "secret can't be decrypted",
+		cause:   cause,
+	}
+}
+
+// newInternalError creates an error of an unexpected server failure
+func newInternalError(cause error) *APIError {
+	return &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternalError,
+		Message: "internal server error",
+		cause:   cause,
+	}
+}
+
+// newDatabaseError maps a database error to an API error.
+//
+// Unknown errors are considered as backend failures.
+func newDatabaseError(err error) *APIError {
+	switch err {
+	case database.ErrNotFound:
+		return newNotFoundError()
+	case database.ErrSecretOutdated:
+		return newOutdatedError()
+	case database.ErrSecretModified:
+		return &APIError{
+			Status:  http.StatusConflict,
+			Code:    CodeConflict,
+			Message: "secret was modified concurrently, try again",
+		}
+	default:
+		return &APIError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    CodeStorageUnavailable,
+			Message: "secret storage is unavailable",
+			cause:   err,
+		}
+	}
+}
+
+// abortWithError stops the request processing and responds with the error for accepted MIME type
+func abortWithError(c *gin.Context, err *APIError) {
+	if err.cause != nil {
+		logging.Error("request error", logging.String("code", err.Code), logging.Err(err.cause))
+	}
+	getStatusResponseFunc(c, err.Status)(&models.ErrorResponse{
+		Code:    err.Code,
+		Message: err.Message,
+		Details: err.Details,
+	})
+	c.Abort()
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+const (
+	// defaultMaxFileBytes is a default size limit of a file secret
+	defaultMaxFileBytes = 10 << 20
+	// defaultFileChunkSize is a default size of a stored file chunk
+	defaultFileChunkSize = 256 << 10
+	// maxFormValueBytes is a size limit of a regular field in a multipart request
+	maxFormValueBytes = 64 << 10
+
+	// defaultFileName is a name of an uploaded file without a name
+	defaultFileName = "secret.bin"
+	// textFileName is a name of a text secret downloaded as a file
+	textFileName = "secret.txt"
+	// defaultContentType is a content type of an uploaded file without a type
+	defaultContentType = "application/octet-stream"
+)
+
+// ErrFileTooLarge uploaded file exceeds the size limit
+var ErrFileTooLarge = errors.New("file is too large")
+
+// GetSecretFile downloads a secret as a file.
+//
+// It consumes a view the same way as GetSecret. File content is read from the database and decrypted chunk by chunk,
+// so it is never held fully in memory. Text secrets are downloaded as text files.
+func (h *SecretHandler) GetSecretFile(c *gin.Context) {
+	hash, s, content, ok := h.openSecret(c, c.Param("hash"), true)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	if !isFile(&s.SecretBase) {
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": textFileName}))
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(content))
+		return
+	}
+
+	// chunks of the burned secret aren't needed after the download
+	if s.RemainingViews == 0 {
+		defer h.deleteChunks(hash, &s.SecretBase)
+	}
+
+	name, err := decryptSecret(content, s.FileName)
+	if err != nil {
+		abortWithError(c, newDecryptionError(err))
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Header("Content-Type", s.ContentType)
+	c.Header("Content-Length", strconv.FormatInt(s.FileSize, 10))
+	c.Status(http.StatusOK)
+
+	for idx := 0; idx < int(s.Chunks); idx++ {
+		chunk, err := h.readChunk(hash, content, idx)
+		if err != nil {
+			// the response is already started, so the client only sees an incomplete body
+			logging.Error("secret file chunk can't be read", logging.Hash("secret", hash), logging.Int("chunk", idx), logging.Err(err))
+			c.Abort()
+			return
+		}
+		if _, err := io.WriteString(c.Writer, chunk); err != nil {
+			c.Abort()
+			return
+		}
+	}
+}
+
+// readMultipartRequest reads secret creation parameters from a multipart body.
+//
+// Regular fields must precede the file part, the file part is returned unread and fields after it are ignored.
+func (h *SecretHandler) readMultipartRequest(c *gin.Context) (*models.SecretRequest, *multipart.Part, error) {
+	c.Request.Body = &limitedBody{ReadCloser: c.Request.Body, n: h.maxFileBytes + maxFormValueBytes*8, err: ErrFileTooLarge}
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var req models.SecretRequest
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return &req, nil, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		// reading of the next part would drain the file, so the rest of the body is ignored
+		if part.FormName() == "file" {
+			return &req, part, nil
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueBytes))
+		if err != nil {
+			return nil, nil, err
+		}
+		switch part.FormName() {
+		case "secret":
+			req.Secret = string(value)
+		case "expireAfterViews":
+			req.ExpireAfterViews = models.RawValue(value)
+		case "expireAfter":
+			req.ExpireAfter = models.RawValue(value)
+		case "passphrase":
+			req.Passphrase = string(value)
+		case "notifyUrl":
+			req.NotifyURL = string(value)
+		}
+	}
+}
+
+// limitedBody is a request body failing with err after n bytes
+type limitedBody struct {
+	io.ReadCloser
+	// n is the number of bytes left
+	n   int64
+	err error
+}
+
+// Read reads the body until the limit is exceeded
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// one byte over the limit is read to tell a body of exactly n bytes from a larger one
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.n {
+		n = int(b.n)
+		b.n = 0
+		return n, b.err
+	}
+	b.n -= int64(n)
+	return n, err
+}
+
+// storeFile encrypts the file with the file key and stores it in chunks.
+//
+// Chunks are stored as separate database records with the same expiration as the secret.
+// The number of stored chunks is kept in the secret even on error, so they can be deleted.
+func (h *SecretHandler) storeFile(hash string, s *models.SecretBase, fileKey string, file *multipart.Part) error {
+	name := fileName(file)
+	encName, err := encryptSecret(fileKey, name)
+	if err != nil {
+		return err
+	}
+	s.FileName = encName
+	s.ContentType = fileContentType(file)
+
+	buf := make([]byte, h.fileChunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			s.FileSize += int64(n)
+			if s.FileSize > h.maxFileBytes {
+				return ErrFileTooLarge
+			}
+			if err := h.writeChunk(hash, s, fileKey, int(s.Chunks), buf[:n]); err != nil {
+				return err
+			}
+			s.Chunks++
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// writeChunk encrypts and stores a file chunk
+func (h *SecretHandler) writeChunk(hash string, s *models.SecretBase, fileKey string, idx int, data []byte) error {
+	key := chunkKey(fileKey, idx)
+	encData, err := encryptSecret(key, string(data))
+	if err != nil {
+		return err
+	}
+	return h.db.CreateSecret(models.ChunkID(hash, idx), models.Secret{
+		SecretBase: models.SecretBase{
+			CreatedAt:      s.CreatedAt,
+			ExpiresAt:      s.ExpiresAt,
+			RemainingViews: 1,
+			SecretText:     encData,
+			// chunks are verified by their own keys, so they can't be read as legacy secrets
+			KeyHash: hashKey(key),
+		},
+	})
+}
+
+// readChunk reads and decrypts a file chunk
+func (h *SecretHandler) readChunk(hash, fileKey string, idx int) (string, error) {
+	chunk, err := h.db.GetSecret(models.ChunkID(hash, idx))
+	if err != nil {
+		return "", err
+	}
+	return decryptSecret(chunkKey(fileKey, idx), chunk.SecretText)
+}
+
+// deleteChunks deletes file chunks of the secret
+func (h *SecretHandler) deleteChunks(hash string, s *models.SecretBase) {
+	for idx := 0; idx < int(s.Chunks); idx++ {
+		if err := h.db.DeleteSecret(models.ChunkID(hash, idx)); err != nil && err != database.ErrNotFound {
+			logging.Warn("secret file chunk can't be deleted", logging.Hash("secret", hash), logging.Int("chunk", idx), logging.Err(err))
+		}
+	}
+}
+
+// chunkKey returns an encryption key of a file chunk.
+//
+// Every chunk is bound to its position, so chunks can't be reordered.
+func chunkKey(fileKey string, idx int) string {
+	return fmt.Sprintf("%s:%d", fileKey, idx)
+}
+
+// fileName returns a name of an uploaded file
+func fileName(file *multipart.Part) string {
+	if name := file.FileName(); name != "" {
+		return name
+	}
+	return defaultFileName
+}
+
+// fileContentType returns a content type of an uploaded file
+func fileContentType(file *multipart.Part) string {
+	if ct := file.Header.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	return defaultContentType
+}
+
+// isFile checks if the secret is a file
+func isFile(s *models.SecretBase) bool {
+	return s.FileName != ""
+}
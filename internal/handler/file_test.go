@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testPart struct {
+	name, fileName, contentType, value string
+}
+
+// newMultipartRequest creates a secret creation request with parts in the given order
+func newMultipartRequest(t *testing.T, parts []testPart) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		if p.fileName != "" {
+			header.Set("Content-Disposition", `form-data; name="`+p.name+`"; filename="`+p.fileName+`"`)
+			header.Set("Content-Type", p.contentType)
+		} else {
+			header.Set("Content-Disposition", `form-data; name="`+p.name+`"`)
+		}
+		w, err := mw.CreatePart(header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(p.value))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	req, _ := http.NewRequest("POST", "/secret", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestSecretHandler_File(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := database.NewMemoryDB()
+	h := NewSecretHandler(db, WithFileLimits(16, 4))
+	h.nowFunc = func() time.Time { return now }
+
+	router := gin.New()
+	router.POST("/secret", h.PostSecret)
+	router.GET("/secret/:hash", h.GetSecret)
+	router.GET("/secret/:hash/file", h.GetSecretFile)
+	router.GET("/secret/:hash/meta", h.GetSecretMeta)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(path, passphrase string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if passphrase != "" {
+			req.Header.Set(passphraseHeader, passphrase)
+		}
+		return serve(req)
+	}
+
+	// upload
+	w := serve(newMultipartRequest(t, []testPart{
+		{name: "expireAfterViews", value: "2"},
+		{name: "expireAfter", value: "0"},
+		{name: "file", fileName: "id_rsa", contentType: "application/x-pem-file", value: "0123456789"},
+	}))
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	var res models.SecretResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, "id_rsa", res.FileName)
+	assert.Equal(t, "application/x-pem-file", res.ContentType)
+	assert.Equal(t, int64(10), res.Size)
+	assert.Empty(t, res.SecretText)
+	id, _, _ := splitToken(res.Hash)
+
+	// file is stored in encrypted chunks, the file name is encrypted too
+	s, err := db.GetSecret(id)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), s.Chunks)
+	assert.NotContains(t, s.FileName, "id_rsa")
+	for idx := 0; idx < 3; idx++ {
+		chunk, err := db.GetSecret(models.ChunkID(id, idx))
+		require.NoError(t, err)
+		assert.NotContains(t, chunk.SecretText, "0123")
+		// chunks have verifiers of their own keys
+		assert.NotEmpty(t, chunk.KeyHash)
+		assert.NotEqual(t, s.KeyHash, chunk.KeyHash)
+	}
+
+	// file can't be read as a text secret and metadata doesn't consume views
+	w = get("/secret/"+res.Hash, "")
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), CodeFileSecret)
+	w = get("/secret/"+res.Hash+"/meta", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"remainingViews":2,"readable":true,"passphraseRequired":false,"file":true,"size":10`)
+
+	// download
+	for i := 0; i < 2; i++ {
+		w = get("/secret/"+res.Hash+"/file", "")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+		assert.Equal(t, "attachment; filename=id_rsa", w.Header().Get("Content-Disposition"))
+		assert.Equal(t, "application/x-pem-file", w.Header().Get("Content-Type"))
+		assert.Equal(t, "10", w.Header().Get("Content-Length"))
+	}
+
+	// chunks are deleted with the last view
+	assert.Equal(t, 404, get("/secret/"+res.Hash+"/file", "").Code)
+	for idx := 0; idx < 3; idx++ {
+		_, err := db.GetSecret(models.ChunkID(id, idx))
+		assert.Equal(t, database.ErrNotFound, err)
+	}
+
+	// passphrase-protected file
+	w = serve(newMultipartRequest(t, []testPart{
+		{name: "expireAfterViews", value: "1"},
+		{name: "expireAfter", value: "0"},
+		{name: "passphrase", value: "correct horse"},
+		{name: "file", fileName: "config", contentType: "text/yaml", value: "key: value"},
+	}))
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, 401, get("/secret/"+res.Hash+"/file", "").Code)
+	w = get("/secret/"+res.Hash+"/file", "correct horse")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "key: value", w.Body.String())
+
+	// text secret is downloaded as a text file
+	w = serve(newMultipartRequest(t, []testPart{
+		{name: "secret", value: "test_secret"},
+		{name: "expireAfterViews", value: "1"},
+		{name: "expireAfter", value: "0"},
+	}))
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	w = get("/secret/"+res.Hash+"/file", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "test_secret", w.Body.String())
+	assert.Equal(t, "attachment; filename=secret.txt", w.Header().Get("Content-Disposition"))
+}
+
+func TestSecretHandler_FileErrors(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	tests := []struct {
+		name     string
+		parts    []testPart
+		respCode int
+		respBody string
+	}{
+		{
+			name: "too large",
+			parts: []testPart{
+				{name: "expireAfterViews", value: "1"},
+				{name: "expireAfter", value: "0"},
+				{name: "file", fileName: "big", contentType: "text/plain", value: "0123456789abcdefg"},
+			},
+			respCode: 413,
+			respBody: `{"code":"payload_too_large","message":"the secret exceeds the size limit of 16 bytes"}`,
+		},
+		{
+			name: "fields after the file are ignored",
+			parts: []testPart{
+				{name: "file", fileName: "f", contentType: "text/plain", value: "0123"},
+				{name: "expireAfterViews", value: "1"},
+				{name: "expireAfter", value: "0"},
+			},
+			respCode: 400,
+			respBody: `{"code":"invalid_request","message":"invalid request parameters","details":[{"field":"expireAfterViews","message":"must be an integer"}]}`,
+		},
+		{
+			name: "validation",
+			parts: []testPart{
+				{name: "expireAfterViews", value: "0"},
+				{name: "expireAfter", value: "0"},
+				{name: "file", fileName: "f", contentType: "text/plain", value: "0123"},
+			},
+			respCode: 422,
+			respBody: `{"code":"validation_failed","message":"request validation failed","details":[{"field":"expireAfterViews","message":"must be greater than 0, got 0"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := database.NewMemoryDB()
+			h := NewSecretHandler(db, WithFileLimits(16, 4))
+
+			router := gin.New()
+			router.POST("/secret", h.PostSecret)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newMultipartRequest(t, tt.parts))
+			assert.Equal(t, tt.respCode, w.Code)
+			assert.Equal(t, tt.respBody, w.Body.String())
+
+			// nothing is left in the database
+			count := 0
+			require.NoError(t, db.ForEachSecret(func(string) error {
+				count++
+				return nil
+			}))
+			assert.Equal(t, 0, count)
+		})
+	}
+}
+
+func Test_limitedBody(t *testing.T) {
+	body := func(n int64) *limitedBody {
+		return &limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")), n: n, err: ErrFileTooLarge}
+	}
+
+	data, err := ioutil.ReadAll(body(10))
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	data, err = ioutil.ReadAll(body(9))
+	assert.Equal(t, ErrFileTooLarge, err)
+	assert.Equal(t, "012345678", string(data))
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+// Policy is a set of secret creation limits.
+//
+// Zero value has no limits.
+type Policy struct {
+	// MaxBytes is a size limit of a secret text, 0 means no limit
+	MaxBytes int
+	// MaxViews is a limit of views of a secret, 0 means no limit
+	MaxViews int
+	// MaxTTL is a limit of a secret lifetime, 0 means no limit
+	MaxTTL time.Duration
+	// DefaultTTL is a lifetime of a secret created without expiration time, 0 means it never expires
+	DefaultTTL time.Duration
+	// ForbidNeverExpire rejects secrets without expiration time
+	ForbidNeverExpire bool
+	// AllowedContentTypes is a list of content types of file secrets, e.g. text/plain or text/*. Empty list allows any type
+	AllowedContentTypes []string
+}
+
+// Validate checks that the policy limits are consistent
+func (p Policy) Validate() error {
+	switch {
+	case p.MaxBytes < 0:
+		return errors.New("maximum secret size must not be negative")
+	case p.MaxViews < 0:
+		return errors.New("maximum number of views must not be negative")
+	case p.MaxTTL < 0:
+		return errors.New("maximum TTL must not be negative")
+	case p.DefaultTTL < 0:
+		return errors.New("default TTL must not be negative")
+	case p.MaxTTL > 0 && p.DefaultTTL > p.MaxTTL:
+		return fmt.Errorf("default TTL %s exceeds maximum TTL %s", p.DefaultTTL, p.MaxTTL)
+	}
+	for _, ct := range p.AllowedContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("invalid allowed content type %q: %v", ct, err)
+		}
+	}
+	return nil
+}
+
+// check validates new secret parameters and returns all violations.
+//
+// TTL is the secret lifetime, 0 means it never expires. Content type is only checked for files.
+func (p Policy) check(secret string, views int, ttl time.Duration, contentType string) []models.ErrorDetail {
+	var details []models.ErrorDetail
+
+	if p.MaxBytes > 0 && len(secret) > p.MaxBytes {
+		details = append(details, models.ErrorDetail{
+			Field:   "secret",
+			Message: fmt.Sprintf("must be at most %d bytes, got %d", p.MaxBytes, len(secret)),
+		})
+	}
+
+	switch {
+	case views <= 0:
+		details = append(details, models.ErrorDetail{
+			Field:   "expireAfterViews",
+			Message: fmt.Sprintf("must be greater than 0, got %d", views),
+		})
+	case p.MaxViews > 0 && views > p.MaxViews:
+		details = append(details, models.ErrorDetail{
+			Field:   "expireAfterViews",
+			Message: fmt.Sprintf("must be at most %d, got %d", p.MaxViews, views),
+		})
+	}
+
+	minutes := int(ttl / time.Minute)
+	switch {
+	case ttl < 0:
+		details = append(details, models.ErrorDetail{
+			Field:   "expireAfter",
+			Message: fmt.Sprintf("must not be negative, got %d", minutes),
+		})
+	case ttl == 0 && (p.ForbidNeverExpire || p.MaxTTL > 0):
+		// limited lifetime doesn't allow secrets that never expire
+		details = append(details, models.ErrorDetail{
+			Field:   "expireAfter",
+			Message: "must be greater than 0, secrets that never expire are not allowed",
+		})
+	case p.MaxTTL > 0 && ttl > p.MaxTTL:
+		details = append(details, models.ErrorDetail{
+			Field:   "expireAfter",
+			Message: fmt.Sprintf("must be at most %d minutes, got %d", int(p.MaxTTL/time.Minute), minutes),
+		})
+	}
+
+	if contentType != "" && !p.allowsContentType(contentType) {
+		details = append(details, models.ErrorDetail{
+			Field:   "file",
+			Message: fmt.Sprintf("content type %s is not allowed, allowed types are %s", contentType, strings.Join(p.AllowedContentTypes, ", ")),
+		})
+	}
+
+	return details
+}
+
+// allowsContentType checks if a file of the content type can be stored.
+//
+// Content type parameters are ignored, subtype wildcards like text/* are supported.
+func (p Policy) allowsContentType(contentType string) bool {
+	if len(p.AllowedContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.AllowedContentTypes {
+		allowedType, _, _ := mime.ParseMediaType(allowed)
+		if allowedType == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowedType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowedType, "*")) {
+			return true
+		}
+	}
+	return false
+}
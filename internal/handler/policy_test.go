@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{name: "no limits", policy: Policy{}},
+		{name: "consistent", policy: Policy{MaxBytes: 10, MaxViews: 10, MaxTTL: time.Hour, DefaultTTL: time.Minute, AllowedContentTypes: []string{"text/*"}}},
+		{name: "negative size", policy: Policy{MaxBytes: -1}, wantErr: true},
+		{name: "negative views", policy: Policy{MaxViews: -1}, wantErr: true},
+		{name: "default exceeds max", policy: Policy{MaxTTL: time.Minute, DefaultTTL: time.Hour}, wantErr: true},
+		{name: "bad content type", policy: Policy{AllowedContentTypes: []string{"text/"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicy_allowsContentType(t *testing.T) {
+	p := Policy{AllowedContentTypes: []string{"application/x-pem-file", "text/*"}}
+
+	assert.True(t, p.allowsContentType("application/x-pem-file"))
+	assert.True(t, p.allowsContentType("text/plain; charset=utf-8"))
+	assert.True(t, p.allowsContentType("text/yaml"))
+	assert.False(t, p.allowsContentType("application/octet-stream"))
+	assert.False(t, p.allowsContentType("textual/plain"))
+	assert.False(t, p.allowsContentType("invalid"))
+
+	assert.True(t, Policy{}.allowsContentType("application/octet-stream"))
+}
+
+func TestPolicy_check(t *testing.T) {
+	p := Policy{AllowedContentTypes: []string{"text/plain"}}
+
+	details := p.check("", 1, time.Minute, "image/png")
+	if assert.Len(t, details, 1) {
+		assert.Equal(t, "file", details[0].Field)
+		assert.Equal(t, "content type image/png is not allowed, allowed types are text/plain", details[0].Message)
+	}
+
+	// text secrets have no content type
+	assert.Empty(t, p.check("test_secret", 1, 0, ""))
+
+	// secrets that never expire aren't allowed with limited lifetime
+	assert.Len(t, Policy{MaxTTL: time.Hour}.check("", 1, 0, ""), 1)
+}
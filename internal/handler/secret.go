@@ -1,107 +1,392 @@
 package handler
 
 import (
+	"encoding/json"
+	"encoding/xml"
 	"errors"
-	"fmt"
-	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-openapi/strfmt"
+	"github.com/ilyakaznacheev/secret/internal/audit"
+	"github.com/ilyakaznacheev/secret/internal/certs"
+	"github.com/ilyakaznacheev/secret/internal/clientip"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/logging"
 	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+	"github.com/ilyakaznacheev/secret/internal/webhook"
+)
+
+const (
+	// passphraseHeader is a request header with the secret passphrase
+	passphraseHeader = "X-Secret-Passphrase"
+	// manageTokenHeader is a request header with the secret management token
+	manageTokenHeader = "X-Manage-Token"
+	// defaultPassphraseAttempts is a default number of wrong passphrase attempts before the secret is deleted
+	defaultPassphraseAttempts = 5
+	// maxBodyBytes is a size limit of JSON and XML request bodies if the policy doesn't limit the secret size
+	maxBodyBytes = 10 << 20
 )
 
 var (
 	// ErrSecretOutdated secret in not valid anymore
-	ErrSecretOutdated = errors.New("secret isn't valid anymore")
+	ErrSecretOutdated = database.ErrSecretOutdated
+	// ErrNoTenants tenant namespaces aren't configured
+	ErrNoTenants = errors.New("tenant namespaces aren't configured")
+	// ErrBodyTooLarge request body exceeds the size limit
+	ErrBodyTooLarge = errors.New("request body is too large")
 )
 
 // SecretHandler is a REST API handler for secret service
 type SecretHandler struct {
-	db Database
+	db       Database
+	keyring  KeyWrapper
+	notifier Notifier
+	auditor  Auditor
+	// fingerprintKey is a key of ids of legacy secrets in events
+	fingerprintKey []byte
+	// tenants returns databases of tenant namespaces
+	tenants func(tenant string) Database
+	// tenant is the name of the current namespace
+	tenant string
+
+	// number of wrong passphrase attempts before the secret is deleted
+	passphraseAttempts int
+	// secret creation limits
+	policy Policy
+	// file secret size limit and the size of its stored chunks
+	maxFileBytes  int64
+	fileChunkSize int
 
 	// main functions can be injected for test purposes
 	nowFunc func() time.Time
 	keygen  func() string
+	idgen   func() string
+	mgmtgen func() string
+}
+
+// Option is a SecretHandler configuration option
+type Option func(*SecretHandler)
+
+// WithKeyring enables wrapping of data keys with server-side key-encryption keys
+func WithKeyring(kr KeyWrapper) Option {
+	return func(h *SecretHandler) {
+		h.keyring = kr
+	}
+}
+
+// WithNotifier enables lifecycle event webhooks of secrets created with a notification URL
+func WithNotifier(n Notifier) Option {
+	return func(h *SecretHandler) {
+		h.notifier = n
+	}
+}
+
+// WithAuditor enables the audit trail of secret lifecycle events
+func WithAuditor(a Auditor) Option {
+	return func(h *SecretHandler) {
+		h.auditor = a
+	}
+}
+
+// WithFingerprintKey sets a key of fingerprints identifying legacy secrets in events
+func WithFingerprintKey(key []byte) Option {
+	return func(h *SecretHandler) {
+		h.fingerprintKey = key
+	}
+}
+
+// WithPassphraseAttempts sets the number of wrong passphrase attempts before a secret is deleted
+func WithPassphraseAttempts(n int) Option {
+	return func(h *SecretHandler) {
+		h.passphraseAttempts = n
+	}
+}
+
+// WithPolicy sets secret creation limits
+func WithPolicy(p Policy) Option {
+	return func(h *SecretHandler) {
+		h.policy = p
+	}
+}
+
+// WithFileLimits sets the maximum size of a file secret and the size of its stored chunks
+func WithFileLimits(maxBytes int64, chunkSize int) Option {
+	return func(h *SecretHandler) {
+		h.maxFileBytes = maxBytes
+		h.fileChunkSize = chunkSize
+	}
+}
+
+// WithTenants isolates secrets of tenants in database namespaces
+func WithTenants(ns func(tenant string) Database) Option {
+	return func(h *SecretHandler) {
+		h.tenants = ns
+	}
 }
 
 // NewSecretHandler creates a new API handler
-func NewSecretHandler(db Database) *SecretHandler {
-	return &SecretHandler{
-		db:      db,
-		nowFunc: time.Now,
-		keygen:  generateKey,
+func NewSecretHandler(db Database, opts ...Option) *SecretHandler {
+	h := &SecretHandler{
+		db:                 db,
+		passphraseAttempts: defaultPassphraseAttempts,
+		maxFileBytes:       defaultMaxFileBytes,
+		fileChunkSize:      defaultFileChunkSize,
+		nowFunc:            time.Now,
+		keygen:             generateKey,
+		idgen:              generateID,
+		mgmtgen:            generateManageToken,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // GetSecret returns a secret if possible.
 //
-// It tries to get a secret by hash, if found, checks view counter and TTL. If any of checks fails, the method will delete this secret as expired. Otherwise, it will decrement view counter and return the secret.
+// It splits the token into lookup id and key, tries to get a secret by id and, if found, checks the key.
+// A passphrase-protected secret also requires the passphrase, wrong attempts are counted without consuming a view. Then it atomically consumes one view of the secret. The database checks view counter and TTL, and deletes the secret if it is outdated or has no views left.
 func (h *SecretHandler) GetSecret(c *gin.Context) {
+	token := c.Param("hash")
+	_, s, content, ok := h.openSecret(c, token, false)
+	if !ok {
+		return
+	}
+
+	var expFormatted *strfmt.DateTime
+	if s.ExpiresAt != nil {
+		exp := strfmt.DateTime(*s.ExpiresAt)
+		expFormatted = &exp
+	}
+
+	// prepare response structure
+	res := models.SecretResponse{
+		CreatedAt:      strfmt.DateTime(s.CreatedAt),
+		ExpiresAt:      expFormatted,
+		Hash:           token,
+		RemainingViews: s.RemainingViews,
+		SecretText:     content,
+	}
+
+	getResponseFunc(c)(&res)
+}
+
+// openSecret finds the secret, checks its key and passphrase, consumes a view and decrypts the content.
+//
+// File secrets are only opened if file is set, their content is the file key.
+// If the secret can't be opened, the error is sent to the client and ok is false.
+func (h *SecretHandler) openSecret(c *gin.Context, token string, file bool) (hash string, s *models.Secret, content string, ok bool) {
 	now := h.nowFunc()
 
-	hash := c.Param("hash")
-	s, err := h.db.GetSecret(hash)
+	h, token, ok = h.forTenant(c, token)
+	if !ok {
+		abortWithError(c, newNotFoundError())
+		return "", nil, "", false
+	}
+
+	hash, key, s, apiErr := h.findSecret(token)
+	if apiErr != nil {
+		abortWithError(c, apiErr)
+		return "", nil, "", false
+	}
+
+	// file content can't be sent in a response structure
+	if isFile(&s.SecretBase) && !file {
+		abortWithError(c, newFileSecretError())
+		return "", nil, "", false
+	}
+
+	// passphrase check must be done before the view is consumed
+	var passphraseKey string
+	if s.PassphraseCheck != "" {
+		passphrase := c.GetHeader(passphraseHeader)
+		if passphrase == "" {
+			passphrase = c.PostForm("passphrase")
+		}
+		if passphrase == "" {
+			abortWithError(c, newPassphraseRequiredError())
+			return "", nil, "", false
+		}
+
+		var err error
+		passphraseKey, err = checkPassphrase(&s.SecretBase, passphrase)
+		if err != nil {
+			h.abortWithWrongPassphrase(c, hash, s)
+			return "", nil, "", false
+		}
+	}
+
+	// check validity and decrement view counter
+	consumed, err := h.db.ConsumeSecret(hash, now)
+	switch err {
+	case nil:
+		s = consumed
+		h.notify(c, hash, &s.SecretBase, webhook.EventViewed)
+		if s.RemainingViews == 0 {
+			h.notify(c, hash, &s.SecretBase, webhook.EventBurned)
+			h.keepTombstone(hash, &s.SecretBase, models.StateRead)
+		}
+	case ErrSecretOutdated, database.ErrNotFound:
+		// the secret existed a moment ago, so it was expired or burned by a concurrent view
+		logging.Info("secret is outdated", logging.Hash("secret", hash))
+		if s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
+			h.notify(c, hash, &s.SecretBase, webhook.EventExpired)
+			h.deleteChunks(hash, &s.SecretBase)
+		}
+		abortWithError(c, newOutdatedError())
+		return "", nil, "", false
+	default:
+		abortWithError(c, newDatabaseError(err))
+		return "", nil, "", false
+	}
+
+	// decrypt secret
+	content, err = h.decryptContent(&s.SecretBase, key)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		abortWithError(c, newDecryptionError(err))
+		return "", nil, "", false
+	}
+	if passphraseKey != "" {
+		content, err = decryptSecret(passphraseKey, content)
+		if err != nil {
+			abortWithError(c, newDecryptionError(err))
+			return "", nil, "", false
+		}
+	}
+	return hash, s, content, true
+}
+
+// GetSecretMeta returns a state of a secret without decrypting it or consuming a view.
+//
+// The token key is checked the same way as in GetSecret, so the state is only visible to the token holder.
+func (h *SecretHandler) GetSecretMeta(c *gin.Context) {
+	h, token, ok := h.forTenant(c, c.Param("hash"))
+	if !ok {
+		abortWithError(c, newNotFoundError())
 		return
 	}
 
-	// validity checks
+	_, _, s, apiErr := h.findSecret(token)
+	if apiErr != nil {
+		abortWithError(c, apiErr)
+		return
+	}
 
-	// TTL check
-	if s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
-		log.Printf("secret %s expire time is out", hash)
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": ErrSecretOutdated.Error()})
-		defer func(hs string) {
-			if err := h.db.DeleteSecret(hs); err != nil {
-				log.Printf("secret '%s' deletion error: %v", hs, err)
-			}
-		}(hash)
+	var expFormatted *strfmt.DateTime
+	if s.ExpiresAt != nil {
+		exp := strfmt.DateTime(*s.ExpiresAt)
+		expFormatted = &exp
+	}
+
+	res := models.SecretMeta{
+		CreatedAt:          strfmt.DateTime(s.CreatedAt),
+		ExpiresAt:          expFormatted,
+		RemainingViews:     s.RemainingViews,
+		Readable:           isReadable(&s.SecretBase, h.nowFunc()),
+		PassphraseRequired: s.PassphraseCheck != "",
+		File:               isFile(&s.SecretBase),
+		Size:               s.FileSize,
+	}
+
+	getResponseFunc(c)(&res)
+}
+
+// HeadSecret is a cheap probe of a secret that doesn't consume a view.
+//
+// It responds with 200 if the secret can be read, 410 if it is outdated and 404 if it doesn't exist.
+func (h *SecretHandler) HeadSecret(c *gin.Context) {
+	h, token, ok := h.forTenant(c, c.Param("hash"))
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
-	// view counter check
-	if s.RemainingViews > 0 {
-		s.RemainingViews--
-		if err := h.db.UpdateSecret(hash, *s); err != nil {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
-			return
-		}
-	} else {
-		log.Printf("secret %s expire counter is out", hash)
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": ErrSecretOutdated.Error()})
-		defer func(hs string) {
-			if err := h.db.DeleteSecret(hs); err != nil {
-				log.Printf("secret '%s' deletion error: %v", hs, err)
-			}
-		}(hash)
+	_, _, s, apiErr := h.findSecret(token)
+	if apiErr != nil {
+		c.AbortWithStatus(apiErr.Status)
 		return
 	}
 
-	// decrypt secret
-	encSecret, err := decryptSecret(hash, s.SecretText)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	if !isReadable(&s.SecretBase, h.nowFunc()) {
+		c.AbortWithStatus(http.StatusGone)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// DeleteSecret revokes a secret.
+//
+// The secret can be addressed by its token or lookup id, and the request must contain the management token returned on creation.
+func (h *SecretHandler) DeleteSecret(c *gin.Context) {
+	h, token, ok := h.forTenant(c, c.Param("hash"))
+	if !ok {
+		abortWithError(c, newNotFoundError())
+		return
+	}
+
+	hash, s, apiErr := h.findManagedSecret(c, token, false)
+	if apiErr != nil {
+		abortWithError(c, apiErr)
 		return
 	}
 
+	if err := h.db.DeleteSecret(hash); err != nil {
+		abortWithError(c, newDatabaseError(err))
+		return
+	}
+
+	logging.Info("secret was revoked", logging.Hash("secret", hash))
+	h.deleteChunks(hash, &s.SecretBase)
+	h.keepTombstone(hash, &s.SecretBase, models.StateRevoked)
+	h.notify(c, hash, &s.SecretBase, webhook.EventRevoked)
+	c.Status(http.StatusNoContent)
+}
+
+// GetSecretStatus returns a state of a secret to its creator.
+//
+// Unlike GetSecretMeta it requires the management token instead of the decryption key, and also returns the number of views.
+// Read, burned and revoked secrets are reported by their tombstones until the original expiration time.
+// Expired secrets are removed from the database, so they aren't found.
+func (h *SecretHandler) GetSecretStatus(c *gin.Context) {
+	h, token, ok := h.forTenant(c, c.Param("hash"))
+	if !ok {
+		abortWithError(c, newNotFoundError())
+		return
+	}
+
+	_, s, apiErr := h.findManagedSecret(c, token, true)
+	if apiErr != nil {
+		abortWithError(c, apiErr)
+		return
+	}
+	now := h.nowFunc()
+
 	var expFormatted *strfmt.DateTime
 	if s.ExpiresAt != nil {
 		exp := strfmt.DateTime(*s.ExpiresAt)
 		expFormatted = &exp
 	}
 
-	// prepare response structure
-	res := models.SecretResponse{
+	res := models.SecretStatus{
 		CreatedAt:      strfmt.DateTime(s.CreatedAt),
 		ExpiresAt:      expFormatted,
-		Hash:           hash,
 		RemainingViews: s.RemainingViews,
-		SecretText:     encSecret,
+		Views:          s.MaxViews - s.RemainingViews,
+		Readable:       s.State == "" && isReadable(&s.SecretBase, now),
+		State:          s.State,
+	}
+	if res.State == "" {
+		res.State = models.StateActive
+		if !res.Readable {
+			res.State = models.StateExpired
+		}
 	}
 
 	getResponseFunc(c)(&res)
@@ -110,43 +395,76 @@ func (h *SecretHandler) GetSecret(c *gin.Context) {
 // PostSecret creates a new secret.
 //
 // The method verifies incoming data and creates a new encrypted secret in the database.
+// The secret is stored under a public lookup id, the encryption key is never stored, only its hash.
+// Parameters are read from a form, JSON or XML body depending on the request content type.
+// Secrets of an authenticated tenant are stored in its namespace, and their tokens are prefixed with the tenant name.
 func (h *SecretHandler) PostSecret(c *gin.Context) {
-	// read and parse parameters
-	secret := c.PostForm("secret")
-	expireCounterStr := c.PostForm("expireAfterViews")
-	expireTimeoutStr := c.PostForm("expireAfter")
+	name := tenant.FromContext(c)
+	h, ok := h.namespace(name)
+	if !ok {
+		abortWithError(c, newInternalError(ErrNoTenants))
+		return
+	}
 
-	expireCounter, err := strconv.Atoi(expireCounterStr)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": err.Error()})
+	// read and parse parameters
+	req, file, err := h.readSecretRequest(c)
+	if err == ErrBodyTooLarge {
+		limit := int64(h.policy.MaxBytes)
+		if limit == 0 {
+			limit = maxBodyBytes
+		}
+		abortWithError(c, newTooLargeError(limit))
+		return
+	} else if err != nil {
+		abortWithError(c, newRequestError(models.ErrorDetail{Message: err.Error()}))
 		return
 	}
+	secret := req.Secret
 
-	expireTimeout, err := strconv.Atoi(expireTimeoutStr)
+	expireCounter, err := strconv.Atoi(req.ExpireAfterViews.String())
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": err.Error()})
+		abortWithError(c, newRequestError(models.ErrorDetail{Field: "expireAfterViews", Message: "must be an integer"}))
 		return
 	}
 
+	// secrets without expiration time live for the default TTL
+	ttl := h.policy.DefaultTTL
+	if req.ExpireAfter != "" {
+		expireTimeout, err := strconv.Atoi(req.ExpireAfter.String())
+		if err != nil {
+			abortWithError(c, newRequestError(models.ErrorDetail{Field: "expireAfter", Message: "must be an integer"}))
+			return
+		}
+		ttl = time.Minute * time.Duration(expireTimeout)
+	}
+
 	// validity checks
-	if expireCounter <= 0 {
-		c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": fmt.Sprintf("wrong expireAfterViews value %d", expireCounter)})
+	var contentType string
+	if file != nil {
+		contentType = fileContentType(file)
+	}
+	if details := h.policy.check(secret, expireCounter, ttl, contentType); len(details) > 0 {
+		abortWithError(c, newValidationError(details...))
 		return
 	}
 
+	if req.NotifyURL != "" {
+		if detail, ok := h.checkNotifyURL(req.NotifyURL); !ok {
+			abortWithError(c, newValidationError(detail))
+			return
+		}
+	}
+
 	var expTime *time.Time
-	if expireTimeout > 0 {
-		exp := h.nowFunc().Add(time.Minute * time.Duration(expireTimeout))
+	if ttl > 0 {
+		exp := h.nowFunc().Add(ttl)
 		expTime = &exp
 	}
 
 	// encrypt secret
-	key := h.keygen()
-	encSecret, err := encryptSecret(key, secret)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": err.Error()})
-		return
-	}
+	id, key := h.idgen(), h.keygen()
+	token := tenant.JoinToken(name, makeToken(id, key))
+	manageToken := h.mgmtgen()
 
 	// fill db model data
 	s := models.Secret{
@@ -154,13 +472,42 @@ func (h *SecretHandler) PostSecret(c *gin.Context) {
 			CreatedAt:      h.nowFunc(),
 			ExpiresAt:      expTime,
 			RemainingViews: int32(expireCounter),
-			SecretText:     encSecret,
+			MaxViews:       int32(expireCounter),
+			KeyHash:        hashKey(key),
+			ManageHash:     hashKey(manageToken),
+			NotifyURL:      req.NotifyURL,
 		},
 	}
+	content := secret
+	if file != nil {
+		// file content is stored in chunks, the secret itself keeps the file key
+		content = generateRandomHex(dataKeyLength / 2)
+		if err := h.storeFile(id, &s.SecretBase, content, file); err != nil {
+			h.deleteChunks(id, &s.SecretBase)
+			if err == ErrFileTooLarge {
+				abortWithError(c, newTooLargeError(h.maxFileBytes))
+				return
+			}
+			abortWithError(c, newDatabaseError(err))
+			return
+		}
+	}
+	if req.Passphrase != "" {
+		content, err = encryptPassphrase(&s.SecretBase, req.Passphrase, content)
+		if err != nil {
+			abortWithError(c, newInternalError(err))
+			return
+		}
+	}
+	if err := h.encryptContent(&s.SecretBase, key, content); err != nil {
+		abortWithError(c, newInternalError(err))
+		return
+	}
 
 	// save to database
-	if err := h.db.CreateSecret(key, s); err != nil {
-		c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{"error": err.Error()})
+	if err := h.db.CreateSecret(id, s); err != nil {
+		h.deleteChunks(id, &s.SecretBase)
+		abortWithError(c, newDatabaseError(err))
 		return
 	}
 
@@ -175,16 +522,245 @@ func (h *SecretHandler) PostSecret(c *gin.Context) {
 	res := models.SecretResponse{
 		CreatedAt:      strfmt.DateTime(s.CreatedAt),
 		ExpiresAt:      expFormatted,
-		Hash:           key,
+		Hash:           token,
+		ManageToken:    manageToken,
 		RemainingViews: s.RemainingViews,
 		SecretText:     secret,
 	}
+	if file != nil {
+		res.ContentType = s.ContentType
+		res.FileName = fileName(file)
+		res.Size = s.FileSize
+	}
 
-	log.Printf("key %s was issued for IP %s", key, c.Request.Host)
+	logging.Info("secret was issued", logging.Hash("secret", id), logging.String("ip", clientip.FromContext(c)))
+	h.record(c, audit.ActionCreated, id)
 
 	getResponseFunc(c)(&res)
 }
 
+// checkNotifyURL validates a notification URL of a new secret
+func (h *SecretHandler) checkNotifyURL(notifyURL string) (models.ErrorDetail, bool) {
+	if h.notifier == nil {
+		return models.ErrorDetail{Field: "notifyUrl", Message: "webhooks are disabled"}, false
+	}
+	u, err := url.Parse(notifyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return models.ErrorDetail{Field: "notifyUrl", Message: "must be an absolute http or https URL"}, false
+	}
+	return models.ErrorDetail{}, true
+}
+
+// notify records a lifecycle event of the secret to the audit trail,
+// and sends it to the webhook if the secret has a notification URL
+func (h *SecretHandler) notify(c *gin.Context, hash string, s *models.SecretBase, event webhook.EventType) {
+	id := eventID(h.fingerprintKey, hash, s)
+	h.record(c, audit.Action(event), id)
+	if h.notifier == nil || s.NotifyURL == "" {
+		return
+	}
+	h.notifier.Notify(s.NotifyURL, webhook.Event{
+		Type:           event,
+		SecretID:       id,
+		Time:           h.nowFunc(),
+		RemainingViews: s.RemainingViews,
+	})
+}
+
+// eventID returns the id of the secret in lifecycle events.
+//
+// Legacy secrets are stored under their token, which is also the key, so they are identified by a fingerprint.
+func eventID(key []byte, hash string, s *models.SecretBase) string {
+	if s.KeyHash == "" {
+		return audit.Fingerprint(key, hash)
+	}
+	return hash
+}
+
+// record adds a lifecycle event of the secret to the audit trail.
+// id is the lookup id of a secret or the fingerprint of a legacy one
+func (h *SecretHandler) record(c *gin.Context, action audit.Action, id string) {
+	if h.auditor == nil {
+		return
+	}
+
+	var actor string
+	if key := tenant.KeyFromContext(c); key != "" {
+		actor = "api-key:" + key
+	} else if subject, ok := certs.ClientSubject(c); ok {
+		actor = "cert:" + subject
+	}
+	h.auditor.Record(audit.Event{
+		Time:     h.nowFunc(),
+		Action:   action,
+		SecretID: id,
+		Tenant:   h.tenant,
+		Actor:    actor,
+		IP:       clientip.FromContext(c),
+	})
+}
+
+// forTenant returns a handler working in the tenant namespace of the token and the token without the tenant name.
+//
+// A client authenticated with an API key can only access secrets of its own tenant.
+// Returns false if the namespace can't be accessed.
+func (h *SecretHandler) forTenant(c *gin.Context, token string) (*SecretHandler, string, bool) {
+	name, token := tenant.SplitToken(token)
+	if auth := tenant.FromContext(c); auth != "" && auth != name {
+		return nil, "", false
+	}
+	th, ok := h.namespace(name)
+	return th, token, ok
+}
+
+// namespace returns a handler working in the tenant namespace, an empty name is the default namespace.
+//
+// Returns false if tenant namespaces aren't configured.
+func (h *SecretHandler) namespace(name string) (*SecretHandler, bool) {
+	if name == "" {
+		return h, true
+	}
+	if h.tenants == nil {
+		return nil, false
+	}
+
+	th := *h
+	th.db = h.tenants(name)
+	th.tenant = name
+	return &th, true
+}
+
+// findSecret splits the token into lookup id and key, gets the secret by id and checks the key.
+//
+// Key check must be done before any state change or disclosure of the secret state.
+func (h *SecretHandler) findSecret(token string) (hash, key string, s *models.Secret, apiErr *APIError) {
+	hash, key, err := splitToken(token)
+	if err != nil {
+		return "", "", nil, newNotFoundError()
+	}
+
+	s, err = h.db.GetSecret(hash)
+	if err != nil {
+		return "", "", nil, newDatabaseError(err)
+	}
+
+	if err := checkKey(key, s.KeyHash); err != nil {
+		return "", "", nil, newNotFoundError()
+	}
+	return hash, key, s, nil
+}
+
+// findManagedSecret gets the secret by token or lookup id and checks the management token.
+//
+// If tombstone is set, the tombstone of a deleted secret is returned until its expiration time.
+func (h *SecretHandler) findManagedSecret(c *gin.Context, token string, tombstone bool) (hash string, s *models.Secret, apiErr *APIError) {
+	hash, err := lookupID(token)
+	if err != nil {
+		return "", nil, newNotFoundError()
+	}
+
+	manageToken := c.GetHeader(manageTokenHeader)
+	if manageToken == "" {
+		manageToken = c.PostForm("manageToken")
+	}
+	if manageToken == "" {
+		return "", nil, newManageTokenError(true)
+	}
+
+	s, err = h.db.GetSecret(hash)
+	if err == database.ErrNotFound && tombstone {
+		s, err = h.db.GetSecret(models.TombstoneID(hash))
+		if err == nil && models.TombstoneOutdated(&s.SecretBase, h.nowFunc()) {
+			err = database.ErrNotFound
+		}
+	}
+	if err != nil {
+		return "", nil, newDatabaseError(err)
+	}
+
+	if err := checkManageToken(manageToken, s.ManageHash); err != nil {
+		return "", nil, newManageTokenError(false)
+	}
+	return hash, s, nil
+}
+
+// keepTombstone stores a tombstone of a deleted secret, so its creator can still check the status.
+//
+// The tombstone has no content or keys and lives until the original expiration time of the secret,
+// or for models.TombstoneRetention if the secret never expires.
+// Legacy secrets have no management token and no status, so they get no tombstone.
+func (h *SecretHandler) keepTombstone(hash string, s *models.SecretBase, state string) {
+	now := h.nowFunc()
+	if s.ManageHash == "" || s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
+		return
+	}
+
+	t := models.Secret{
+		SecretBase: models.SecretBase{
+			CreatedAt:      s.CreatedAt,
+			ExpiresAt:      s.ExpiresAt,
+			RemainingViews: s.RemainingViews,
+			ManageHash:     s.ManageHash,
+			MaxViews:       s.MaxViews,
+			State:          state,
+			DeletedAt:      &now,
+		},
+	}
+	if err := h.db.CreateSecret(models.TombstoneID(hash), t); err != nil {
+		logging.Warn("tombstone of the secret can't be stored", logging.Hash("secret", hash), logging.Err(err))
+	}
+}
+
+// isReadable checks if the secret is neither expired nor exhausted
+func isReadable(s *models.SecretBase, now time.Time) bool {
+	if s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
+		return false
+	}
+	return s.RemainingViews > 0
+}
+
+// abortWithWrongPassphrase counts a failed passphrase attempt and deletes the secret when no attempts are left.
+//
+// The counter is updated optimistically, so concurrent guesses can't skip the count.
+func (h *SecretHandler) abortWithWrongPassphrase(c *gin.Context, hash string, s *models.Secret) {
+	for {
+		s.FailedAttempts++
+		if int(s.FailedAttempts) >= h.passphraseAttempts {
+			err := h.db.DeleteSecret(hash)
+			if err != nil && err != database.ErrNotFound {
+				abortWithError(c, newDatabaseError(err))
+				return
+			}
+			logging.Info("secret was deleted after wrong passphrase attempts", logging.Hash("secret", hash), logging.Any("attempts", s.FailedAttempts))
+			h.deleteChunks(hash, &s.SecretBase)
+			h.keepTombstone(hash, &s.SecretBase, models.StateBurned)
+			h.notify(c, hash, &s.SecretBase, webhook.EventBurned)
+			abortWithError(c, newOutdatedError())
+			return
+		}
+
+		err := h.db.UpdateSecret(hash, *s)
+		switch err {
+		case nil:
+			abortWithError(c, newWrongPassphraseError(h.passphraseAttempts-int(s.FailedAttempts)))
+			return
+		case database.ErrSecretModified:
+			// somebody else has changed the secret, count the attempt on the actual version
+			s, err = h.db.GetSecret(hash)
+			if err != nil {
+				abortWithError(c, newDatabaseError(err))
+				return
+			}
+		case database.ErrNotFound:
+			abortWithError(c, newOutdatedError())
+			return
+		default:
+			abortWithError(c, newDatabaseError(err))
+			return
+		}
+	}
+}
+
 // RedirectTo redirects to provided url
 func RedirectTo(url string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -193,25 +769,72 @@ func RedirectTo(url string) gin.HandlerFunc {
 	}
 }
 
+// readSecretRequest reads secret creation parameters for the request MIME type.
+//
+// For multipart requests the file part is returned unread, so it can be streamed to the database.
+// JSON and XML bodies are limited by bodyLimit, larger bodies fail with ErrBodyTooLarge.
+func (h *SecretHandler) readSecretRequest(c *gin.Context) (*models.SecretRequest, *multipart.Part, error) {
+	var req models.SecretRequest
+
+	switch c.ContentType() {
+	case "application/json":
+		body := &limitedBody{ReadCloser: c.Request.Body, n: h.bodyLimit(), err: ErrBodyTooLarge}
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, nil, err
+		}
+		req.ResolveAliases()
+	case "application/xml", "text/xml":
+		body := &limitedBody{ReadCloser: c.Request.Body, n: h.bodyLimit(), err: ErrBodyTooLarge}
+		if err := xml.NewDecoder(body).Decode(&req); err != nil {
+			return nil, nil, err
+		}
+		req.ResolveAliases()
+	case "multipart/form-data":
+		return h.readMultipartRequest(c)
+	default:
+		req.Secret = c.PostForm("secret")
+		req.ExpireAfterViews = models.RawValue(c.PostForm("expireAfterViews"))
+		req.ExpireAfter = models.RawValue(c.PostForm("expireAfter"))
+		req.Passphrase = c.PostForm("passphrase")
+		req.NotifyURL = c.PostForm("notifyUrl")
+	}
+	return &req, nil, nil
+}
+
+// bodyLimit returns a size limit of JSON and XML request bodies.
+//
+// An escaped byte of the secret takes up to 6 bytes of the body, other fields take up to maxFormValueBytes each.
+func (h *SecretHandler) bodyLimit() int64 {
+	if h.policy.MaxBytes == 0 {
+		return maxBodyBytes
+	}
+	return int64(h.policy.MaxBytes)*6 + maxFormValueBytes*4
+}
+
 // getResponseFunc returns data marshalling function for accepted MIME type
 func getResponseFunc(c *gin.Context) func(interface{}) {
+	return getStatusResponseFunc(c, http.StatusOK)
+}
+
+// getStatusResponseFunc returns data marshalling function for accepted MIME type with HTTP status
+func getStatusResponseFunc(c *gin.Context, status int) func(interface{}) {
 	mimeTypes := strings.Split(strings.Replace(c.GetHeader("Accept"), " ", "", -1), ",")
 	for _, mime := range mimeTypes {
 		switch mime {
 		case "application/json":
 			return func(v interface{}) {
-				c.JSON(http.StatusOK, v)
+				c.JSON(status, v)
 			}
 		case "application/xml":
 			return func(v interface{}) {
-				c.XML(http.StatusOK, v)
+				c.XML(status, v)
 			}
 		}
 		// add more types if needed here
 	}
 	// default json
 	return func(v interface{}) {
-		c.JSON(http.StatusOK, v)
+		c.JSON(status, v)
 	}
 }
 
@@ -221,4 +844,21 @@ type Database interface {
 	CreateSecret(hash string, s models.Secret) error
 	DeleteSecret(hash string) error
 	UpdateSecret(hash string, s models.Secret) error
+	ConsumeSecret(hash string, now time.Time) (*models.Secret, error)
+}
+
+// Notifier delivers secret lifecycle events
+type Notifier interface {
+	Notify(url string, e webhook.Event)
+}
+
+// Auditor keeps the audit trail of secret lifecycle events
+type Auditor interface {
+	Record(e audit.Event)
+}
+
+// KeyWrapper wraps data keys with server-side key-encryption keys
+type KeyWrapper interface {
+	Wrap(dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
 }
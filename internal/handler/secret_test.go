@@ -1,16 +1,26 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/audit"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/keyring"
+	"github.com/ilyakaznacheev/secret/internal/logging"
 	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+	"github.com/ilyakaznacheev/secret/internal/webhook"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testError struct {
@@ -22,17 +32,19 @@ func (e testError) Error() string {
 }
 
 type testDB struct {
-	secret                  *models.Secret
-	hash                    string
-	newSecret               models.Secret
-	errGetSecret            error
-	errCreateSecret         error
-	errDeleteSecret         error
-	errUpdateSecret         error
-	callCounterGetSecret    int
-	callCounterCreateSecret int
-	callCounterDeleteSecret int
-	callCounterUpdateSecret int
+	secret                   *models.Secret
+	hash                     string
+	newSecret                models.Secret
+	errGetSecret             error
+	errCreateSecret          error
+	errDeleteSecret          error
+	errUpdateSecret          error
+	errConsumeSecret         error
+	callCounterGetSecret     int
+	callCounterCreateSecret  int
+	callCounterDeleteSecret  int
+	callCounterUpdateSecret  int
+	callCounterConsumeSecret int
 }
 
 func (db *testDB) GetSecret(hash string) (*models.Secret, error) {
@@ -60,6 +72,24 @@ func (db *testDB) UpdateSecret(hash string, s models.Secret) error {
 	return db.errUpdateSecret
 }
 
+func (db *testDB) ConsumeSecret(hash string, now time.Time) (*models.Secret, error) {
+	db.callCounterConsumeSecret++
+	db.hash = hash
+	if db.errConsumeSecret != nil {
+		return nil, db.errConsumeSecret
+	}
+	if db.secret == nil {
+		return nil, database.ErrNotFound
+	}
+
+	s := *db.secret
+	if s.ExpiresAt != nil && now.After(*s.ExpiresAt) || s.RemainingViews <= 0 {
+		return nil, database.ErrSecretOutdated
+	}
+	s.RemainingViews--
+	return &s, nil
+}
+
 func TestSecretHandler_GetSecret(t *testing.T) {
 	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
 	future, _ := time.Parse(time.RFC3339, "2020-03-01T10:10:10Z")
@@ -73,15 +103,16 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 	errTest := &testError{"test error"}
 
 	tests := []struct {
-		name                    string
-		secretID                string
-		respCode                int
-		respBody                string
-		headers                 map[string]string
-		db                      *testDB
-		callCounterGetSecret    int
-		callCounterDeleteSecret int
-		callCounterUpdateSecret int
+		name                     string
+		secretID                 string
+		dbHash                   string
+		respCode                 int
+		respBody                 string
+		headers                  map[string]string
+		db                       *testDB
+		callCounterGetSecret     int
+		callCounterDeleteSecret  int
+		callCounterConsumeSecret int
 	}{
 		{
 			name:     "simple",
@@ -99,30 +130,30 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 				},
 				hash: "5621caf61d79545957a49c7d",
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 0,
-			callCounterUpdateSecret: 1,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
 		},
 
 		{
 			name:     "no data",
-			secretID: "12345",
+			secretID: "000000000000000000000000",
 			respCode: 404,
-			respBody: `{"error":"test error"}`,
+			respBody: `{"code":"not_found","message":"secret not found"}`,
 			db: &testDB{
 				secret:       nil,
-				errGetSecret: errTest,
+				errGetSecret: database.ErrNotFound,
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 0,
-			callCounterUpdateSecret: 0,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 0,
 		},
 
 		{
-			name:     "update error",
+			name:     "consume error",
 			secretID: "5621caf61d79545957a49c7d",
-			respCode: 404,
-			respBody: `{"error":"test error"}`,
+			respCode: 503,
+			respBody: `{"code":"storage_unavailable","message":"secret storage is unavailable"}`,
 			db: &testDB{
 				secret: &models.Secret{
 					SecretBase: models.SecretBase{
@@ -132,19 +163,19 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 						SecretText:     encTestSecret("5621caf61d79545957a49c7d"),
 					},
 				},
-				hash:            "5621caf61d79545957a49c7d",
-				errUpdateSecret: errTest,
+				hash:             "5621caf61d79545957a49c7d",
+				errConsumeSecret: errTest,
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 0,
-			callCounterUpdateSecret: 1,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
 		},
 
 		{
 			name:     "expiration error",
 			secretID: "5621caf61d79545957a49c7d",
-			respCode: 404,
-			respBody: `{"error":"secret isn't valid anymore"}`,
+			respCode: 410,
+			respBody: `{"code":"secret_outdated","message":"secret isn't valid anymore"}`,
 			db: &testDB{
 				secret: &models.Secret{
 					SecretBase: models.SecretBase{
@@ -156,16 +187,16 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 				},
 				hash: "5621caf61d79545957a49c7d",
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 1,
-			callCounterUpdateSecret: 0,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
 		},
 
 		{
 			name:     "counter error",
 			secretID: "5621caf61d79545957a49c7d",
-			respCode: 404,
-			respBody: `{"error":"secret isn't valid anymore"}`,
+			respCode: 410,
+			respBody: `{"code":"secret_outdated","message":"secret isn't valid anymore"}`,
 			db: &testDB{
 				secret: &models.Secret{
 					SecretBase: models.SecretBase{
@@ -177,9 +208,154 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 				},
 				hash: "5621caf61d79545957a49c7d",
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 1,
-			callCounterUpdateSecret: 0,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
+		},
+
+		{
+			name:     "storage failure",
+			secretID: "000000000000000000000000",
+			respCode: 503,
+			respBody: `{"code":"storage_unavailable","message":"secret storage is unavailable"}`,
+			db: &testDB{
+				secret:       nil,
+				errGetSecret: errTest,
+			},
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 0,
+		},
+
+		{
+			name:     "concurrent conflict",
+			secretID: "5621caf61d79545957a49c7d",
+			respCode: 409,
+			respBody: `{"code":"conflict","message":"secret was modified concurrently, try again"}`,
+			db: &testDB{
+				secret: &models.Secret{
+					SecretBase: models.SecretBase{
+						CreatedAt:      now,
+						ExpiresAt:      &future,
+						RemainingViews: 100,
+						SecretText:     encTestSecret("5621caf61d79545957a49c7d"),
+					},
+				},
+				errConsumeSecret: database.ErrSecretModified,
+			},
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
+		},
+
+		{
+			name:     "burned concurrently",
+			secretID: "5621caf61d79545957a49c7d",
+			respCode: 410,
+			respBody: `{"code":"secret_outdated","message":"secret isn't valid anymore"}`,
+			db: &testDB{
+				secret: &models.Secret{
+					SecretBase: models.SecretBase{
+						CreatedAt:      now,
+						ExpiresAt:      &future,
+						RemainingViews: 1,
+						SecretText:     encTestSecret("5621caf61d79545957a49c7d"),
+					},
+				},
+				errConsumeSecret: database.ErrNotFound,
+			},
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
+		},
+
+		{
+			name:     "decryption error",
+			secretID: "5621caf61d79545957a49c7d",
+			respCode: 500,
+			respBody: `{"code":"decryption_failed","message":"secret can't be decrypted"}`,
+			db: &testDB{
+				secret: &models.Secret{
+					SecretBase: models.SecretBase{
+						CreatedAt:      now,
+						ExpiresAt:      &future,
+						RemainingViews: 100,
+						SecretText:     encTestSecret("000000000000000000000000"),
+					},
+				},
+			},
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
+		},
+
+		{
+			name:     "xml error",
+			secretID: "12345",
+			respCode: 404,
+			respBody: `<Error><code>not_found</code><message>secret not found</message></Error>`,
+			headers: map[string]string{
+				"Accept": "application/xml",
+			},
+			db:                       &testDB{},
+			callCounterGetSecret:     0,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 0,
+		},
+
+		{
+			name:     "split token",
+			secretID: "0123456789abcdef5621caf61d79545957a49c7d",
+			dbHash:   "0123456789abcdef",
+			respCode: 200,
+			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-03-01T10:10:10.000Z","hash":"0123456789abcdef5621caf61d79545957a49c7d","remainingViews":99,"secretText":"test_secret"}`,
+			db: &testDB{
+				secret: &models.Secret{
+					SecretBase: models.SecretBase{
+						CreatedAt:      now,
+						ExpiresAt:      &future,
+						RemainingViews: 100,
+						SecretText:     encTestSecret("5621caf61d79545957a49c7d"),
+						KeyHash:        hashKey("5621caf61d79545957a49c7d"),
+					},
+				},
+			},
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
+		},
+
+		{
+			name:     "wrong key",
+			secretID: "0123456789abcdefaaaaaaaaaaaaaaaaaaaaaaaa",
+			dbHash:   "0123456789abcdef",
+			respCode: 404,
+			respBody: `{"code":"not_found","message":"secret not found"}`,
+			db: &testDB{
+				secret: &models.Secret{
+					SecretBase: models.SecretBase{
+						CreatedAt:      now,
+						ExpiresAt:      &future,
+						RemainingViews: 100,
+						SecretText:     encTestSecret("5621caf61d79545957a49c7d"),
+						KeyHash:        hashKey("5621caf61d79545957a49c7d"),
+					},
+				},
+			},
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 0,
+		},
+
+		{
+			name:                     "invalid token",
+			secretID:                 "12345",
+			respCode:                 404,
+			respBody:                 `{"code":"not_found","message":"secret not found"}`,
+			db:                       &testDB{},
+			callCounterGetSecret:     0,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 0,
 		},
 
 		{
@@ -201,9 +377,9 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 				},
 				hash: "5621caf61d79545957a49c7d",
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 0,
-			callCounterUpdateSecret: 1,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
 		},
 
 		{
@@ -225,9 +401,9 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 				},
 				hash: "5621caf61d79545957a49c7d",
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 0,
-			callCounterUpdateSecret: 1,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
 		},
 
 		{
@@ -249,9 +425,9 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 				},
 				hash: "5621caf61d79545957a49c7d",
 			},
-			callCounterGetSecret:    1,
-			callCounterDeleteSecret: 0,
-			callCounterUpdateSecret: 1,
+			callCounterGetSecret:     1,
+			callCounterDeleteSecret:  0,
+			callCounterConsumeSecret: 1,
 		},
 	}
 
@@ -278,10 +454,14 @@ func TestSecretHandler_GetSecret(t *testing.T) {
 			assert.Equal(t, tt.respCode, w.Code)
 			assert.Equal(t, tt.respBody, w.Body.String())
 
-			assert.Equal(t, tt.secretID, tt.db.hash)
+			dbHash := tt.dbHash
+			if dbHash == "" && tt.callCounterGetSecret > 0 {
+				dbHash = tt.secretID
+			}
+			assert.Equal(t, dbHash, tt.db.hash)
 			assert.Equal(t, tt.callCounterGetSecret, tt.db.callCounterGetSecret)
 			assert.Equal(t, tt.callCounterDeleteSecret, tt.db.callCounterDeleteSecret)
-			assert.Equal(t, tt.callCounterUpdateSecret, tt.db.callCounterUpdateSecret)
+			assert.Equal(t, tt.callCounterConsumeSecret, tt.db.callCounterConsumeSecret)
 		})
 	}
 }
@@ -298,6 +478,8 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 	errTest := &testError{"test error"}
 
 	testKey := "5621caf61d79545957a49c7d"
+	testID := "0123456789abcdef"
+	testManageToken := "00112233445566778899aabbccddeeff"
 
 	tests := []struct {
 		name                    string
@@ -305,6 +487,8 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 		respBody                string
 		headers                 map[string]string
 		postFields              map[string]string
+		body                    string
+		policy                  Policy
 		db                      *testDB
 		secret                  models.Secret
 		callCounterCreateSecret int
@@ -312,7 +496,7 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 		{
 			name:     "normal creation",
 			respCode: 200,
-			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-02-01T10:20:10.000Z","hash":"5621caf61d79545957a49c7d","remainingViews":10,"secretText":"test_secret"}`,
+			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-02-01T10:20:10.000Z","hash":"0123456789abcdef5621caf61d79545957a49c7d","manageToken":"00112233445566778899aabbccddeeff","remainingViews":10,"secretText":"test_secret"}`,
 			postFields: map[string]string{
 				"secret":           "test_secret",
 				"expireAfterViews": "10",
@@ -325,6 +509,7 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 					ExpiresAt:      &future,
 					RemainingViews: 10,
 					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
 				},
 			},
 			callCounterCreateSecret: 1,
@@ -332,8 +517,8 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 
 		{
 			name:     "bad view counter",
-			respCode: 405,
-			respBody: `{"error":"strconv.Atoi: parsing \"abc\": invalid syntax"}`,
+			respCode: 400,
+			respBody: `{"code":"invalid_request","message":"invalid request parameters","details":[{"field":"expireAfterViews","message":"must be an integer"}]}`,
 			postFields: map[string]string{
 				"secret":           "test_secret",
 				"expireAfterViews": "abc",
@@ -345,8 +530,8 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 
 		{
 			name:     "bad expiration time",
-			respCode: 405,
-			respBody: `{"error":"strconv.Atoi: parsing \"abc\": invalid syntax"}`,
+			respCode: 400,
+			respBody: `{"code":"invalid_request","message":"invalid request parameters","details":[{"field":"expireAfter","message":"must be an integer"}]}`,
 			postFields: map[string]string{
 				"secret":           "test_secret",
 				"expireAfterViews": "10",
@@ -358,8 +543,8 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 
 		{
 			name:     "zero view counter",
-			respCode: 405,
-			respBody: `{"error":"wrong expireAfterViews value 0"}`,
+			respCode: 422,
+			respBody: `{"code":"validation_failed","message":"request validation failed","details":[{"field":"expireAfterViews","message":"must be greater than 0, got 0"}]}`,
 			postFields: map[string]string{
 				"secret":           "test_secret",
 				"expireAfterViews": "0",
@@ -369,10 +554,99 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 			callCounterCreateSecret: 0,
 		},
 
+		{
+			name:     "policy violations",
+			respCode: 422,
+			respBody: `{"code":"validation_failed","message":"request validation failed","details":[{"field":"secret","message":"must be at most 5 bytes, got 11"},{"field":"expireAfterViews","message":"must be at most 5, got 10"},{"field":"expireAfter","message":"must be at most 60 minutes, got 120"}]}`,
+			postFields: map[string]string{
+				"secret":           "test_secret",
+				"expireAfterViews": "10",
+				"expireAfter":      "120",
+			},
+			policy:                  Policy{MaxBytes: 5, MaxViews: 5, MaxTTL: time.Hour},
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "json body too large",
+			respCode: 413,
+			respBody: `{"code":"payload_too_large","message":"the secret exceeds the size limit of 5 bytes"}`,
+			headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			body:                    `{"secret":"` + strings.Repeat("a", 300<<10) + `","expireAfterViews":1}`,
+			policy:                  Policy{MaxBytes: 5},
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "xml body too large",
+			respCode: 413,
+			respBody: `{"code":"payload_too_large","message":"the secret exceeds the size limit of 5 bytes"}`,
+			headers: map[string]string{
+				"Content-Type": "application/xml",
+			},
+			body:                    `<Secret><secret>` + strings.Repeat("a", 300<<10) + `</secret><expireAfterViews>1</expireAfterViews></Secret>`,
+			policy:                  Policy{MaxBytes: 5},
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "never expire forbidden",
+			respCode: 422,
+			respBody: `{"code":"validation_failed","message":"request validation failed","details":[{"field":"expireAfter","message":"must be greater than 0, secrets that never expire are not allowed"}]}`,
+			postFields: map[string]string{
+				"secret":           "test_secret",
+				"expireAfterViews": "10",
+				"expireAfter":      "0",
+			},
+			policy:                  Policy{ForbidNeverExpire: true},
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "negative expiration time",
+			respCode: 422,
+			respBody: `{"code":"validation_failed","message":"request validation failed","details":[{"field":"expireAfter","message":"must not be negative, got -10"}]}`,
+			postFields: map[string]string{
+				"secret":           "test_secret",
+				"expireAfterViews": "10",
+				"expireAfter":      "-10",
+			},
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "default expiration time",
+			respCode: 200,
+			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-02-01T10:20:10.000Z","hash":"0123456789abcdef5621caf61d79545957a49c7d","manageToken":"00112233445566778899aabbccddeeff","remainingViews":10,"secretText":"test_secret"}`,
+			postFields: map[string]string{
+				"secret":           "test_secret",
+				"expireAfterViews": "10",
+			},
+			policy: Policy{DefaultTTL: 10 * time.Minute, MaxTTL: time.Hour},
+			db:     &testDB{},
+			secret: models.Secret{
+				SecretBase: models.SecretBase{
+					CreatedAt:      now,
+					ExpiresAt:      &future,
+					RemainingViews: 10,
+					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
+				},
+			},
+			callCounterCreateSecret: 1,
+		},
+
 		{
 			name:     "infinite expiration time",
 			respCode: 200,
-			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","hash":"5621caf61d79545957a49c7d","remainingViews":10,"secretText":"test_secret"}`,
+			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","hash":"0123456789abcdef5621caf61d79545957a49c7d","manageToken":"00112233445566778899aabbccddeeff","remainingViews":10,"secretText":"test_secret"}`,
 			postFields: map[string]string{
 				"secret":           "test_secret",
 				"expireAfterViews": "10",
@@ -385,15 +659,138 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 					ExpiresAt:      nil,
 					RemainingViews: 10,
 					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
+				},
+			},
+			callCounterCreateSecret: 1,
+		},
+
+		{
+			name:     "json creation",
+			respCode: 200,
+			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-02-01T10:20:10.000Z","hash":"0123456789abcdef5621caf61d79545957a49c7d","manageToken":"00112233445566778899aabbccddeeff","remainingViews":10,"secretText":"test_secret"}`,
+			headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			body: `{"secret":"test_secret","expireAfterViews":10,"expireAfter":"10"}`,
+			db:   &testDB{},
+			secret: models.Secret{
+				SecretBase: models.SecretBase{
+					CreatedAt:      now,
+					ExpiresAt:      &future,
+					RemainingViews: 10,
+					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
+				},
+			},
+			callCounterCreateSecret: 1,
+		},
+
+		{
+			name:     "json response field names",
+			respCode: 200,
+			respBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-02-01T10:20:10.000Z","hash":"0123456789abcdef5621caf61d79545957a49c7d","manageToken":"00112233445566778899aabbccddeeff","remainingViews":10,"secretText":"test_secret"}`,
+			headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			body: `{"secretText":"test_secret","remainingViews":10,"expireAfter":10}`,
+			db:   &testDB{},
+			secret: models.Secret{
+				SecretBase: models.SecretBase{
+					CreatedAt:      now,
+					ExpiresAt:      &future,
+					RemainingViews: 10,
+					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
 				},
 			},
 			callCounterCreateSecret: 1,
 		},
 
+		{
+			name:     "json bad view counter",
+			respCode: 400,
+			respBody: `{"code":"invalid_request","message":"invalid request parameters","details":[{"field":"expireAfterViews","message":"must be an integer"}]}`,
+			headers: map[string]string{
+				"Content-Type": "application/json; charset=utf-8",
+			},
+			body:                    `{"secret":"test_secret","expireAfterViews":"abc","expireAfter":10}`,
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "json malformed",
+			respCode: 400,
+			respBody: `{"code":"invalid_request","message":"invalid request parameters","details":[{"message":"unexpected EOF"}]}`,
+			headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			body:                    `{"secret":"test_secret"`,
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
+		{
+			name:     "xml creation",
+			respCode: 200,
+			respBody: `<Secret><createdAt>2020-02-01T10:10:10.000Z</createdAt><hash>0123456789abcdef5621caf61d79545957a49c7d</hash><manageToken>00112233445566778899aabbccddeeff</manageToken><remainingViews>10</remainingViews><secretText>test_secret</secretText></Secret>`,
+			headers: map[string]string{
+				"Content-Type": "application/xml",
+				"Accept":       "application/xml",
+			},
+			body: `<Secret><secret>test_secret</secret><expireAfterViews>10</expireAfterViews><expireAfter>0</expireAfter></Secret>`,
+			db:   &testDB{},
+			secret: models.Secret{
+				SecretBase: models.SecretBase{
+					CreatedAt:      now,
+					ExpiresAt:      nil,
+					RemainingViews: 10,
+					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
+				},
+			},
+			callCounterCreateSecret: 1,
+		},
+
+		{
+			name:     "xml response field names",
+			respCode: 200,
+			respBody: `<Secret><createdAt>2020-02-01T10:10:10.000Z</createdAt><hash>0123456789abcdef5621caf61d79545957a49c7d</hash><manageToken>00112233445566778899aabbccddeeff</manageToken><remainingViews>10</remainingViews><secretText>test_secret</secretText></Secret>`,
+			headers: map[string]string{
+				"Content-Type": "application/xml",
+				"Accept":       "application/xml",
+			},
+			body: `<Secret><secretText>test_secret</secretText><remainingViews>10</remainingViews><expireAfter>0</expireAfter></Secret>`,
+			db:   &testDB{},
+			secret: models.Secret{
+				SecretBase: models.SecretBase{
+					CreatedAt:      now,
+					ExpiresAt:      nil,
+					RemainingViews: 10,
+					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
+				},
+			},
+			callCounterCreateSecret: 1,
+		},
+
+		{
+			name:     "xml zero view counter",
+			respCode: 422,
+			respBody: `{"code":"validation_failed","message":"request validation failed","details":[{"field":"expireAfterViews","message":"must be greater than 0, got 0"}]}`,
+			headers: map[string]string{
+				"Content-Type": "text/xml",
+			},
+			body:                    `<Secret><secret>test_secret</secret><expireAfterViews>0</expireAfterViews><expireAfter>10</expireAfter></Secret>`,
+			db:                      &testDB{},
+			callCounterCreateSecret: 0,
+		},
+
 		{
 			name:     "creation error",
-			respCode: 405,
-			respBody: `{"error":"test error"}`,
+			respCode: 503,
+			respBody: `{"code":"storage_unavailable","message":"secret storage is unavailable"}`,
 			postFields: map[string]string{
 				"secret":           "test_secret",
 				"expireAfterViews": "10",
@@ -408,6 +805,7 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 					ExpiresAt:      &future,
 					RemainingViews: 10,
 					SecretText:     encTestSecret(testKey),
+					KeyHash:        hashKey(testKey),
 				},
 			},
 			callCounterCreateSecret: 1,
@@ -425,11 +823,14 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 				db:      tt.db,
 				nowFunc: func() time.Time { return now },
 				keygen:  func() string { return testKey },
+				idgen:   func() string { return testID },
+				mgmtgen: func() string { return testManageToken },
+				policy:  tt.policy,
 			}
 			router.POST("/secret", h.PostSecret)
 
 			w := httptest.NewRecorder()
-			req, _ := http.NewRequest("POST", "/secret", nil)
+			req, _ := http.NewRequest("POST", "/secret", strings.NewReader(tt.body))
 			for key, value := range tt.headers {
 				req.Header.Add(key, value)
 			}
@@ -445,8 +846,737 @@ func TestSecretHandler_PostSecret(t *testing.T) {
 			assert.Equal(t, tt.secret.CreatedAt, tt.db.newSecret.CreatedAt)
 			assert.Equal(t, tt.secret.ExpiresAt, tt.db.newSecret.ExpiresAt)
 			assert.Equal(t, tt.secret.RemainingViews, tt.db.newSecret.RemainingViews)
+			assert.Equal(t, tt.secret.KeyHash, tt.db.newSecret.KeyHash)
+			if tt.callCounterCreateSecret > 0 {
+				assert.Equal(t, testID, tt.db.hash)
+				assert.Equal(t, hashKey(testManageToken), tt.db.newSecret.ManageHash)
+				assert.Equal(t, tt.secret.RemainingViews, tt.db.newSecret.MaxViews)
+			}
 
 			assert.Equal(t, tt.callCounterCreateSecret, tt.db.callCounterCreateSecret)
 		})
 	}
 }
+
+func TestSecretHandler_Keyring(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+
+	kr, err := keyring.New("test", map[string][]byte{"test": []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := &testDB{}
+	h := NewSecretHandler(db, WithKeyring(kr))
+	h.nowFunc = func() time.Time { return now }
+
+	router := gin.New()
+	router.POST("/secret", h.PostSecret)
+	router.GET("/secret/:hash", h.GetSecret)
+
+	// create a secret
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/secret", nil)
+	req.PostForm = url.Values{
+		"secret":           {"test_secret"},
+		"expireAfterViews": {"10"},
+		"expireAfter":      {"0"},
+	}
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var res models.SecretResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+
+	// data key is wrapped and the payload isn't encrypted with the token key
+	assert.Equal(t, "test", db.newSecret.KeyID)
+	assert.NotEmpty(t, db.newSecret.DataKey)
+	_, key, _ := splitToken(res.Hash)
+	_, err = decryptSecret(key, db.newSecret.SecretText)
+	assert.Error(t, err)
+
+	// read it back
+	db.secret = &db.newSecret
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/secret/"+res.Hash, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"secretText":"test_secret"`)
+
+	// secret can't be read without the keyring
+	h.keyring = nil
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/secret/"+res.Hash, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 500, w.Code)
+}
+
+func TestSecretHandler_Passphrase(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := database.NewMemoryDB()
+	h := NewSecretHandler(db, WithPassphraseAttempts(3))
+	h.nowFunc = func() time.Time { return now }
+
+	router := gin.New()
+	router.POST("/secret", h.PostSecret)
+	router.GET("/secret/:hash", h.GetSecret)
+
+	create := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/secret", nil)
+		req.PostForm = url.Values{
+			"secret":           {"test_secret"},
+			"expireAfterViews": {"2"},
+			"expireAfter":      {"0"},
+			"passphrase":       {"correct horse"},
+		}
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var res models.SecretResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.Hash
+	}
+	get := func(token, passphrase string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/secret/"+token, nil)
+		if passphrase != "" {
+			req.Header.Set(passphraseHeader, passphrase)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	token := create()
+	id, key, _ := splitToken(token)
+
+	// payload can't be decrypted with the token key only
+	s, err := db.GetSecret(id)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, s.PassphraseSalt)
+	assert.NotEmpty(t, s.PassphraseCheck)
+	inner, err := decryptSecret(key, s.SecretText)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "test_secret", inner)
+
+	// missing and wrong passphrases don't consume views
+	w := get(token, "")
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), CodePassphraseRequired)
+
+	w = get(token, "wrong")
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), CodeWrongPassphrase)
+
+	s, err = db.GetSecret(id)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), s.RemainingViews)
+	assert.Equal(t, int32(1), s.FailedAttempts)
+
+	// correct passphrase
+	w = get(token, "correct horse")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"secretText":"test_secret"`)
+	assert.Contains(t, w.Body.String(), `"remainingViews":1`)
+
+	// too many wrong attempts delete the secret
+	assert.Equal(t, 403, get(token, "wrong").Code)
+	assert.Equal(t, 410, get(token, "wrong").Code)
+	_, err = db.GetSecret(id)
+	assert.Equal(t, database.ErrNotFound, err)
+	assert.Equal(t, 404, get(token, "correct horse").Code)
+}
+
+func TestSecretHandler_Meta(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+	future, _ := time.Parse(time.RFC3339, "2020-03-01T10:10:10Z")
+	past, _ := time.Parse(time.RFC3339, "2020-01-01T10:10:10Z")
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	tests := []struct {
+		name     string
+		token    string
+		secret   *models.Secret
+		errGet   error
+		metaCode int
+		metaBody string
+		headCode int
+	}{
+		{
+			name:  "readable",
+			token: "5621caf61d79545957a49c7d",
+			secret: &models.Secret{SecretBase: models.SecretBase{
+				CreatedAt:      now,
+				ExpiresAt:      &future,
+				RemainingViews: 3,
+			}},
+			metaCode: 200,
+			metaBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-03-01T10:10:10.000Z","remainingViews":3,"readable":true,"passphraseRequired":false}`,
+			headCode: 200,
+		},
+		{
+			name:  "expired",
+			token: "5621caf61d79545957a49c7d",
+			secret: &models.Secret{SecretBase: models.SecretBase{
+				CreatedAt:       now,
+				ExpiresAt:       &past,
+				RemainingViews:  3,
+				PassphraseCheck: "check",
+			}},
+			metaCode: 200,
+			metaBody: `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-01-01T10:10:10.000Z","remainingViews":3,"readable":false,"passphraseRequired":true}`,
+			headCode: 410,
+		},
+		{
+			name:  "exhausted",
+			token: "5621caf61d79545957a49c7d",
+			secret: &models.Secret{SecretBase: models.SecretBase{
+				CreatedAt:      now,
+				RemainingViews: 0,
+			}},
+			metaCode: 200,
+			metaBody: `{"createdAt":"2020-02-01T10:10:10.000Z","remainingViews":0,"readable":false,"passphraseRequired":false}`,
+			headCode: 410,
+		},
+		{
+			name:  "wrong key",
+			token: "5621caf61d795459000000000000000000000000",
+			secret: &models.Secret{SecretBase: models.SecretBase{
+				CreatedAt:      now,
+				RemainingViews: 3,
+				KeyHash:        hashKey("000000000000000000000001"),
+			}},
+			metaCode: 404,
+			metaBody: `{"code":"not_found","message":"secret not found"}`,
+			headCode: 404,
+		},
+		{
+			name:     "not found",
+			token:    "5621caf61d79545957a49c7d",
+			errGet:   database.ErrNotFound,
+			metaCode: 404,
+			metaBody: `{"code":"not_found","message":"secret not found"}`,
+			headCode: 404,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &testDB{secret: tt.secret, errGetSecret: tt.errGet}
+			h := SecretHandler{
+				db:      db,
+				nowFunc: func() time.Time { return now },
+			}
+
+			router := gin.New()
+			router.GET("/secret/:hash/meta", h.GetSecretMeta)
+			router.HEAD("/secret/:hash", h.HeadSecret)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/secret/"+tt.token+"/meta", nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.metaCode, w.Code)
+			assert.Equal(t, tt.metaBody, w.Body.String())
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("HEAD", "/secret/"+tt.token, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.headCode, w.Code)
+			assert.Empty(t, w.Body.String())
+
+			// nothing is consumed
+			assert.Equal(t, 0, db.callCounterConsumeSecret)
+			assert.Equal(t, 0, db.callCounterUpdateSecret)
+			assert.Equal(t, 0, db.callCounterDeleteSecret)
+		})
+	}
+}
+
+func TestSecretHandler_Manage(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := database.NewMemoryDB()
+	h := NewSecretHandler(db)
+	h.nowFunc = func() time.Time { return now }
+
+	router := gin.New()
+	router.POST("/secret", h.PostSecret)
+	router.GET("/secret/:hash", h.GetSecret)
+	router.DELETE("/secret/:hash", h.DeleteSecret)
+	router.GET("/secret/:hash/status", h.GetSecretStatus)
+
+	serve := func(method, path, manageToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		if manageToken != "" {
+			req.Header.Set(manageTokenHeader, manageToken)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// create a secret
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/secret", nil)
+	req.PostForm = url.Values{
+		"secret":           {"test_secret"},
+		"expireAfterViews": {"3"},
+		"expireAfter":      {"0"},
+	}
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var res models.SecretResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(t, res.ManageToken, manageTokenLength)
+	id, _, _ := splitToken(res.Hash)
+
+	// management token is stored only as a hash
+	s, err := db.GetSecret(id)
+	assert.NoError(t, err)
+	assert.Equal(t, hashKey(res.ManageToken), s.ManageHash)
+
+	// status by token and by lookup id
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, "").Code)
+	w = serve("GET", "/secret/"+res.Hash+"/status", res.ManageToken)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"createdAt":"2020-02-01T10:10:10.000Z","remainingViews":2,"views":1,"readable":true,"state":"active"}`, w.Body.String())
+	assert.Equal(t, 200, serve("GET", "/secret/"+id+"/status", res.ManageToken).Code)
+
+	// management token is required
+	w = serve("GET", "/secret/"+id+"/status", "")
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), CodeManageTokenRequired)
+
+	// decryption key isn't a management token
+	_, key, _ := splitToken(res.Hash)
+	w = serve("DELETE", "/secret/"+id, key)
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), CodeWrongManageToken)
+
+	// revoke
+	w = serve("DELETE", "/secret/"+id, res.ManageToken)
+	assert.Equal(t, 204, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	assert.Equal(t, 404, serve("GET", "/secret/"+res.Hash, "").Code)
+	assert.Equal(t, 404, serve("DELETE", "/secret/"+id, res.ManageToken).Code)
+
+	// the status of a revoked secret is kept in its tombstone
+	w = serve("GET", "/secret/"+id+"/status", res.ManageToken)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"createdAt":"2020-02-01T10:10:10.000Z","remainingViews":2,"views":1,"readable":false,"state":"revoked"}`, w.Body.String())
+	assert.Equal(t, 403, serve("GET", "/secret/"+id+"/status", key).Code)
+
+	// the status of a read secret is kept until its expiration time
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/secret", nil)
+	req.PostForm = url.Values{
+		"secret":           {"test_secret"},
+		"expireAfterViews": {"1"},
+		"expireAfter":      {"10"},
+	}
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, "").Code)
+	w = serve("GET", "/secret/"+res.Hash+"/status", res.ManageToken)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"createdAt":"2020-02-01T10:10:10.000Z","expiresAt":"2020-02-01T10:20:10.000Z","remainingViews":0,"views":1,"readable":false,"state":"read"}`, w.Body.String())
+
+	now = now.Add(11 * time.Minute)
+	assert.Equal(t, 404, serve("GET", "/secret/"+res.Hash+"/status", res.ManageToken).Code)
+}
+
+// TestSecretHandler_LogRedaction fails if a token, its key or lookup id reaches the logs
+func TestSecretHandler_LogRedaction(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	for _, mode := range []string{logging.RedactMask, logging.RedactFingerprint} {
+		t.Run(mode, func(t *testing.T) {
+			var out bytes.Buffer
+			redactor, err := logging.NewRedactor(mode, "")
+			require.NoError(t, err)
+			logger, err := logging.New(&out, logging.LevelDebug, logging.FormatJSON, redactor)
+			require.NoError(t, err)
+			defer logging.SetDefault(logging.Default())
+			logging.SetDefault(logger)
+
+			db := database.NewMemoryDB()
+			h := NewSecretHandler(db, WithPassphraseAttempts(1))
+
+			router := gin.New()
+			router.Use(logging.AccessLog(logger), logging.Recovery(logger))
+			router.POST("/secret", h.PostSecret)
+			router.GET("/secret/:hash", h.GetSecret)
+			router.GET("/secret/:hash/meta", h.GetSecretMeta)
+			router.DELETE("/secret/:hash", h.DeleteSecret)
+
+			serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, path+"?passphrase=x", nil)
+				if header != nil {
+					req.Header = header
+				}
+				router.ServeHTTP(w, req)
+				return w
+			}
+			create := func(passphrase string) models.SecretResponse {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/secret", nil)
+				req.PostForm = url.Values{
+					"secret":           {"test_secret"},
+					"expireAfterViews": {"3"},
+					"expireAfter":      {"0"},
+					"passphrase":       {passphrase},
+				}
+				router.ServeHTTP(w, req)
+				require.Equal(t, 200, w.Code)
+
+				var res models.SecretResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				return res
+			}
+
+			// read, meta, revocation and unknown routes
+			res := create("")
+			assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, nil).Code)
+			assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash+"/meta", nil).Code)
+			assert.Equal(t, 404, serve("GET", "/secret/"+res.Hash+"/unknown", nil).Code)
+			id, key, _ := splitToken(res.Hash)
+			assert.Equal(t, 204, serve("DELETE", "/secret/"+id, http.Header{manageTokenHeader: {res.ManageToken}}).Code)
+
+			// burned by wrong passphrases
+			burned := create("correct horse")
+			assert.Equal(t, 410, serve("GET", "/secret/"+burned.Hash, http.Header{passphraseHeader: {"wrong"}}).Code)
+			burnedID, burnedKey, _ := splitToken(burned.Hash)
+
+			logs := out.String()
+			require.Contains(t, logs, "secret was revoked")
+			require.Contains(t, logs, "secret was deleted after wrong passphrase attempts")
+			for _, leak := range []string{res.Hash, id, key, res.ManageToken, burned.Hash, burnedID, burnedKey} {
+				assert.NotContains(t, logs, leak)
+			}
+			assert.NotContains(t, logs, "passphrase=x")
+		})
+	}
+}
+
+type testNotifier struct {
+	urls   []string
+	events []webhook.Event
+}
+
+func (n *testNotifier) Notify(url string, e webhook.Event) {
+	n.urls = append(n.urls, url)
+	n.events = append(n.events, e)
+}
+
+func TestSecretHandler_Notify(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := database.NewMemoryDB()
+	notifier := &testNotifier{}
+	h := NewSecretHandler(db, WithNotifier(notifier))
+	h.nowFunc = func() time.Time { return now }
+
+	router := gin.New()
+	router.POST("/secret", h.PostSecret)
+	router.GET("/secret/:hash", h.GetSecret)
+	router.DELETE("/secret/:hash", h.DeleteSecret)
+
+	create := func(notifyURL, expireAfter string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/secret", nil)
+		req.PostForm = url.Values{
+			"secret":           {"test_secret"},
+			"expireAfterViews": {"2"},
+			"expireAfter":      {expireAfter},
+			"notifyUrl":        {notifyURL},
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	serve := func(method, path, manageToken string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set(manageTokenHeader, manageToken)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	event := func(e webhook.EventType, id string, views int32) webhook.Event {
+		return webhook.Event{Type: e, SecretID: id, Time: now, RemainingViews: views}
+	}
+
+	// invalid URL
+	w := create("ftp://example.com", "0")
+	assert.Equal(t, 422, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"notifyUrl"`)
+
+	// views are reported, the last one burns the secret
+	var res models.SecretResponse
+	w = create("http://example.com/hook", "0")
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	id, _, _ := splitToken(res.Hash)
+
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, ""))
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, ""))
+	assert.Equal(t, []webhook.Event{
+		event(webhook.EventViewed, id, 1),
+		event(webhook.EventViewed, id, 0),
+		event(webhook.EventBurned, id, 0),
+	}, notifier.events)
+
+	// revocation
+	notifier.events = nil
+	w = create("http://example.com/hook", "0")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	id, _, _ = splitToken(res.Hash)
+	assert.Equal(t, 204, serve("DELETE", "/secret/"+id, res.ManageToken))
+	assert.Equal(t, []webhook.Event{event(webhook.EventRevoked, id, 2)}, notifier.events)
+
+	// expiration found by a reader
+	notifier.events = nil
+	w = create("http://example.com/hook", "10")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	id, _, _ = splitToken(res.Hash)
+	now = now.Add(time.Hour)
+	assert.Equal(t, 410, serve("GET", "/secret/"+res.Hash, ""))
+	assert.Equal(t, []webhook.Event{event(webhook.EventExpired, id, 2)}, notifier.events)
+	assert.Equal(t, []string{"http://example.com/hook"}, notifier.urls[len(notifier.urls)-1:])
+
+	// webhooks are disabled without a notifier
+	h.notifier = nil
+	w = create("http://example.com/hook", "0")
+	assert.Equal(t, 422, w.Code)
+	assert.Contains(t, w.Body.String(), "webhooks are disabled")
+}
+
+type testKeys map[string]tenant.Key
+
+func (k testKeys) Lookup(key string) (tenant.Key, bool) {
+	res, ok := k[key]
+	return res, ok
+}
+
+func TestSecretHandler_Tenants(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := database.NewMemoryDB()
+	h := NewSecretHandler(db, WithTenants(func(name string) Database {
+		return database.Namespace(db, name)
+	}))
+	auth := tenant.NewAuthenticator(testKeys{
+		"acme_key": {Tenant: "acme", Name: "ci"},
+		"beta_key": {Tenant: "beta", Name: "ci"},
+	})
+
+	router := gin.New()
+	router.POST("/secret", auth.Required(h.PostSecret))
+	router.GET("/secret/:hash", auth.Optional(h.GetSecret))
+	router.GET("/secret/:hash/status", auth.Optional(h.GetSecretStatus))
+
+	serve := func(method, path, apiKey string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.PostForm = form
+		if apiKey != "" {
+			req.Header.Set(tenant.KeyHeader, apiKey)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	create := func() models.SecretResponse {
+		w := serve("POST", "/secret", "acme_key", url.Values{
+			"secret":           {"test_secret"},
+			"expireAfterViews": {"5"},
+			"expireAfter":      {"0"},
+		})
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var res models.SecretResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	// API key is required for creation
+	w := serve("POST", "/secret", "", url.Values{"secret": {"test_secret"}, "expireAfterViews": {"1"}})
+	assert.Equal(t, 401, w.Code)
+
+	res := create()
+	name, token := tenant.SplitToken(res.Hash)
+	assert.Equal(t, "acme", name)
+	id, _, _ := splitToken(token)
+
+	// the secret is stored in the tenant namespace
+	_, err := db.GetSecret(id)
+	assert.Equal(t, database.ErrNotFound, err)
+	_, err = database.Namespace(db, "acme").GetSecret(id)
+	assert.NoError(t, err)
+
+	// the secret can be read by the tenant and without an API key
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, "acme_key", nil).Code)
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, "", nil).Code)
+	w = serve("GET", "/secret/acme."+id+"/status", "", url.Values{"manageToken": {res.ManageToken}})
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"views":2`)
+
+	// other tenants and the default namespace can't access it
+	assert.Equal(t, 404, serve("GET", "/secret/"+res.Hash, "beta_key", nil).Code)
+	assert.Equal(t, 404, serve("GET", "/secret/beta."+token, "beta_key", nil).Code)
+	assert.Equal(t, 404, serve("GET", "/secret/"+token, "", nil).Code)
+	assert.Equal(t, 404, serve("GET", "/secret/"+token, "acme_key", nil).Code)
+
+	// tenant namespaces can't be accessed without configured tenants
+	plain := NewSecretHandler(db)
+	router.GET("/plain/:hash", plain.GetSecret)
+	assert.Equal(t, 404, serve("GET", "/plain/"+res.Hash, "", nil).Code)
+}
+
+type testAuditor struct {
+	events []audit.Event
+}
+
+func (a *testAuditor) Record(e audit.Event) {
+	a.events = append(a.events, e)
+}
+
+func TestSecretHandler_Audit(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2020-02-01T10:10:10Z")
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	db := database.NewMemoryDB()
+	auditor := &testAuditor{}
+	h := NewSecretHandler(db, WithAuditor(auditor), WithPassphraseAttempts(1), WithTenants(func(name string) Database {
+		return database.Namespace(db, name)
+	}))
+	h.nowFunc = func() time.Time { return now }
+	auth := tenant.NewAuthenticator(testKeys{"acme_key": {Tenant: "acme", Name: "ci"}})
+
+	router := gin.New()
+	router.POST("/secret", auth.Optional(h.PostSecret))
+	router.GET("/secret/:hash", auth.Optional(h.GetSecret))
+	router.DELETE("/secret/:hash", auth.Optional(h.DeleteSecret))
+
+	serve := func(method, path string, header http.Header, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		for k, v := range header {
+			req.Header.Set(k, v[0])
+		}
+		req.PostForm = form
+		router.ServeHTTP(w, req)
+		return w
+	}
+	create := func(header http.Header, views, expireAfter, passphrase string) models.SecretResponse {
+		w := serve("POST", "/secret", header, url.Values{
+			"secret":           {"test_secret"},
+			"expireAfterViews": {views},
+			"expireAfter":      {expireAfter},
+			"passphrase":       {passphrase},
+		})
+		require.Equal(t, 200, w.Code)
+		var res models.SecretResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+	created := now
+	event := func(action audit.Action, id, tenant, actor string) audit.Event {
+		return audit.Event{Time: created, Action: action, SecretID: id, Tenant: tenant, Actor: actor, IP: "192.0.2.1"}
+	}
+	apiKey := http.Header{tenant.KeyHeader: {"acme_key"}}
+
+	// creation and views of a tenant secret
+	res := create(apiKey, "1", "0", "")
+	_, token := tenant.SplitToken(res.Hash)
+	id, _, _ := splitToken(token)
+	assert.Equal(t, 200, serve("GET", "/secret/"+res.Hash, nil, nil).Code)
+
+	// revocation
+	revoked := create(nil, "2", "0", "")
+	revokedID, _, _ := splitToken(revoked.Hash)
+	assert.Equal(t, 204, serve("DELETE", "/secret/"+revokedID, http.Header{manageTokenHeader: {revoked.ManageToken}}, nil).Code)
+
+	// wrong passphrases
+	burned := create(nil, "2", "0", "correct horse")
+	burnedID, _, _ := splitToken(burned.Hash)
+	assert.Equal(t, 410, serve("GET", "/secret/"+burned.Hash, http.Header{passphraseHeader: {"wrong"}}, nil).Code)
+
+	// expiration
+	expired := create(nil, "2", "10", "")
+	expiredID, _, _ := splitToken(expired.Hash)
+	now = now.Add(time.Hour)
+	assert.Equal(t, 410, serve("GET", "/secret/"+expired.Hash, nil, nil).Code)
+	expiredEvent := event(audit.ActionExpired, expiredID, "", "")
+	expiredEvent.Time = now
+
+	assert.Equal(t, []audit.Event{
+		event(audit.ActionCreated, id, "acme", "api-key:ci"),
+		event(audit.ActionViewed, id, "acme", ""),
+		event(audit.ActionBurned, id, "acme", ""),
+		event(audit.ActionCreated, revokedID, "", ""),
+		event(audit.ActionRevoked, revokedID, "", ""),
+		event(audit.ActionCreated, burnedID, "", ""),
+		event(audit.ActionBurned, burnedID, "", ""),
+		event(audit.ActionCreated, expiredID, "", ""),
+		expiredEvent,
+	}, auditor.events)
+}
+
+func TestSecretHandler_AuditLegacy(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = ioutil.Discard
+
+	// legacy tokens are lookup ids and keys at once
+	token := "0123456789abcdef01234567"
+	db := database.NewMemoryDB()
+	require.NoError(t, db.CreateSecret(token, models.Secret{SecretBase: models.SecretBase{
+		RemainingViews: 1,
+		SecretText:     encryptLegacySecret(token, "test_secret"),
+		NotifyURL:      "http://example.com/hook",
+	}}))
+
+	auditor := &testAuditor{}
+	notifier := &testNotifier{}
+	h := NewSecretHandler(db, WithAuditor(auditor), WithNotifier(notifier), WithFingerprintKey([]byte("audit_key")))
+	router := gin.New()
+	router.GET("/secret/:hash", h.GetSecret)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/secret/"+token, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	fp := audit.Fingerprint([]byte("audit_key"), token)
+	require.Len(t, auditor.events, 2)
+	for _, e := range auditor.events {
+		assert.Equal(t, fp, e.SecretID)
+		data, _ := json.Marshal(e)
+		assert.NotContains(t, string(data), token)
+	}
+	require.Len(t, notifier.events, 2)
+	for _, e := range notifier.events {
+		assert.Equal(t, fp, e.SecretID)
+	}
+}
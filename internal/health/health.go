@@ -0,0 +1,146 @@
+/*
+Package health serves liveness and readiness probes.
+
+Liveness only shows that the process is able to serve requests.
+Readiness also checks dependencies, like the storage backend, and fails during graceful shutdown,
+so load balancers stop routing requests to the replica.
+*/
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// probe and dependency statuses
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// CheckFunc checks a dependency. It should return when the context is done
+type CheckFunc func(ctx context.Context) error
+
+// Report is a probe response
+type Report struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+// Check is a dependency status
+type Check struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Checker runs dependency checks of the readiness probe
+type Checker struct {
+	timeout  time.Duration
+	names    []string
+	checks   map[string]CheckFunc
+	stopping int32
+}
+
+// New creates a checker with a timeout of every readiness check
+func New(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  make(map[string]CheckFunc),
+	}
+}
+
+// Add adds a dependency check. Checks must be added before probes are served
+func (h *Checker) Add(name string, check CheckFunc) {
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+		sort.Strings(h.names)
+	}
+	h.checks[name] = check
+}
+
+// Shutdown marks the service as shutting down. Readiness fails after that
+func (h *Checker) Shutdown() {
+	atomic.StoreInt32(&h.stopping, 1)
+}
+
+// Check runs all dependency checks concurrently
+func (h *Checker) Check(ctx context.Context) Report {
+	rep := Report{
+		Status: StatusOK,
+		Checks: make(map[string]Check, len(h.names)+1),
+	}
+	if atomic.LoadInt32(&h.stopping) == 1 {
+		rep.Status = StatusFail
+		rep.Checks["shutdown"] = Check{Status: StatusFail, Error: "server is shutting down", Duration: "0s"}
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, name := range h.names {
+		wg.Add(1)
+		go func(name string, check CheckFunc) {
+			defer wg.Done()
+			res := h.run(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			rep.Checks[name] = res
+			if res.Status != StatusOK {
+				rep.Status = StatusFail
+			}
+		}(name, h.checks[name])
+	}
+	wg.Wait()
+	return rep
+}
+
+// run runs the check with a timeout. Checks that ignore the context are abandoned on timeout
+func (h *Checker) run(ctx context.Context, check CheckFunc) Check {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := Check{
+		Status:   StatusOK,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Live is a liveness probe handler
+func (h *Checker) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, Report{Status: StatusOK})
+}
+
+// Ready is a readiness probe handler. It responds with 503 if any check fails
+func (h *Checker) Ready(c *gin.Context) {
+	rep := h.Check(c.Request.Context())
+	status := http.StatusOK
+	if rep.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, rep)
+}
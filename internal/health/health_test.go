@@ -0,0 +1,68 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(t *testing.T, hf gin.HandlerFunc) (int, Report) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	hf(c)
+
+	var rep Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rep))
+	return w.Code, rep
+}
+
+func TestChecker(t *testing.T) {
+	storageErr := error(nil)
+	h := New(50 * time.Millisecond)
+	h.Add("storage", func(ctx context.Context) error { return storageErr })
+	h.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	// the slow check ignores the timeout error, but the checker doesn't
+	code, rep := probe(t, h.Ready)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusFail, rep.Status)
+	assert.Equal(t, StatusOK, rep.Checks["storage"].Status)
+	assert.Equal(t, StatusFail, rep.Checks["slow"].Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), rep.Checks["slow"].Error)
+
+	h.Add("slow", func(ctx context.Context) error { return nil })
+	code, rep = probe(t, h.Ready)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusOK, rep.Status)
+	assert.Len(t, rep.Checks, 2)
+
+	storageErr = errors.New("connection refused")
+	code, rep = probe(t, h.Ready)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, Check{Status: StatusFail, Error: "connection refused", Duration: rep.Checks["storage"].Duration}, rep.Checks["storage"])
+
+	storageErr = nil
+	h.Shutdown()
+	code, rep = probe(t, h.Ready)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusFail, rep.Checks["shutdown"].Status)
+	assert.Equal(t, StatusOK, rep.Checks["storage"].Status)
+
+	// the process is still alive during shutdown
+	code, rep = probe(t, h.Live)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusOK, rep.Status)
+}
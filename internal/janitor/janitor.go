@@ -0,0 +1,274 @@
+/*
+Package janitor sweeps expired and exhausted secrets out of the storage.
+
+Storage drivers without native expiration keep outdated secrets until someone reads them.
+The janitor periodically scans the storage and deletes such secrets in batches.
+*/
+package janitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/audit"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/webhook"
+)
+
+// Janitor periodically deletes expired and exhausted secrets
+type Janitor struct {
+	db       Database
+	locker   Locker
+	observer Observer
+	notifier Notifier
+	auditor  Auditor
+	tenant   string
+	// fingerprintKey is a key of ids of legacy secrets in events
+	fingerprintKey []byte
+	interval       time.Duration
+	batchSize      int
+
+	nowFunc func() time.Time
+}
+
+// New creates a new janitor.
+//
+// If locker is nil, every replica sweeps the storage on its own.
+// If observer is nil, sweep progress is only logged.
+func New(db Database, locker Locker, observer Observer, interval time.Duration, batchSize int) *Janitor {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &Janitor{
+		db:        db,
+		locker:    locker,
+		observer:  observer,
+		interval:  interval,
+		batchSize: batchSize,
+		nowFunc:   time.Now,
+	}
+}
+
+// SetNotifier enables expiration events of swept secrets with a notification URL
+func (j *Janitor) SetNotifier(n Notifier) {
+	j.notifier = n
+}
+
+// SetAuditor enables the audit trail of swept expired secrets. Tenant is the namespace of the swept database
+func (j *Janitor) SetAuditor(a Auditor, tenant string) {
+	j.auditor = a
+	j.tenant = tenant
+}
+
+// SetFingerprintKey sets a key of fingerprints identifying legacy secrets in events
+func (j *Janitor) SetFingerprintKey(key []byte) {
+	j.fingerprintKey = key
+}
+
+// Run sweeps the storage every interval until the context is done
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.runOnce()
+		}
+	}
+}
+
+// runOnce sweeps the storage if no other replica does it in this interval
+func (j *Janitor) runOnce() {
+	if j.locker != nil {
+		// the lock isn't released after the sweep
+		// and expires with the interval, so only one replica sweeps per interval
+		ok, err := j.locker.TryLock(j.interval)
+		if err != nil {
+			logging.Error("janitor lock error", logging.Err(err))
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+
+	start := time.Now()
+	scanned, deleted, err := j.Sweep()
+	duration := time.Since(start)
+
+	if err != nil {
+		logging.Error("janitor sweep error", logging.Err(err))
+	}
+	logging.Info("janitor sweep finished",
+		logging.Int("scanned", scanned),
+		logging.Int("deleted", deleted),
+		logging.Any("duration", duration),
+	)
+
+	if j.observer != nil {
+		j.observer.ObserveSweep(scanned, deleted, duration, err)
+	}
+}
+
+// Sweep scans the storage once and deletes expired and exhausted secrets.
+//
+// File chunks expire with their secrets and are deleted too, but they aren't counted or reported.
+// The same goes for tombstones of deleted secrets.
+// Returns the number of scanned and deleted secrets.
+func (j *Janitor) Sweep() (scanned, deleted int, err error) {
+	now := j.nowFunc()
+	batch := make([]string, 0, j.batchSize)
+	// number of secrets in the current batch, the rest are chunks and tombstones
+	var secrets int
+	// expired secrets of the current batch to be reported
+	var expired []webhook.Delivery
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := j.deleteBatch(batch); err != nil {
+			return err
+		}
+		deleted += secrets
+		batch = batch[:0]
+		secrets = 0
+
+		for _, dl := range expired {
+			j.report(dl)
+		}
+		expired = expired[:0]
+		return nil
+	}
+
+	err = j.db.ForEachSecret(func(hash string) error {
+		s, err := j.db.GetSecret(hash)
+		if err == database.ErrNotFound {
+			// deleted concurrently
+			return nil
+		} else if err != nil {
+			return err
+		}
+		secret := !models.IsChunk(hash) && s.State == ""
+		if secret {
+			scanned++
+		}
+
+		if !isOutdated(s, now) {
+			return nil
+		}
+
+		batch = append(batch, hash)
+		if secret {
+			secrets++
+			// exhausted secrets were reported as burned by the last reader
+			if s.ExpiresAt != nil && now.After(*s.ExpiresAt) {
+				expired = append(expired, webhook.Delivery{
+					URL: s.NotifyURL,
+					Event: webhook.Event{
+						Type:           webhook.EventExpired,
+						SecretID:       j.eventID(hash, s),
+						Time:           now,
+						RemainingViews: s.RemainingViews,
+					},
+				})
+			}
+		}
+		if len(batch) >= j.batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return scanned, deleted, err
+	}
+	return scanned, deleted, flush()
+}
+
+// report sends the expiration event to the webhook and the audit trail
+func (j *Janitor) report(dl webhook.Delivery) {
+	if j.notifier != nil && dl.URL != "" {
+		j.notifier.Notify(dl.URL, dl.Event)
+	}
+	if j.auditor != nil {
+		j.auditor.Record(audit.Event{
+			Time:     dl.Event.Time,
+			Action:   audit.ActionExpired,
+			SecretID: dl.Event.SecretID,
+			Tenant:   j.tenant,
+			Actor:    "janitor",
+		})
+	}
+}
+
+// eventID returns the id of the secret in events.
+//
+// Legacy secrets are stored under their token, which is also the key, so they are identified by a fingerprint.
+func (j *Janitor) eventID(hash string, s *models.Secret) string {
+	if s.KeyHash == "" {
+		return audit.Fingerprint(j.fingerprintKey, hash)
+	}
+	return hash
+}
+
+// deleteBatch deletes several secrets at once if the database supports it
+func (j *Janitor) deleteBatch(hashes []string) error {
+	if bd, ok := j.db.(BatchDeleter); ok {
+		return bd.DeleteSecrets(hashes)
+	}
+	for _, hash := range hashes {
+		if err := j.db.DeleteSecret(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOutdated checks if the secret can't be read anymore.
+//
+// Outdated secrets never become valid again, so they can be deleted without a version check.
+// Tombstones are kept until the expiration time of their secrets.
+func isOutdated(s *models.Secret, now time.Time) bool {
+	if s.State != "" {
+		return models.TombstoneOutdated(&s.SecretBase, now)
+	}
+	return s.RemainingViews <= 0 || s.ExpiresAt != nil && now.After(*s.ExpiresAt)
+}
+
+// Database is a database layer interface
+type Database interface {
+	GetSecret(hash string) (*models.Secret, error)
+	DeleteSecret(hash string) error
+	ForEachSecret(fn func(hash string) error) error
+}
+
+// BatchDeleter is a database able to delete several secrets at once
+type BatchDeleter interface {
+	DeleteSecrets(hashes []string) error
+}
+
+// Locker guards sweeps from running on several replicas at once
+type Locker interface {
+	// TryLock acquires the lock for ttl. Returns false if the lock is held by another owner
+	TryLock(ttl time.Duration) (bool, error)
+}
+
+// Notifier delivers secret lifecycle events
+type Notifier interface {
+	Notify(url string, e webhook.Event)
+}
+
+// Auditor keeps the audit trail of secret lifecycle events
+type Auditor interface {
+	Record(e audit.Event)
+}
+
+// Observer receives sweep progress
+type Observer interface {
+	ObserveSweep(scanned, deleted int, duration time.Duration, err error)
+}
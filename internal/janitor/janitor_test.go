@@ -0,0 +1,237 @@
+package janitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/audit"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testLocker struct {
+	locked bool
+}
+
+func (l *testLocker) TryLock(ttl time.Duration) (bool, error) {
+	if l.locked {
+		return false, nil
+	}
+	l.locked = true
+	return true, nil
+}
+
+type testObserver struct {
+	sweeps           int
+	scanned, deleted int
+}
+
+func (o *testObserver) ObserveSweep(scanned, deleted int, duration time.Duration, err error) {
+	o.sweeps++
+	o.scanned += scanned
+	o.deleted += deleted
+}
+
+type testNotifier struct {
+	urls   []string
+	events []webhook.Event
+}
+
+func (n *testNotifier) Notify(url string, e webhook.Event) {
+	n.urls = append(n.urls, url)
+	n.events = append(n.events, e)
+}
+
+type testAuditor struct {
+	events []audit.Event
+}
+
+func (a *testAuditor) Record(e audit.Event) {
+	a.events = append(a.events, e)
+}
+
+func newTestDB(t *testing.T, now time.Time) *database.MemoryDB {
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	db := database.NewMemoryDB()
+	secrets := map[string]models.SecretBase{
+		"valid":     {RemainingViews: 1, ExpiresAt: &future},
+		"forever":   {RemainingViews: 1},
+		"expired":   {RemainingViews: 1, ExpiresAt: &past},
+		"exhausted": {RemainingViews: 0, ExpiresAt: &future},
+		"both":      {RemainingViews: 0, ExpiresAt: &past},
+	}
+	for hash, s := range secrets {
+		s.KeyHash = "key_hash"
+		require.NoError(t, db.CreateSecret(hash, models.Secret{SecretBase: s}))
+	}
+	return db
+}
+
+func TestJanitor_Sweep(t *testing.T) {
+	now := time.Now()
+
+	for _, batchSize := range []int{1, 2, 100} {
+		db := newTestDB(t, now)
+		j := New(db, nil, nil, time.Minute, batchSize)
+		j.nowFunc = func() time.Time { return now }
+
+		scanned, deleted, err := j.Sweep()
+		require.NoError(t, err)
+		assert.Equal(t, 5, scanned)
+		assert.Equal(t, 3, deleted)
+
+		for _, hash := range []string{"valid", "forever"} {
+			_, err := db.GetSecret(hash)
+			assert.NoError(t, err, hash)
+		}
+		for _, hash := range []string{"expired", "exhausted", "both"} {
+			_, err := db.GetSecret(hash)
+			assert.Equal(t, database.ErrNotFound, err, hash)
+		}
+	}
+}
+
+func TestJanitor_runOnce(t *testing.T) {
+	now := time.Now()
+	db := newTestDB(t, now)
+	locker := &testLocker{}
+	observer := &testObserver{}
+
+	j := New(db, locker, observer, time.Minute, 10)
+	j.nowFunc = func() time.Time { return now }
+
+	// the first replica takes the lock and sweeps
+	j.runOnce()
+	assert.Equal(t, 1, observer.sweeps)
+	assert.Equal(t, 5, observer.scanned)
+	assert.Equal(t, 3, observer.deleted)
+
+	// other replicas skip the sweep while the lock is held
+	j.runOnce()
+	assert.Equal(t, 1, observer.sweeps)
+}
+
+func TestJanitor_Notify(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+
+	db := newTestDB(t, now)
+	secrets := map[string]models.SecretBase{
+		"notify_expired":   {RemainingViews: 2, ExpiresAt: &past, NotifyURL: "http://example.com/expired", KeyHash: "key_hash"},
+		"notify_exhausted": {RemainingViews: 0, NotifyURL: "http://example.com/exhausted", KeyHash: "key_hash"},
+		// legacy secrets are stored under their token and have no key hash
+		"0123456789abcdef01234567": {RemainingViews: 1, ExpiresAt: &past, NotifyURL: "http://example.com/legacy"},
+	}
+	for hash, s := range secrets {
+		require.NoError(t, db.CreateSecret(hash, models.Secret{SecretBase: s}))
+	}
+
+	notifier := &testNotifier{}
+	auditor := &testAuditor{}
+	j := New(db, nil, nil, time.Minute, 1)
+	j.SetNotifier(notifier)
+	j.SetAuditor(auditor, "acme")
+	j.SetFingerprintKey([]byte("audit_key"))
+	j.nowFunc = func() time.Time { return now }
+
+	_, deleted, err := j.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 6, deleted)
+
+	// exhausted secrets were already reported by the handler,
+	// legacy tokens are secret keys and never leave the service
+	legacyID := audit.Fingerprint([]byte("audit_key"), "0123456789abcdef01234567")
+	assert.ElementsMatch(t, []string{"http://example.com/expired", "http://example.com/legacy"}, notifier.urls)
+	assert.ElementsMatch(t, []webhook.Event{{
+		Type:           webhook.EventExpired,
+		SecretID:       "notify_expired",
+		Time:           now,
+		RemainingViews: 2,
+	}, {
+		Type:           webhook.EventExpired,
+		SecretID:       legacyID,
+		Time:           now,
+		RemainingViews: 1,
+	}}, notifier.events)
+
+	// all expired secrets are audited
+	var ids []string
+	for _, e := range auditor.events {
+		assert.Equal(t, audit.Event{Time: now, Action: audit.ActionExpired, SecretID: e.SecretID, Tenant: "acme", Actor: "janitor"}, e)
+		ids = append(ids, e.SecretID)
+	}
+	assert.ElementsMatch(t, []string{"expired", "both", "notify_expired", legacyID}, ids)
+}
+
+func TestJanitor_Tombstones(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	deletedLongAgo := now.Add(-models.TombstoneRetention - time.Minute)
+
+	db := database.NewMemoryDB()
+	tombstones := map[string]models.SecretBase{
+		"read":     {ExpiresAt: &future, State: models.StateRead, DeletedAt: &past},
+		"revoked":  {ExpiresAt: &past, RemainingViews: 2, NotifyURL: "http://example.com/revoked", State: models.StateRevoked, DeletedAt: &past},
+		"kept":     {RemainingViews: 1, State: models.StateRevoked, DeletedAt: &past},
+		"retained": {State: models.StateBurned, DeletedAt: &deletedLongAgo},
+	}
+	for hash, s := range tombstones {
+		require.NoError(t, db.CreateSecret(models.TombstoneID(hash), models.Secret{SecretBase: s}))
+	}
+
+	notifier := &testNotifier{}
+	j := New(db, nil, nil, time.Minute, 10)
+	j.SetNotifier(notifier)
+	j.nowFunc = func() time.Time { return now }
+
+	scanned, deleted, err := j.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 0, scanned)
+	assert.Equal(t, 0, deleted)
+
+	// tombstones are kept until the expiration of their secrets and never reported
+	for hash, ok := range map[string]bool{"read": true, "revoked": false, "kept": true, "retained": false} {
+		_, err := db.GetSecret(models.TombstoneID(hash))
+		assert.Equal(t, ok, err == nil, hash)
+	}
+	assert.Empty(t, notifier.urls)
+}
+
+func TestJanitor_FileChunks(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+
+	db := database.NewMemoryDB()
+	file := models.SecretBase{RemainingViews: 1, ExpiresAt: &past, NotifyURL: "http://example.com/file", KeyHash: "key_hash", Chunks: 3}
+	require.NoError(t, db.CreateSecret("file", models.Secret{SecretBase: file}))
+	for idx := 0; idx < int(file.Chunks); idx++ {
+		chunk := models.SecretBase{RemainingViews: 1, ExpiresAt: &past, KeyHash: "key_hash"}
+		require.NoError(t, db.CreateSecret(models.ChunkID("file", idx), models.Secret{SecretBase: chunk}))
+	}
+
+	notifier := &testNotifier{}
+	auditor := &testAuditor{}
+	j := New(db, nil, nil, time.Minute, 2)
+	j.SetNotifier(notifier)
+	j.SetAuditor(auditor, "")
+	j.nowFunc = func() time.Time { return now }
+
+	scanned, deleted, err := j.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 1, scanned)
+	assert.Equal(t, 1, deleted)
+
+	// chunks are deleted with the secret, but only the secret is reported
+	for idx := 0; idx < int(file.Chunks); idx++ {
+		_, err := db.GetSecret(models.ChunkID("file", idx))
+		assert.Equal(t, database.ErrNotFound, err)
+	}
+	assert.Equal(t, []string{"http://example.com/file"}, notifier.urls)
+	require.Len(t, auditor.events, 1)
+	assert.Equal(t, "file", auditor.events[0].SecretID)
+}
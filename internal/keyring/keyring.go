@@ -0,0 +1,170 @@
+/*
+Package keyring manages server-side key-encryption keys (KEK).
+
+Every data key stored in the database is wrapped with a KEK. The keyring keeps several KEKs side by side,
+so records wrapped with an old key can be read while new records are wrapped with the primary key.
+*/
+package keyring
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeySize is a required length of a key-encryption key
+const KeySize = 32
+
+var (
+	// ErrUnknownKey the key is not present in the keyring
+	ErrUnknownKey = errors.New("unknown key-encryption key")
+	// ErrEmpty the keyring has no keys
+	ErrEmpty = errors.New("keyring has no keys")
+)
+
+// Keyring is a set of key-encryption keys with one primary key
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// New creates a keyring from raw keys.
+//
+// The primary key is used to wrap new data keys, other keys are only used for unwrapping.
+func New(primary string, keys map[string][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrEmpty
+	}
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("%v %q", ErrUnknownKey, primary)
+	}
+
+	kr := Keyring{
+		primary: primary,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %q has length %d, expected %d", id, len(key), KeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+	}
+	return &kr, nil
+}
+
+// Load creates a keyring from a comma-separated key list and a key file.
+//
+// Each key is defined as "id:base64key", in the file every key is on a separate line.
+// If primary is empty, the first key is used as the primary one.
+// Returns nil keyring without error if no keys are defined.
+func Load(list, file, primary string) (*Keyring, error) {
+	var specs []string
+	for _, spec := range strings.Split(list, ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			specs = append(specs, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[string][]byte, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("wrong key format, expected id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", parts[0], err)
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate key %q", parts[0])
+		}
+		keys[parts[0]] = key
+		if primary == "" {
+			primary = parts[0]
+		}
+	}
+
+	return New(primary, keys)
+}
+
+// Primary returns an id of the primary key
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Wrap encrypts a data key with the primary key.
+//
+// Returns the id of the key used and the wrapped data key.
+func (k *Keyring) Wrap(dataKey []byte) (string, []byte, error) {
+	aead := k.keys[k.primary]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+
+	// key id is authenticated to bind the wrapped key to it
+	return k.primary, aead.Seal(nonce, nonce, dataKey, []byte(k.primary)), nil
+}
+
+// Unwrap decrypts a data key wrapped with the key id
+func (k *Keyring) Unwrap(id string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%v %q", ErrUnknownKey, id)
+	}
+	if len(wrapped) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():], []byte(id))
+}
+
+// Rewrap re-encrypts a data key wrapped with the key id with the primary key
+func (k *Keyring) Rewrap(id string, wrapped []byte) (string, []byte, error) {
+	dataKey, err := k.Unwrap(id, wrapped)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.Wrap(dataKey)
+}
@@ -0,0 +1,149 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestKeyring_Rewrap(t *testing.T) {
+	dataKey := []byte("test data key")
+
+	oldRing, err := New("old", map[string][]byte{"old": testKey(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRing, err := New("new", map[string][]byte{"old": testKey(1), "new": testKey(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, wrapped, err := oldRing.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "old" {
+		t.Errorf("Wrap() id = %s, want old", id)
+	}
+
+	// old keys are still readable by the new keyring
+	got, err := newRing.Unwrap(id, wrapped)
+	if err != nil {
+		t.Fatalf("Unwrap() error = %v", err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Errorf("Unwrap() = %s, want %s", got, dataKey)
+	}
+
+	id, wrapped, err = newRing.Rewrap(id, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "new" {
+		t.Errorf("Rewrap() id = %s, want new", id)
+	}
+
+	// the old keyring doesn't know the new key
+	if _, err := oldRing.Unwrap(id, wrapped); err == nil {
+		t.Error("Unwrap() with unknown key must fail")
+	}
+
+	// the key id is authenticated
+	if _, err := newRing.Unwrap("old", wrapped); err == nil {
+		t.Error("Unwrap() with wrong key id must fail")
+	}
+
+	got, err = newRing.Unwrap(id, wrapped)
+	if err != nil {
+		t.Fatalf("Unwrap() error = %v", err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Errorf("Unwrap() = %s, want %s", got, dataKey)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString(testKey(1))
+	key2 := base64.StdEncoding.EncodeToString(testKey(2))
+
+	f, err := ioutil.TempFile("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\nfile:" + key2 + "\n")
+	f.Close()
+
+	tests := []struct {
+		name        string
+		list        string
+		file        string
+		primary     string
+		wantPrimary string
+		wantNil     bool
+		wantErr     bool
+	}{
+		{
+			name:    "empty",
+			wantNil: true,
+		},
+		{
+			name:        "list",
+			list:        "a:" + key1 + ", b:" + key2,
+			wantPrimary: "a",
+		},
+		{
+			name:        "list and file with primary",
+			list:        "a:" + key1,
+			file:        f.Name(),
+			primary:     "file",
+			wantPrimary: "file",
+		},
+		{
+			name:    "unknown primary",
+			list:    "a:" + key1,
+			primary: "b",
+			wantErr: true,
+		},
+		{
+			name:    "short key",
+			list:    "a:" + base64.StdEncoding.EncodeToString([]byte("short")),
+			wantErr: true,
+		},
+		{
+			name:    "wrong format",
+			list:    key1,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate",
+			list:    "a:" + key1 + ",a:" + key2,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr, err := Load(tt.list, tt.file, tt.primary)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if (kr == nil) != tt.wantNil {
+				t.Errorf("Load() = %v, wantNil %v", kr, tt.wantNil)
+				return
+			}
+			if kr != nil && kr.Primary() != tt.wantPrimary {
+				t.Errorf("Primary() = %s, want %s", kr.Primary(), tt.wantPrimary)
+			}
+		})
+	}
+}
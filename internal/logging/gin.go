@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ilyakaznacheev/secret/internal/clientip"
+)
+
+// AccessLog is a middleware writing a record of every request.
+//
+// Hashes in the path are redacted, the query string isn't logged.
+func AccessLog(l *Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		values := make([]string, 0, len(c.Params))
+		for _, p := range c.Params {
+			values = append(values, p.Value)
+		}
+
+		level := LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = LevelError
+		}
+		l.write(level, "request",
+			[]Field{
+				String("method", c.Request.Method),
+				String("path", l.redactor.RedactPath(c.Request.URL.Path, values...)),
+				Int("status", c.Writer.Status()),
+				Int("size", c.Writer.Size()),
+				Any("latency", time.Since(start)),
+				String("ip", clientip.FromContext(c)),
+			},
+		)
+	}
+}
+
+// Recovery is a middleware recovering from panics with a 500 response.
+//
+// Unlike gin.Recovery it doesn't dump the request, because its path may contain a secret token.
+func Recovery(l *Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				l.Error("panic recovered",
+					Any("panic", err),
+					String("stack", string(debug.Stack())),
+				)
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}
+		}()
+		c.Next()
+	}
+}
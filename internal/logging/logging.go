@@ -0,0 +1,266 @@
+/*
+Package logging writes leveled structured logs in JSON or text format.
+
+Secret hashes and tokens are logged with the Hash field and are never written as is:
+they are masked or replaced with a keyed fingerprint by the logger's Redactor.
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is a log severity level
+type Level int
+
+// log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns a level by name
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(l), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// output formats
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Field is a key-value pair of a log record
+type Field struct {
+	Key   string
+	Value interface{}
+	hash  bool
+}
+
+// String creates a string field
+func String(key, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Int creates an integer field
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Any creates a field of any JSON-serializable value
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err creates an error field
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error"}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// Hash creates a field of a secret hash or token. It is redacted on write
+func Hash(key, hash string) Field {
+	return Field{Key: key, Value: hash, hash: true}
+}
+
+// Logger writes structured log records. It is safe for concurrent use
+type Logger struct {
+	mu       *sync.Mutex
+	out      io.Writer
+	level    Level
+	format   string
+	redactor *Redactor
+	fields   []Field
+	nowFunc  func() time.Time
+}
+
+// New creates a logger writing records of the level and above in the format
+func New(out io.Writer, level Level, format string, redactor *Redactor) (*Logger, error) {
+	if format != FormatJSON && format != FormatText {
+		return nil, fmt.Errorf("unknown log format %q, expected json or text", format)
+	}
+	return &Logger{
+		mu:       &sync.Mutex{},
+		out:      out,
+		level:    level,
+		format:   format,
+		redactor: redactor,
+		nowFunc:  time.Now,
+	}, nil
+}
+
+// With returns a logger adding the fields to every record
+func (l *Logger) With(fields ...Field) *Logger {
+	wl := *l
+	wl.fields = append(append([]Field{}, l.fields...), fields...)
+	return &wl
+}
+
+// Redact returns a redacted secret hash or token
+func (l *Logger) Redact(hash string) string {
+	return l.redactor.Redact(hash)
+}
+
+// Enabled reports whether records of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes a debug record
+func (l *Logger) Debug(msg string, fields ...Field) { l.write(LevelDebug, msg, fields) }
+
+// Info writes an info record
+func (l *Logger) Info(msg string, fields ...Field) { l.write(LevelInfo, msg, fields) }
+
+// Warn writes a warning record
+func (l *Logger) Warn(msg string, fields ...Field) { l.write(LevelWarn, msg, fields) }
+
+// Error writes an error record
+func (l *Logger) Error(msg string, fields ...Field) { l.write(LevelError, msg, fields) }
+
+func (l *Logger) write(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	for _, f := range append(l.fields, fields...) {
+		if f.hash {
+			f.Value = l.redactor.Redact(f.Value.(string))
+		}
+		all = append(all, f)
+	}
+
+	var buf bytes.Buffer
+	ts := l.nowFunc().UTC().Format(time.RFC3339Nano)
+	if l.format == FormatText {
+		writeText(&buf, ts, level, msg, all)
+	} else {
+		writeJSON(&buf, ts, level, msg, all)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// writeJSON writes a record as a JSON object line with fields in the given order
+func writeJSON(buf *bytes.Buffer, ts string, level Level, msg string, fields []Field) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, ts)
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSONValue(buf, f.Key)
+		buf.WriteByte(':')
+		writeJSONValue(buf, fieldValue(f.Value))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// writeText writes a record as a line of space-separated key=value pairs
+func writeText(buf *bytes.Buffer, ts string, level Level, msg string, fields []Field) {
+	buf.WriteString(ts)
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for _, f := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		s := fmt.Sprint(fieldValue(f.Value))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+}
+
+// fieldValue converts values without a readable JSON form
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	default:
+		return v
+	}
+}
+
+var (
+	stdMu sync.RWMutex
+	std   = &Logger{
+		mu:       &sync.Mutex{},
+		out:      os.Stderr,
+		level:    LevelInfo,
+		format:   FormatJSON,
+		redactor: &Redactor{},
+		nowFunc:  time.Now,
+	}
+)
+
+// Default returns the default logger. It writes info records in JSON to stderr and masks hashes until replaced
+func Default() *Logger {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+	return std
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	std = l
+}
+
+// Debug writes a debug record with the default logger
+func Debug(msg string, fields ...Field) { Default().write(LevelDebug, msg, fields) }
+
+// Info writes an info record with the default logger
+func Info(msg string, fields ...Field) { Default().write(LevelInfo, msg, fields) }
+
+// Warn writes a warning record with the default logger
+func Warn(msg string, fields ...Field) { Default().write(LevelWarn, msg, fields) }
+
+// Error writes an error record with the default logger
+func Error(msg string, fields ...Field) { Default().write(LevelError, msg, fields) }
@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHash = "0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func newTestLogger(t *testing.T, level Level, format string, redactor *Redactor) (*Logger, *bytes.Buffer) {
+	var out bytes.Buffer
+	l, err := New(&out, level, format, redactor)
+	require.NoError(t, err)
+	l.nowFunc = func() time.Time { return time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC) }
+	return l, &out
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, level := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warn": LevelWarn, "error": LevelError} {
+		l, err := ParseLevel(name)
+		assert.NoError(t, err)
+		assert.Equal(t, level, l)
+	}
+	_, err := ParseLevel("trace")
+	assert.Error(t, err)
+}
+
+func TestLogger(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, LevelInfo, "xml", nil)
+	assert.Error(t, err)
+
+	l, out := newTestLogger(t, LevelInfo, FormatJSON, &Redactor{})
+	l.Debug("hidden")
+	l.With(String("request", "r1")).Info("secret was issued",
+		Hash("secret", testHash),
+		Int("views", 2),
+		Any("latency", 1500*time.Millisecond),
+		Err(errors.New("some error")),
+	)
+	l.Warn("plain")
+	assert.Equal(t,
+		`{"time":"2020-02-01T10:10:10Z","level":"info","msg":"secret was issued","request":"r1","secret":"0123****","views":2,"latency":"1.5s","error":"some error"}`+"\n"+
+			`{"time":"2020-02-01T10:10:10Z","level":"warn","msg":"plain"}`+"\n",
+		out.String(),
+	)
+
+	l, out = newTestLogger(t, LevelDebug, FormatText, &Redactor{})
+	l.Debug("secret skipped", Hash("secret", testHash), String("error", "not found"), String("empty", ""))
+	assert.Equal(t, `2020-02-01T10:10:10Z DEBUG secret skipped secret=0123**** error="not found" empty=""`+"\n", out.String())
+}
+
+func TestRedactor(t *testing.T) {
+	_, err := NewRedactor("none", "")
+	assert.Error(t, err)
+
+	mask, err := NewRedactor(RedactMask, "")
+	require.NoError(t, err)
+	assert.Equal(t, "0123****", mask.Redact(testHash))
+	assert.Equal(t, "****", mask.Redact("short"))
+	assert.Equal(t, "", mask.Redact(""))
+
+	fp, err := NewRedactor(RedactFingerprint, "key")
+	require.NoError(t, err)
+	other, err := NewRedactor(RedactFingerprint, "other key")
+	require.NoError(t, err)
+	assert.Regexp(t, `^fp:[0-9a-f]{16}$`, fp.Redact(testHash))
+	assert.Equal(t, fp.Redact(testHash), fp.Redact(testHash))
+	assert.NotEqual(t, fp.Redact(testHash), fp.Redact(testHash[:16]))
+	assert.NotEqual(t, fp.Redact(testHash), other.Redact(testHash))
+
+	// random key without configuration
+	random, err := NewRedactor(RedactFingerprint, "")
+	require.NoError(t, err)
+	assert.NotEqual(t, fp.Redact(testHash), random.Redact(testHash))
+
+	assert.Equal(t, "/v1/secret/0123****/meta", mask.RedactPath("/v1/secret/"+testHash+"/meta", testHash))
+	assert.Equal(t, "/v1/secret/****", mask.RedactPath("/v1/secret/abc", "abc"))
+	assert.Equal(t, "/v1/secret/0123****/unknown", mask.RedactPath("/v1/secret/"+testHash+"/unknown"))
+	assert.Equal(t, "/metrics", mask.RedactPath("/metrics"))
+}
+
+func TestAccessLog(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	l, out := newTestLogger(t, LevelInfo, FormatJSON, &Redactor{})
+
+	router := gin.New()
+	router.Use(AccessLog(l), Recovery(l))
+	router.GET("/secret/:hash", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	router.GET("/panic/:hash", func(c *gin.Context) { panic("failure") })
+
+	for _, path := range []string{"/secret/" + testHash + "?passphrase=x", "/panic/abc", "/unknown/" + testHash} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		router.ServeHTTP(w, req)
+	}
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var rec map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		records = append(records, rec)
+	}
+	require.Len(t, records, 4)
+
+	assert.Equal(t, "request", records[0]["msg"])
+	assert.Equal(t, "/secret/0123****", records[0]["path"])
+	assert.Equal(t, float64(200), records[0]["status"])
+	assert.Equal(t, "info", records[0]["level"])
+
+	assert.Equal(t, "panic recovered", records[1]["msg"])
+	assert.Equal(t, "failure", records[1]["panic"])
+	assert.Equal(t, "/panic/****", records[2]["path"])
+	assert.Equal(t, float64(500), records[2]["status"])
+	assert.Equal(t, "error", records[2]["level"])
+
+	assert.Equal(t, "/unknown/0123****", records[3]["path"])
+	assert.Equal(t, float64(404), records[3]["status"])
+
+	assert.NotContains(t, out.String(), testHash)
+	assert.NotContains(t, out.String(), "passphrase")
+}
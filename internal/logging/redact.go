@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// redaction modes
+const (
+	RedactMask        = "mask"
+	RedactFingerprint = "fingerprint"
+)
+
+// maskPrefix is a number of characters kept by masking. It's too short to read or find a secret
+const maskPrefix = 4
+
+// minHashLength is a length of the shortest hash, a lookup id
+const minHashLength = 16
+
+// mask replaces the hidden part of a hash
+const mask = "****"
+
+// fingerprintLength is a number of hex characters of a fingerprint
+const fingerprintLength = 16
+
+// Redactor hides secret hashes and tokens in logs
+type Redactor struct {
+	// fingerprint key, masking is used without it
+	key []byte
+}
+
+// NewRedactor creates a redactor of the mode.
+//
+// Mask mode keeps only the first characters of a hash.
+// Fingerprint mode replaces a hash with a truncated HMAC-SHA256 of the key, so records of the same secret
+// can be correlated. Without a key, a random one is generated and fingerprints only match within the process.
+func NewRedactor(mode, key string) (*Redactor, error) {
+	switch mode {
+	case RedactMask:
+		return &Redactor{}, nil
+	case RedactFingerprint:
+		k := []byte(key)
+		if len(k) == 0 {
+			k = make([]byte, 32)
+			if _, err := rand.Read(k); err != nil {
+				return nil, err
+			}
+		}
+		return &Redactor{key: k}, nil
+	default:
+		return nil, fmt.Errorf("unknown log redaction mode %q, expected mask or fingerprint", mode)
+	}
+}
+
+// Redact returns a masked hash or its fingerprint
+func (r *Redactor) Redact(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	if r == nil || r.key == nil {
+		if len(hash) <= 2*maskPrefix {
+			return mask
+		}
+		return hash[:maskPrefix] + mask
+	}
+
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(hash))
+	return "fp:" + hex.EncodeToString(mac.Sum(nil))[:fingerprintLength]
+}
+
+// RedactPath redacts path segments that may contain secret hashes: the given values
+// of route parameters and any segment long enough to be a hash, even on unknown routes
+func (r *Redactor) RedactPath(path string, values ...string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		redact := len(seg) >= minHashLength
+		for _, v := range values {
+			redact = redact || (v != "" && seg == v)
+		}
+		if redact {
+			segments[i] = r.Redact(seg)
+		}
+	}
+	return strings.Join(segments, "/")
+}
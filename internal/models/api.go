@@ -18,6 +18,9 @@ import (
 type SecretResponse struct {
 	XMLName xml.Name `json:"-" xml:"Secret"`
 
+	// Content type of a file secret
+	ContentType string `json:"contentType,omitempty" xml:"contentType,omitempty"`
+
 	// The date and time of the creation
 	// Format: date-time
 	CreatedAt strfmt.DateTime `json:"createdAt,omitempty" xml:"createdAt,omitempty"`
@@ -26,14 +29,23 @@ type SecretResponse struct {
 	// Format: date-time
 	ExpiresAt *strfmt.DateTime `json:"expiresAt,omitempty" xml:"expiresAt,omitempty"`
 
+	// File name of a file secret
+	FileName string `json:"fileName,omitempty" xml:"fileName,omitempty"`
+
 	// Unique hash to identify the secrets
 	Hash string `json:"hash,omitempty" xml:"hash,omitempty"`
 
+	// Token to manage the secret, returned only on creation
+	ManageToken string `json:"manageToken,omitempty" xml:"manageToken,omitempty"`
+
 	// How many times the secret can be viewed
 	RemainingViews int32 `json:"remainingViews,omitempty" xml:"remainingViews,omitempty"`
 
 	// The secret itself
 	SecretText string `json:"secretText,omitempty" xml:"secretText,omitempty"`
+
+	// File size of a file secret in bytes
+	Size int64 `json:"size,omitempty" xml:"size,omitempty"`
 }
 
 // Validate validates this secret
@@ -1,17 +1,83 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
-//SecretBase is a secret database model
+// chunkSeparator separates a secret hash from the chunk index. Secret hashes and tenant names never contain it
+const chunkSeparator = "."
+
+// tombstoneSuffix marks a tombstone of a deleted secret. Secret hashes, tenant names and chunk ids never contain it
+const tombstoneSuffix = "~"
+
+// TombstoneRetention is how long tombstones of secrets without expiration time are kept
+const TombstoneRetention = 7 * 24 * time.Hour
+
+// SecretBase is a secret database model
 type SecretBase struct {
 	CreatedAt      time.Time  `json:"createdAt"`
 	ExpiresAt      *time.Time `json:"expiresAt"`
 	RemainingViews int32      `json:"remainingViews"`
 	SecretText     string     `json:"secretText"`
+	KeyHash        string     `json:"keyHash,omitempty"`
+	DataKey        string     `json:"dataKey,omitempty"`
+	KeyID          string     `json:"keyId,omitempty"`
+
+	PassphraseSalt  string `json:"passphraseSalt,omitempty"`
+	PassphraseCheck string `json:"passphraseCheck,omitempty"`
+	FailedAttempts  int32  `json:"failedAttempts,omitempty"`
+
+	ManageHash string `json:"manageHash,omitempty"`
+	MaxViews   int32  `json:"maxViews,omitempty"`
+
+	NotifyURL string `json:"notifyUrl,omitempty"`
+
+	FileName    string `json:"fileName,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	FileSize    int64  `json:"fileSize,omitempty"`
+	Chunks      int32  `json:"chunks,omitempty"`
+
+	// State and deletion time of a tombstone, they are empty for secrets
+	State     string     `json:"state,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
-//Secret is a secret database model with persistence version tag
+// Secret is a secret database model with persistence version tag
 type Secret struct {
 	SecretBase
 	Version int64
 }
+
+// ChunkID returns a database id of a file chunk of the secret
+func ChunkID(hash string, idx int) string {
+	return fmt.Sprintf("%s%s%d", hash, chunkSeparator, idx)
+}
+
+// IsChunk checks if the database id belongs to a file chunk rather than to a secret.
+//
+// Chunks are stored next to secrets, so database scans must skip them where only secrets matter.
+func IsChunk(hash string) bool {
+	return strings.Contains(hash, chunkSeparator)
+}
+
+// TombstoneID returns a database id of a tombstone of the secret
+func TombstoneID(hash string) string {
+	return hash + tombstoneSuffix
+}
+
+// IsTombstone checks if the database id belongs to a tombstone of a deleted secret
+func IsTombstone(hash string) bool {
+	return strings.HasSuffix(hash, tombstoneSuffix)
+}
+
+// TombstoneOutdated checks if the tombstone outlived the expiration time of its secret.
+//
+// Tombstones of secrets without expiration time are kept for TombstoneRetention after the deletion.
+func TombstoneOutdated(s *SecretBase, now time.Time) bool {
+	if s.ExpiresAt != nil {
+		return now.After(*s.ExpiresAt)
+	}
+	return s.DeletedAt == nil || now.After(s.DeletedAt.Add(TombstoneRetention))
+}
@@ -0,0 +1,26 @@
+package models
+
+import "encoding/xml"
+
+// ErrorResponse is an API error
+type ErrorResponse struct {
+	XMLName xml.Name `json:"-" xml:"Error"`
+
+	// Stable error code
+	Code string `json:"code" xml:"code"`
+
+	// Human-readable error description
+	Message string `json:"message" xml:"message"`
+
+	// Error details, e.g. invalid request fields
+	Details []ErrorDetail `json:"details,omitempty" xml:"detail,omitempty"`
+}
+
+// ErrorDetail is a detailed description of an error cause
+type ErrorDetail struct {
+	// Request field name
+	Field string `json:"field,omitempty" xml:"field,omitempty"`
+
+	// Cause description
+	Message string `json:"message" xml:"message"`
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"encoding/xml"
+
+	strfmt "github.com/go-openapi/strfmt"
+)
+
+// SecretMeta is a secret state returned without consuming a view
+type SecretMeta struct {
+	XMLName xml.Name `json:"-" xml:"SecretMeta"`
+
+	// The date and time of the creation
+	CreatedAt strfmt.DateTime `json:"createdAt" xml:"createdAt"`
+
+	// The secret cannot be reached after this time
+	ExpiresAt *strfmt.DateTime `json:"expiresAt,omitempty" xml:"expiresAt,omitempty"`
+
+	// How many times the secret can be viewed
+	RemainingViews int32 `json:"remainingViews" xml:"remainingViews"`
+
+	// Whether the secret can still be read
+	Readable bool `json:"readable" xml:"readable"`
+
+	// Whether the secret requires a passphrase to be read
+	PassphraseRequired bool `json:"passphraseRequired" xml:"passphraseRequired"`
+
+	// Whether the secret is a file
+	File bool `json:"file,omitempty" xml:"file,omitempty"`
+
+	// File size of a file secret in bytes
+	Size int64 `json:"size,omitempty" xml:"size,omitempty"`
+}
+
+// SecretStatus is a secret state visible to its creator
+type SecretStatus struct {
+	XMLName xml.Name `json:"-" xml:"SecretStatus"`
+
+	// The date and time of the creation
+	CreatedAt strfmt.DateTime `json:"createdAt" xml:"createdAt"`
+
+	// The secret cannot be reached after this time
+	ExpiresAt *strfmt.DateTime `json:"expiresAt,omitempty" xml:"expiresAt,omitempty"`
+
+	// How many times the secret can be viewed
+	RemainingViews int32 `json:"remainingViews" xml:"remainingViews"`
+
+	// How many times the secret was viewed
+	Views int32 `json:"views" xml:"views"`
+
+	// Whether the secret can still be read
+	Readable bool `json:"readable" xml:"readable"`
+
+	// State of the secret: active, expired, read, burned or revoked
+	State string `json:"state" xml:"state"`
+}
+
+// secret states
+const (
+	StateActive  = "active"
+	StateExpired = "expired"
+	// all views were used up
+	StateRead = "read"
+	// deleted after wrong passphrase attempts
+	StateBurned  = "burned"
+	StateRevoked = "revoked"
+)
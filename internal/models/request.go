@@ -0,0 +1,71 @@
+package models
+
+import (
+	"encoding/json"
+	"encoding/xml"
+)
+
+// SecretRequest is a body of a secret creation request.
+//
+// Field names are the same as form field names, so every encoding is validated the same way.
+// JSON and XML bodies may also use names of SecretResponse fields having the same meaning.
+type SecretRequest struct {
+	XMLName xml.Name `json:"-" xml:"Secret"`
+
+	// This text will be saved as a secret
+	Secret string `json:"secret" xml:"secret"`
+
+	// Alias of Secret named as in SecretResponse
+	SecretText string `json:"secretText,omitempty" xml:"secretText,omitempty"`
+
+	// The secret won't be available after the given number of views
+	ExpireAfterViews RawValue `json:"expireAfterViews" xml:"expireAfterViews"`
+
+	// Alias of ExpireAfterViews named as in SecretResponse
+	RemainingViews RawValue `json:"remainingViews,omitempty" xml:"remainingViews,omitempty"`
+
+	// The secret won't be available after the given time in minutes
+	ExpireAfter RawValue `json:"expireAfter" xml:"expireAfter"`
+
+	// Optional passphrase required to read the secret
+	Passphrase string `json:"passphrase,omitempty" xml:"passphrase,omitempty"`
+
+	// Optional URL receiving secret lifecycle events
+	NotifyURL string `json:"notifyUrl,omitempty" xml:"notifyUrl,omitempty"`
+}
+
+// ResolveAliases sets fields missing in the request from their aliases
+func (r *SecretRequest) ResolveAliases() {
+	if r.Secret == "" {
+		r.Secret = r.SecretText
+	}
+	if r.ExpireAfterViews == "" {
+		r.ExpireAfterViews = r.RemainingViews
+	}
+}
+
+// RawValue is a request value kept as text to be parsed the same way as a form value.
+//
+// In JSON it can be set as a number or a string.
+type RawValue string
+
+// UnmarshalJSON interface implementation
+func (v *RawValue) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*v = RawValue(str)
+		return nil
+	}
+
+	var num json.Number
+	if err := json.Unmarshal(b, &num); err != nil {
+		return err
+	}
+	*v = RawValue(num.String())
+	return nil
+}
+
+// String returns the value as text
+func (v RawValue) String() string {
+	return string(v)
+}
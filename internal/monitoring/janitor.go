@@ -0,0 +1,101 @@
+package monitoring
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// JanitorMetrics is a set of Prometheus metrics of expired secret sweeps
+type JanitorMetrics struct {
+	sweepCounter   prometheus.Counter
+	scannedCounter prometheus.Counter
+	deletedCounter prometheus.Counter
+	errorCounter   prometheus.Counter
+	sweepTimeGauge prometheus.Gauge
+	lastSweepGauge prometheus.Gauge
+}
+
+// NewJanitorMetrics creates metrics for the janitor and registers them in reg
+func NewJanitorMetrics(reg prometheus.Registerer) *JanitorMetrics {
+	cl := map[string]string{
+		"ip": getLocalIP(),
+	}
+
+	m := &JanitorMetrics{
+		sweepCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "janitor",
+				Name:        "sweep_number",
+				Help:        "Number of finished sweeps",
+				ConstLabels: cl,
+			},
+		),
+
+		scannedCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "janitor",
+				Name:        "scanned_number",
+				Help:        "Number of secrets checked by sweeps",
+				ConstLabels: cl,
+			},
+		),
+
+		deletedCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "janitor",
+				Name:        "deleted_number",
+				Help:        "Number of expired and exhausted secrets deleted by sweeps",
+				ConstLabels: cl,
+			},
+		),
+
+		errorCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "janitor",
+				Name:        "error_number",
+				Help:        "Number of failed sweeps",
+				ConstLabels: cl,
+			},
+		),
+
+		sweepTimeGauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   "secret",
+				Subsystem:   "janitor",
+				Name:        "sweep_time_ms",
+				Help:        "Duration of the last sweep in milliseconds",
+				ConstLabels: cl,
+			},
+		),
+
+		lastSweepGauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   "secret",
+				Subsystem:   "janitor",
+				Name:        "last_sweep_timestamp_seconds",
+				Help:        "Unix time of the last finished sweep",
+				ConstLabels: cl,
+			},
+		),
+	}
+	reg.MustRegister(m.sweepCounter, m.scannedCounter, m.deletedCounter, m.errorCounter, m.sweepTimeGauge, m.lastSweepGauge)
+	return m
+}
+
+// ObserveSweep reports progress of a finished sweep
+func (m *JanitorMetrics) ObserveSweep(scanned, deleted int, duration time.Duration, err error) {
+	if err != nil {
+		m.errorCounter.Inc()
+	}
+	m.sweepCounter.Inc()
+	m.scannedCounter.Add(float64(scanned))
+	m.deletedCounter.Add(float64(deleted))
+	// nanosec to millisec
+	m.sweepTimeGauge.Set(float64(duration.Nanoseconds()) / 1000000.0)
+	m.lastSweepGauge.SetToCurrentTime()
+}
@@ -6,12 +6,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-// MetricsMiddleware adds Prometheus monitoring to the endpoint handler
-func MetricsMiddleware(hf gin.HandlerFunc, endpoint string) gin.HandlerFunc {
-	ms := NewMetricSet(endpoint)
+// MetricsMiddleware adds Prometheus monitoring to the endpoint handler, the metrics are registered in reg
+func MetricsMiddleware(reg prometheus.Registerer, hf gin.HandlerFunc, endpoint string) gin.HandlerFunc {
+	ms := NewMetricSet(reg, endpoint)
 
 	return func(c *gin.Context) {
 		start := time.Now()
@@ -33,8 +32,8 @@ type MetricSet struct {
 	responceTimeQuantile prometheus.Summary
 }
 
-// NewMetricSet creates a metric for an endpoint
-func NewMetricSet(endpoint string) *MetricSet {
+// NewMetricSet creates a metric for an endpoint and registers it in reg
+func NewMetricSet(reg prometheus.Registerer, endpoint string) *MetricSet {
 	cl := map[string]string{
 		"ip":       getLocalIP(),
 		"endpoint": endpoint,
@@ -43,7 +42,7 @@ func NewMetricSet(endpoint string) *MetricSet {
 	ms := MetricSet{
 		endpointName: endpoint,
 
-		requestCounter: promauto.NewCounter(
+		requestCounter: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace:   "secret",
 				Name:        "request_number",
@@ -52,7 +51,7 @@ func NewMetricSet(endpoint string) *MetricSet {
 			},
 		),
 
-		responceTimeGauge: promauto.NewGauge(
+		responceTimeGauge: prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Namespace:   "secret",
 				Name:        "request_processing_time_ms",
@@ -61,7 +60,7 @@ func NewMetricSet(endpoint string) *MetricSet {
 			},
 		),
 
-		responceTimeQuantile: promauto.NewSummary(
+		responceTimeQuantile: prometheus.NewSummary(
 			prometheus.SummaryOpts{
 				Namespace:   "secret",
 				Name:        "request_processing_time_summary_ms",
@@ -75,6 +74,7 @@ func NewMetricSet(endpoint string) *MetricSet {
 			},
 		),
 	}
+	reg.MustRegister(ms.requestCounter, ms.responceTimeGauge, ms.responceTimeQuantile)
 
 	return &ms
 }
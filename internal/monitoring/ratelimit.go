@@ -0,0 +1,37 @@
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimitMetrics is a set of Prometheus metrics of rate limiting
+type RateLimitMetrics struct {
+	rejectCounter *prometheus.CounterVec
+}
+
+// NewRateLimitMetrics creates metrics for the rate limiter and registers them in reg
+func NewRateLimitMetrics(reg prometheus.Registerer) *RateLimitMetrics {
+	cl := map[string]string{
+		"ip": getLocalIP(),
+	}
+
+	m := &RateLimitMetrics{
+		rejectCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "ratelimit",
+				Name:        "rejected_number",
+				Help:        "Number of requests rejected by rate limits",
+				ConstLabels: cl,
+			},
+			[]string{"endpoint"},
+		),
+	}
+	reg.MustRegister(m.rejectCounter)
+	return m
+}
+
+// ObserveReject reports a request rejected by the endpoint rate limit
+func (m *RateLimitMetrics) ObserveReject(endpoint string) {
+	m.rejectCounter.WithLabelValues(endpoint).Inc()
+}
@@ -0,0 +1,45 @@
+package monitoring
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TenantMetrics is a set of Prometheus metrics of API requests per tenant
+type TenantMetrics struct {
+	requestCounter *prometheus.CounterVec
+	tenantFunc     func(c *gin.Context) string
+}
+
+// NewTenantMetrics creates metrics of tenants identified by tenantFunc and registers them in reg
+func NewTenantMetrics(reg prometheus.Registerer, tenantFunc func(c *gin.Context) string) *TenantMetrics {
+	cl := map[string]string{
+		"ip": getLocalIP(),
+	}
+
+	m := &TenantMetrics{
+		requestCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "tenant",
+				Name:        "request_number",
+				Help:        "Number of API endpoint requests per tenant and response status",
+				ConstLabels: cl,
+			},
+			[]string{"endpoint", "tenant", "status"},
+		),
+		tenantFunc: tenantFunc,
+	}
+	reg.MustRegister(m.requestCounter)
+	return m
+}
+
+// Middleware counts requests of tenants to the endpoint. Requests without a tenant have an empty tenant label
+func (m *TenantMetrics) Middleware(hf gin.HandlerFunc, endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hf(c)
+		m.requestCounter.WithLabelValues(endpoint, m.tenantFunc(c), strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
@@ -0,0 +1,54 @@
+package monitoring
+
+import (
+	"github.com/ilyakaznacheev/secret/internal/webhook"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WebhookMetrics is a set of Prometheus metrics of webhook deliveries
+type WebhookMetrics struct {
+	deliveredCounter *prometheus.CounterVec
+	deadCounter      *prometheus.CounterVec
+}
+
+// NewWebhookMetrics creates metrics for the webhook dispatcher and registers them in reg
+func NewWebhookMetrics(reg prometheus.Registerer) *WebhookMetrics {
+	cl := map[string]string{
+		"ip": getLocalIP(),
+	}
+
+	m := &WebhookMetrics{
+		deliveredCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "webhook",
+				Name:        "delivered_number",
+				Help:        "Number of delivered webhook events",
+				ConstLabels: cl,
+			},
+			[]string{"event"},
+		),
+
+		deadCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "secret",
+				Subsystem:   "webhook",
+				Name:        "dead_letter_number",
+				Help:        "Number of webhook events not delivered after all attempts",
+				ConstLabels: cl,
+			},
+			[]string{"event"},
+		),
+	}
+	reg.MustRegister(m.deliveredCounter, m.deadCounter)
+	return m
+}
+
+// ObserveDelivery reports a delivered event or a dead letter
+func (m *WebhookMetrics) ObserveDelivery(dl webhook.Delivery, delivered bool) {
+	if delivered {
+		m.deliveredCounter.WithLabelValues(string(dl.Event.Type)).Inc()
+		return
+	}
+	m.deadCounter.WithLabelValues(string(dl.Event.Type)).Inc()
+}
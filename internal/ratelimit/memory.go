@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// cleanupInterval is a number of takes between removals of full buckets
+const cleanupInterval = 1000
+
+// MemoryStore keeps token buckets in memory of a single replica
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// period to refill the whole bucket
+	period time.Duration
+}
+
+// NewMemoryStore creates a new in-memory token bucket store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take takes a token from the bucket with capacity limit refilled every period.
+//
+// Returns the number of remaining tokens and false if the bucket is empty.
+func (m *MemoryStore) Take(key string, limit int, period time.Duration, now time.Time) (int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.takes++
+	if m.takes%cleanupInterval == 0 {
+		m.cleanup(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit), last: now, period: period}
+		m.buckets[key] = b
+	}
+
+	if now.After(b.last) {
+		refill := float64(now.Sub(b.last)) / float64(period) * float64(limit)
+		b.tokens = math.Min(float64(limit), b.tokens+refill)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return int(b.tokens), false, nil
+	}
+	b.tokens--
+	return int(b.tokens), true, nil
+}
+
+// cleanup removes buckets refilled completely, they are the same as new ones
+func (m *MemoryStore) cleanup(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.last) >= b.period {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Package ratelimit limits the request rate of API endpoints per client.
+
+Every endpoint has its own limit, applied to every client separately with a token bucket.
+Buckets are stored in memory for a single replica or in Redis to be shared by a cluster.
+*/
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/clientip"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+// CodeRateLimited is an API error code of rejected requests
+const CodeRateLimited = "rate_limited"
+
+// response headers
+const (
+	HeaderLimit      = "RateLimit-Limit"
+	HeaderRemaining  = "RateLimit-Remaining"
+	HeaderReset      = "RateLimit-Reset"
+	HeaderRetryAfter = "Retry-After"
+)
+
+// Rule is a rate limit of an endpoint: Limit requests per Period.
+//
+// The limit is also the burst size, spent tokens are refilled continuously.
+type Rule struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRule parses a rule in format <limit>/<period>, e.g. 10/s, 60/m, 1000/h or 100/30s
+func ParseRule(str string) (Rule, error) {
+	parts := strings.Split(strings.TrimSpace(str), "/")
+	if len(parts) != 2 {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, must be in format <limit>/<period>", str)
+	}
+
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, limit must be a positive integer", str)
+	}
+
+	var period time.Duration
+	switch parts[1] {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		period, err = time.ParseDuration(parts[1])
+		if err != nil || period <= 0 {
+			return Rule{}, fmt.Errorf("invalid rate limit %q, period must be s, m, h or a positive duration", str)
+		}
+	}
+
+	return Rule{Limit: limit, Period: period}, nil
+}
+
+// ParseRules parses named rules, e.g. rules of endpoints
+func ParseRules(rules map[string]string) (map[string]Rule, error) {
+	res := make(map[string]Rule, len(rules))
+	for name, str := range rules {
+		rule, err := ParseRule(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		res[name] = rule
+	}
+	return res, nil
+}
+
+// KeyFunc returns a key identifying the client of the request
+type KeyFunc func(c *gin.Context) string
+
+// ClientIP identifies clients by their IP address resolved by clientip.Resolver
+func ClientIP(c *gin.Context) string {
+	return "ip:" + clientip.FromContext(c)
+}
+
+// Limiter limits the request rate of endpoints
+type Limiter struct {
+	store    Store
+	rules    map[string]Rule
+	keyFunc  KeyFunc
+	observer Observer
+
+	nowFunc func() time.Time
+}
+
+// New creates a new rate limiter with rules per endpoint.
+//
+// Endpoints without a rule aren't limited.
+// If keyFunc is nil, clients are identified by IP address.
+// If observer is nil, rejects are only logged.
+func New(store Store, rules map[string]Rule, keyFunc KeyFunc, observer Observer) *Limiter {
+	if keyFunc == nil {
+		keyFunc = ClientIP
+	}
+	return &Limiter{
+		store:    store,
+		rules:    rules,
+		keyFunc:  keyFunc,
+		observer: observer,
+		nowFunc:  time.Now,
+	}
+}
+
+// Middleware adds rate limiting to the endpoint handler.
+//
+// Limited responses carry RateLimit-* headers. Requests over the limit are rejected with 429.
+func (l *Limiter) Middleware(hf gin.HandlerFunc, endpoint string) gin.HandlerFunc {
+	rule, ok := l.rules[endpoint]
+	if !ok {
+		return hf
+	}
+
+	return func(c *gin.Context) {
+		if l.limit(c, endpoint, endpoint+":"+l.keyFunc(c), rule) {
+			hf(c)
+		}
+	}
+}
+
+// QuotaFunc returns a bucket key and a rule of the request client, or false if the client has no quota
+type QuotaFunc func(c *gin.Context) (key string, rule Rule, ok bool)
+
+// QuotaMiddleware adds per-client rate limiting to the endpoint handler.
+//
+// Unlike Middleware, every client can have its own rule, e.g. a quota of its tenant.
+func (l *Limiter) QuotaMiddleware(hf gin.HandlerFunc, endpoint string, quota QuotaFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, rule, ok := quota(c)
+		if !ok || l.limit(c, endpoint, "quota:"+endpoint+":"+key, rule) {
+			hf(c)
+		}
+	}
+}
+
+// limit takes a token of the request and sets rate limit headers.
+//
+// Returns false if the request was rejected.
+// If the bucket store fails, requests are let through, so the API stays available.
+func (l *Limiter) limit(c *gin.Context, endpoint, key string, rule Rule) bool {
+	remaining, ok, err := l.store.Take(key, rule.Limit, rule.Period, l.nowFunc())
+	if err != nil {
+		logging.Error("rate limit can't be checked", logging.String("endpoint", endpoint), logging.Err(err))
+		return true
+	}
+
+	// time to refill a single token and the whole bucket
+	tokenTime := rule.Period / time.Duration(rule.Limit)
+	c.Header(HeaderLimit, strconv.Itoa(rule.Limit))
+	c.Header(HeaderRemaining, strconv.Itoa(remaining))
+	c.Header(HeaderReset, seconds(tokenTime*time.Duration(rule.Limit-remaining)))
+
+	if ok {
+		return true
+	}
+
+	if l.observer != nil {
+		l.observer.ObserveReject(endpoint)
+	}
+	c.Header(HeaderRetryAfter, seconds(tokenTime))
+	res := models.ErrorResponse{
+		Code:    CodeRateLimited,
+		Message: "too many requests, try again later",
+	}
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEXML) == gin.MIMEXML {
+		c.XML(http.StatusTooManyRequests, &res)
+	} else {
+		c.JSON(http.StatusTooManyRequests, &res)
+	}
+	c.Abort()
+	return false
+}
+
+// seconds formats the duration as a number of seconds rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Store keeps token buckets of clients
+type Store interface {
+	// Take takes a token from the bucket with capacity limit refilled every period.
+	// Returns the number of remaining tokens and false if the bucket is empty.
+	Take(key string, limit int, period time.Duration, now time.Time) (int, bool, error)
+}
+
+// Observer receives rate limit rejects
+type Observer interface {
+	ObserveReject(endpoint string)
+}
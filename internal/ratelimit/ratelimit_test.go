@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    Rule
+		wantErr bool
+	}{
+		{str: "10/s", want: Rule{Limit: 10, Period: time.Second}},
+		{str: "60/m", want: Rule{Limit: 60, Period: time.Minute}},
+		{str: " 1000/h ", want: Rule{Limit: 1000, Period: time.Hour}},
+		{str: "100/30s", want: Rule{Limit: 100, Period: 30 * time.Second}},
+		{str: "10", wantErr: true},
+		{str: "0/m", wantErr: true},
+		{str: "ten/m", wantErr: true},
+		{str: "10/day", wantErr: true},
+		{str: "10/-1s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := ParseRule(tt.str)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	m := NewMemoryStore()
+	now := time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC)
+
+	for i := 2; i >= 0; i-- {
+		remaining, ok, err := m.Take("client", 3, time.Minute, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, i, remaining)
+	}
+	_, ok, _ := m.Take("client", 3, time.Minute, now)
+	assert.False(t, ok)
+
+	// other clients have their own buckets
+	_, ok, _ = m.Take("other", 3, time.Minute, now)
+	assert.True(t, ok)
+
+	// a token is refilled every 20 seconds
+	_, ok, _ = m.Take("client", 3, time.Minute, now.Add(10*time.Second))
+	assert.False(t, ok)
+	remaining, ok, _ := m.Take("client", 3, time.Minute, now.Add(20*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 0, remaining)
+
+	// full buckets are removed
+	m.cleanup(now.Add(time.Hour))
+	assert.Empty(t, m.buckets)
+}
+
+type testObserver struct {
+	rejects map[string]int
+}
+
+func (o *testObserver) ObserveReject(endpoint string) {
+	o.rejects[endpoint]++
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(string, int, time.Duration, time.Time) (int, bool, error) {
+	return 0, false, errors.New("connection refused")
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	now := time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC)
+
+	obs := &testObserver{rejects: map[string]int{}}
+	l := New(NewMemoryStore(), map[string]Rule{
+		"limited": {Limit: 2, Period: time.Minute},
+	}, nil, obs)
+	l.nowFunc = func() time.Time { return now }
+
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router := gin.New()
+	router.GET("/limited", l.Middleware(ok, "limited"))
+	router.GET("/free", l.Middleware(ok, "free"))
+
+	get := func(path, ip, accept string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":12345"
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/limited", "10.0.0.1", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderLimit))
+	assert.Equal(t, "1", w.Header().Get(HeaderRemaining))
+	assert.Equal(t, "30", w.Header().Get(HeaderReset))
+
+	w = get("/limited", "10.0.0.1", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "0", w.Header().Get(HeaderRemaining))
+	assert.Equal(t, "60", w.Header().Get(HeaderReset))
+
+	w = get("/limited", "10.0.0.1", "")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "0", w.Header().Get(HeaderRemaining))
+	assert.Equal(t, "30", w.Header().Get(HeaderRetryAfter))
+	assert.Equal(t, `{"code":"rate_limited","message":"too many requests, try again later"}`, w.Body.String())
+
+	w = get("/limited", "10.0.0.1", "application/xml")
+	assert.Equal(t, 429, w.Code)
+	assert.Contains(t, w.Body.String(), "<code>rate_limited</code>")
+	assert.Equal(t, 2, obs.rejects["limited"])
+
+	// clients are limited separately
+	assert.Equal(t, 200, get("/limited", "10.0.0.2", "").Code)
+
+	// endpoints without rules aren't limited
+	for i := 0; i < 5; i++ {
+		w = get("/free", "10.0.0.1", "")
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, w.Header().Get(HeaderLimit))
+	}
+
+	// tokens are refilled
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, 200, get("/limited", "10.0.0.1", "").Code)
+
+	// store errors don't block requests
+	l.store = failingStore{}
+	assert.Equal(t, 200, get("/limited", "10.0.0.1", "").Code)
+}
+
+func TestLimiter_QuotaMiddleware(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	now := time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC)
+
+	obs := &testObserver{rejects: map[string]int{}}
+	l := New(NewMemoryStore(), nil, nil, obs)
+	l.nowFunc = func() time.Time { return now }
+
+	quota := func(c *gin.Context) (string, Rule, bool) {
+		switch client := c.GetHeader("X-Client"); client {
+		case "small":
+			return client, Rule{Limit: 1, Period: time.Hour}, true
+		case "large":
+			return client, Rule{Limit: 3, Period: time.Hour}, true
+		default:
+			return "", Rule{}, false
+		}
+	}
+
+	router := gin.New()
+	router.POST("/", l.QuotaMiddleware(func(c *gin.Context) { c.Status(http.StatusOK) }, "create", quota))
+
+	post := func(client string) int {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, post("small"))
+	assert.Equal(t, 429, post("small"))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, post("large"))
+	}
+	assert.Equal(t, 429, post("large"))
+	assert.Equal(t, 2, obs.rejects["create"])
+
+	// clients without a quota aren't limited
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 200, post(""))
+	}
+}
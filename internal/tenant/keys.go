@@ -0,0 +1,258 @@
+package tenant
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/logging"
+)
+
+const (
+	// keyLength is a number of random bytes of an API key
+	keyLength = 32
+	// reloadInterval is a minimal interval between checks of key file changes
+	reloadInterval = 10 * time.Second
+)
+
+var (
+	// ErrKeyNotFound API key doesn't exist
+	ErrKeyNotFound = errors.New("API key not found")
+	// ErrKeyExists API key with the same name already exists
+	ErrKeyExists = errors.New("API key already exists")
+)
+
+// Key is an API key of a tenant. Only the key hash is stored
+type Key struct {
+	Tenant string
+	Name   string
+	Hash   string
+}
+
+// KeyFile is a set of API keys stored in a file.
+//
+// Every key is defined on a separate line as "tenant:name:sha256hex".
+// Changes of the file made by other processes are picked up without a restart.
+type KeyFile struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[string]Key
+	modTime time.Time
+	checked time.Time
+
+	nowFunc func() time.Time
+}
+
+// LoadKeyFile reads API keys from the file. A missing file has no keys
+func LoadKeyFile(path string) (*KeyFile, error) {
+	f := &KeyFile{
+		path:    path,
+		keys:    make(map[string]Key),
+		nowFunc: time.Now,
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Lookup returns a key by its plain value
+func (f *KeyFile) Lookup(key string) (Key, bool) {
+	f.reload()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	k, ok := f.keys[hashKey(key)]
+	return k, ok
+}
+
+// Keys returns all keys sorted by tenant and name
+func (f *KeyFile) Keys() []Key {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.sorted()
+}
+
+// sorted returns all keys sorted by tenant and name, the caller must hold the lock
+func (f *KeyFile) sorted() []Key {
+	keys := make([]Key, 0, len(f.keys))
+	for _, k := range f.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Tenant != keys[j].Tenant {
+			return keys[i].Tenant < keys[j].Tenant
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
+
+// Tenants returns sorted names of tenants having keys.
+//
+// The file is read again if it was changed, so tenants added by another process are returned too.
+func (f *KeyFile) Tenants() []string {
+	f.reload()
+
+	var tenants []string
+	for _, k := range f.Keys() {
+		if len(tenants) == 0 || tenants[len(tenants)-1] != k.Tenant {
+			tenants = append(tenants, k.Tenant)
+		}
+	}
+	return tenants
+}
+
+// Create generates a new named key of the tenant and saves it to the file.
+//
+// Returns the plain key value, it can't be restored later.
+func (f *KeyFile) Create(tenant, name string) (string, error) {
+	if !ValidName(tenant) {
+		return "", fmt.Errorf("invalid tenant name %q", tenant)
+	}
+	if !ValidName(name) {
+		return "", fmt.Errorf("invalid key name %q", name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, k := range f.keys {
+		if k.Tenant == tenant && k.Name == name {
+			return "", fmt.Errorf("%v: %s:%s", ErrKeyExists, tenant, name)
+		}
+	}
+
+	buf := make([]byte, keyLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(buf)
+
+	k := Key{Tenant: tenant, Name: name, Hash: hashKey(key)}
+	f.keys[k.Hash] = k
+	if err := f.save(); err != nil {
+		delete(f.keys, k.Hash)
+		return "", err
+	}
+	return key, nil
+}
+
+// Revoke deletes a named key of the tenant from the file
+func (f *KeyFile) Revoke(tenant, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for hash, k := range f.keys {
+		if k.Tenant == tenant && k.Name == name {
+			delete(f.keys, hash)
+			if err := f.save(); err != nil {
+				f.keys[hash] = k
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: %s:%s", ErrKeyNotFound, tenant, name)
+}
+
+// reload reads the file again if it was changed since the last read
+func (f *KeyFile) reload() {
+	now := f.nowFunc()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.checked) < reloadInterval {
+		return
+	}
+	f.checked = now
+
+	info, err := os.Stat(f.path)
+	if err == nil && info.ModTime().Equal(f.modTime) {
+		return
+	}
+	if err := f.load(); err != nil {
+		// keep the previous keys until the file is fixed
+		logging.Error("API key file can't be reloaded", logging.String("path", f.path), logging.Err(err))
+	}
+}
+
+// load reads the file, the caller must hold the write lock
+func (f *KeyFile) load() error {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		f.keys = make(map[string]Key)
+		f.modTime = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]Key)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || !ValidName(parts[0]) || !ValidName(parts[1]) || len(parts[2]) != sha256.Size*2 {
+			return fmt.Errorf("wrong key format, expected tenant:name:sha256hex")
+		}
+		keys[parts[2]] = Key{Tenant: parts[0], Name: parts[1], Hash: parts[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.keys = keys
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// save writes keys to the file atomically, the caller must hold the write lock
+func (f *KeyFile) save() error {
+	var b strings.Builder
+	b.WriteString("# API keys in format tenant:name:sha256hex, managed by the api-key command\n")
+	for _, k := range f.sorted() {
+		fmt.Fprintf(&b, "%s:%s:%s\n", k.Tenant, k.Name, k.Hash)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// hashKey returns a hex encoded SHA-256 hash of the key
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,78 @@
+package tenant
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	// missing file has no keys
+	f, err := LoadKeyFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, f.Keys())
+
+	ci, err := f.Create("acme", "ci")
+	require.NoError(t, err)
+	ops, err := f.Create("acme", "ops")
+	require.NoError(t, err)
+	_, err = f.Create("beta", "ci")
+	require.NoError(t, err)
+
+	_, err = f.Create("acme", "ci")
+	assert.Error(t, err)
+	_, err = f.Create("Acme:1", "ci")
+	assert.Error(t, err)
+
+	k, ok := f.Lookup(ci)
+	assert.True(t, ok)
+	assert.Equal(t, Key{Tenant: "acme", Name: "ci", Hash: hashKey(ci)}, k)
+	_, ok = f.Lookup("unknown")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"acme", "beta"}, f.Tenants())
+
+	// only key hashes are stored
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), ci)
+	assert.Contains(t, string(data), "acme:ci:"+hashKey(ci))
+
+	// changes made by another process are picked up after the reload interval
+	now := time.Now()
+	f.nowFunc = func() time.Time { return now }
+	other, err := LoadKeyFile(path)
+	require.NoError(t, err)
+	require.NoError(t, other.Revoke("acme", "ops"))
+	assert.Error(t, other.Revoke("acme", "ops"))
+	// make sure the modification time differs on file systems with a coarse resolution
+	require.NoError(t, os.Chtimes(path, now, now.Add(time.Second)))
+
+	_, ok = f.Lookup(ops)
+	assert.True(t, ok)
+	now = now.Add(reloadInterval)
+	_, ok = f.Lookup(ops)
+	assert.False(t, ok)
+	_, ok = f.Lookup(ci)
+	assert.True(t, ok)
+}
+
+func TestLoadKeyFile_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("acme:ci:not-a-hash\n"), 0600))
+	_, err = LoadKeyFile(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,192 @@
+/*
+Package tenant isolates teams sharing one service instance.
+
+Clients authenticate with API keys, every key belongs to a tenant. Secrets of a tenant are stored in its own
+database namespace, and tokens of such secrets are prefixed with the tenant name, so they can be read
+without the API key when it isn't required.
+*/
+package tenant
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/clientip"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/ratelimit"
+)
+
+// KeyHeader is a request header with the API key
+const KeyHeader = "X-API-Key"
+
+// API error codes of authentication
+const (
+	CodeAPIKeyRequired = "api_key_required"
+	CodeInvalidAPIKey  = "invalid_api_key"
+)
+
+const (
+	// contextKey is a request context key of the tenant name
+	contextKey = "tenant"
+	// keyContextKey is a request context key of the API key name
+	keyContextKey = "tenant_key"
+	// tokenSeparator separates the tenant name from a secret token
+	tokenSeparator = "."
+)
+
+// validName is a pattern of tenant and key names
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidName checks if the name can be used as a tenant or key name
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// FromContext returns the tenant of the authenticated request, or an empty string
+func FromContext(c *gin.Context) string {
+	return c.GetString(contextKey)
+}
+
+// KeyFromContext returns the API key name of the authenticated request, or an empty string
+func KeyFromContext(c *gin.Context) string {
+	return c.GetString(keyContextKey)
+}
+
+// ClientKey identifies rate limited clients by their API key, or by IP address without one.
+//
+// Requests must be authenticated before they are rate limited, so clients behind one address have their own buckets.
+func ClientKey(c *gin.Context) string {
+	if key := KeyFromContext(c); key != "" {
+		return "key:" + FromContext(c) + "/" + key
+	}
+	return ratelimit.ClientIP(c)
+}
+
+// SplitToken splits a secret token into the tenant name and the token itself.
+//
+// Tokens of the default namespace have no tenant.
+func SplitToken(token string) (tenant, rest string) {
+	parts := strings.SplitN(token, tokenSeparator, 2)
+	if len(parts) != 2 {
+		return "", token
+	}
+	return parts[0], parts[1]
+}
+
+// JoinToken prefixes a secret token with the tenant name
+func JoinToken(tenant, token string) string {
+	if tenant == "" {
+		return token
+	}
+	return tenant + tokenSeparator + token
+}
+
+// KeyStore finds API keys
+type KeyStore interface {
+	Lookup(key string) (Key, bool)
+}
+
+// Authenticator identifies the tenant of a request by its API key
+type Authenticator struct {
+	keys KeyStore
+}
+
+// NewAuthenticator creates a new API key authenticator
+func NewAuthenticator(keys KeyStore) *Authenticator {
+	return &Authenticator{
+		keys: keys,
+	}
+}
+
+// Required rejects requests without a valid API key
+func (a *Authenticator) Required(hf gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.authenticate(c, true) {
+			hf(c)
+		}
+	}
+}
+
+// Optional lets requests without an API key through, but rejects invalid keys
+func (a *Authenticator) Optional(hf gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.authenticate(c, false) {
+			hf(c)
+		}
+	}
+}
+
+// authenticate sets the tenant of the request API key.
+//
+// Returns false if the request was rejected.
+func (a *Authenticator) authenticate(c *gin.Context, required bool) bool {
+	key := c.GetHeader(KeyHeader)
+	if key == "" {
+		if required {
+			abort(c, CodeAPIKeyRequired, "API key is required")
+			return false
+		}
+		return true
+	}
+
+	k, ok := a.keys.Lookup(key)
+	if !ok {
+		logging.Warn("invalid API key", logging.String("ip", clientip.FromContext(c)))
+		abort(c, CodeInvalidAPIKey, "invalid API key")
+		return false
+	}
+	c.Set(contextKey, k.Tenant)
+	c.Set(keyContextKey, k.Name)
+	return true
+}
+
+// abort rejects the request with 401
+func abort(c *gin.Context, code, message string) {
+	res := models.ErrorResponse{
+		Code:    code,
+		Message: message,
+	}
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEXML) == gin.MIMEXML {
+		c.XML(http.StatusUnauthorized, &res)
+	} else {
+		c.JSON(http.StatusUnauthorized, &res)
+	}
+	c.Abort()
+}
+
+// NewQuota creates a quota of tenants from rate limit rules per tenant and a default rule.
+//
+// Tenants without a rule have the default quota, or no quota if the default rule is empty.
+// Requests without a tenant have no quota.
+func NewQuota(quotas map[string]string, defaultQuota string) (ratelimit.QuotaFunc, error) {
+	rules, err := ratelimit.ParseRules(quotas)
+	if err != nil {
+		return nil, fmt.Errorf("tenant quota: %v", err)
+	}
+
+	var (
+		defaultRule ratelimit.Rule
+		hasDefault  bool
+	)
+	if defaultQuota != "" {
+		if defaultRule, err = ratelimit.ParseRule(defaultQuota); err != nil {
+			return nil, fmt.Errorf("default tenant quota: %v", err)
+		}
+		hasDefault = true
+	}
+
+	return func(c *gin.Context) (string, ratelimit.Rule, bool) {
+		tenant := FromContext(c)
+		if tenant == "" {
+			return "", ratelimit.Rule{}, false
+		}
+		if rule, ok := rules[tenant]; ok {
+			return tenant, rule, true
+		}
+		return tenant, defaultRule, hasDefault
+	}, nil
+}
@@ -0,0 +1,178 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testKeys map[string]Key
+
+func (k testKeys) Lookup(key string) (Key, bool) {
+	res, ok := k[key]
+	return res, ok
+}
+
+func TestAuthenticator(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	a := NewAuthenticator(testKeys{"acme_key": {Tenant: "acme", Name: "ci"}})
+	handler := func(c *gin.Context) {
+		c.String(http.StatusOK, "tenant=%s key=%s", FromContext(c), KeyFromContext(c))
+	}
+
+	router := gin.New()
+	router.GET("/required", a.Required(handler))
+	router.GET("/optional", a.Optional(handler))
+
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		respCode int
+		respBody string
+	}{
+		{
+			name:     "required",
+			path:     "/required",
+			key:      "acme_key",
+			respCode: 200,
+			respBody: "tenant=acme key=ci",
+		},
+		{
+			name:     "required without key",
+			path:     "/required",
+			respCode: 401,
+			respBody: `{"code":"api_key_required","message":"API key is required"}`,
+		},
+		{
+			name:     "required with invalid key",
+			path:     "/required",
+			key:      "unknown",
+			respCode: 401,
+			respBody: `{"code":"invalid_api_key","message":"invalid API key"}`,
+		},
+		{
+			name:     "optional",
+			path:     "/optional",
+			key:      "acme_key",
+			respCode: 200,
+			respBody: "tenant=acme key=ci",
+		},
+		{
+			name:     "optional without key",
+			path:     "/optional",
+			respCode: 200,
+			respBody: "tenant= key=",
+		},
+		{
+			name:     "optional with invalid key",
+			path:     "/optional",
+			key:      "unknown",
+			respCode: 401,
+			respBody: `{"code":"invalid_api_key","message":"invalid API key"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set(KeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.respCode, w.Code)
+			assert.Equal(t, tt.respBody, w.Body.String())
+		})
+	}
+}
+
+func TestSplitToken(t *testing.T) {
+	name, token := SplitToken(JoinToken("acme", "0123456789abcdef"))
+	assert.Equal(t, "acme", name)
+	assert.Equal(t, "0123456789abcdef", token)
+
+	name, token = SplitToken(JoinToken("", "0123456789abcdef"))
+	assert.Empty(t, name)
+	assert.Equal(t, "0123456789abcdef", token)
+}
+
+func TestClientKey(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	a := NewAuthenticator(testKeys{
+		"ci_key":     {Tenant: "acme", Name: "ci"},
+		"deploy_key": {Tenant: "acme", Name: "deploy"},
+		"beta_key":   {Tenant: "beta", Name: "ci"},
+	})
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), map[string]ratelimit.Rule{
+		"test": {Limit: 1, Period: time.Hour},
+	}, ClientKey, nil)
+	handler := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	router := gin.New()
+	router.GET("/", a.Optional(limiter.Middleware(handler, "test")))
+
+	serve := func(key string) int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		if key != "" {
+			req.Header.Set(KeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// every API key has its own bucket, even from the same address
+	for _, key := range []string{"ci_key", "deploy_key", "beta_key", ""} {
+		assert.Equal(t, http.StatusOK, serve(key), key)
+	}
+	for _, key := range []string{"ci_key", "deploy_key", "beta_key", ""} {
+		assert.Equal(t, http.StatusTooManyRequests, serve(key), key)
+	}
+}
+
+func TestNewQuota(t *testing.T) {
+	quota, err := NewQuota(map[string]string{"acme": "1000/h"}, "10/m")
+	require.NoError(t, err)
+
+	newContext := func(tenant string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		if tenant != "" {
+			c.Set(contextKey, tenant)
+		}
+		return c
+	}
+
+	key, rule, ok := quota(newContext("acme"))
+	assert.True(t, ok)
+	assert.Equal(t, "acme", key)
+	assert.Equal(t, ratelimit.Rule{Limit: 1000, Period: time.Hour}, rule)
+
+	key, rule, ok = quota(newContext("beta"))
+	assert.True(t, ok)
+	assert.Equal(t, "beta", key)
+	assert.Equal(t, ratelimit.Rule{Limit: 10, Period: time.Minute}, rule)
+
+	_, _, ok = quota(newContext(""))
+	assert.False(t, ok)
+
+	// no default quota
+	quota, err = NewQuota(nil, "")
+	require.NoError(t, err)
+	_, _, ok = quota(newContext("beta"))
+	assert.False(t, ok)
+
+	_, err = NewQuota(map[string]string{"acme": "often"}, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,384 @@
+/*
+Package webhook delivers secret lifecycle events to creators.
+
+Events are sent as JSON POST requests signed with HMAC-SHA256 of the body.
+Deliveries run through a background queue, failed deliveries are retried with an exponential backoff
+and finally become dead letters, which are logged and reported to the observer.
+
+Webhook URLs are set by API clients, so by default events are never sent to loopback, link-local,
+private or other non-public addresses. Addresses are checked on every connection after DNS resolution.
+*/
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ilyakaznacheev/secret/internal/logging"
+)
+
+// EventType is a type of a secret lifecycle event
+type EventType string
+
+// secret lifecycle events
+const (
+	EventViewed  EventType = "viewed"
+	EventBurned  EventType = "burned"
+	EventExpired EventType = "expired"
+	EventRevoked EventType = "revoked"
+)
+
+const (
+	// SignatureHeader is a request header with the body signature in format sha256=<hex>
+	SignatureHeader = "X-Secret-Signature"
+	// EventHeader is a request header with the event type
+	EventHeader = "X-Secret-Event"
+
+	signaturePrefix = "sha256="
+)
+
+// ErrForbiddenAddress webhook URL resolves to a non-public address
+var ErrForbiddenAddress = errors.New("webhook address is not public")
+
+// forbiddenNetworks are non-public networks, events aren't sent there unless private networks are allowed
+var forbiddenNetworks = parseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// Event is a secret lifecycle event.
+//
+// It never contains secret content or keys, the secret is identified by its public lookup id.
+type Event struct {
+	Type           EventType `json:"event"`
+	SecretID       string    `json:"secretId"`
+	Time           time.Time `json:"time"`
+	RemainingViews int32     `json:"remainingViews"`
+}
+
+// Delivery is an event addressed to a webhook URL
+type Delivery struct {
+	URL       string
+	Event     Event
+	Attempts  int
+	LastError string
+}
+
+// Dispatcher sends events to webhook URLs in background
+type Dispatcher struct {
+	key      []byte
+	client   *http.Client
+	queue    chan Delivery
+	workers  int
+	retries  int
+	backoff  time.Duration
+	observer Observer
+
+	// stop is closed to deliver the rest of the queue and stop
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Observer is notified about finished deliveries
+type Observer interface {
+	// ObserveDelivery reports a delivered event or, if delivered is false, a dead letter
+	ObserveDelivery(dl Delivery, delivered bool)
+}
+
+// Option is a Dispatcher configuration option
+type Option func(*Dispatcher)
+
+// WithClient sets an HTTP client used for deliveries.
+//
+// Addresses of the client connections aren't checked, NewClient creates a client checking them.
+func WithClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithRetries sets the number of delivery attempts and the initial delay between them
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.retries = retries
+		d.backoff = backoff
+	}
+}
+
+// WithQueue sets the size of the delivery queue and the number of delivery workers
+func WithQueue(size, workers int) Option {
+	return func(d *Dispatcher) {
+		d.queue = make(chan Delivery, size)
+		d.workers = workers
+	}
+}
+
+// WithObserver sets an observer of delivered events and dead letters
+func WithObserver(observer Observer) Option {
+	return func(d *Dispatcher) {
+		d.observer = observer
+	}
+}
+
+// New creates a new dispatcher signing events with the key
+func New(key []byte, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		key:     key,
+		client:  NewClient(10*time.Second, false),
+		queue:   make(chan Delivery, 1000),
+		workers: 4,
+		retries: 5,
+		backoff: time.Second,
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.workers <= 0 {
+		d.workers = 1
+	}
+	if d.retries <= 0 {
+		d.retries = 1
+	}
+	return d
+}
+
+// NewClient creates an HTTP client for deliveries with the timeout of a single attempt.
+//
+// Unless private is set, the client refuses to connect to non-public addresses. Proxies aren't used,
+// so the address of the webhook itself is checked.
+func NewClient(timeout time.Duration, private bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if !private {
+		dialer.Control = checkAddress
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+// checkAddress rejects connections to non-public addresses. It is called with a resolved address before a connection
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ErrForbiddenAddress
+	}
+	for _, n := range forbiddenNetworks {
+		if n.Contains(ip) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// parseNetworks parses CIDR notations of networks
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// Notify queues an event for delivery.
+//
+// It never blocks, if the queue is full, the event becomes a dead letter.
+func (d *Dispatcher) Notify(url string, e Event) {
+	dl := Delivery{URL: url, Event: e}
+	select {
+	case d.queue <- dl:
+	default:
+		dl.LastError = "delivery queue is full"
+		d.bury(dl)
+	}
+}
+
+// Run delivers queued events until the context is done or the dispatcher is closed.
+//
+// After Close it delivers the rest of the queue and returns. If the context is done,
+// deliveries in progress are aborted and events left in the queue become dead letters.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(d.workers)
+	for i := 0; i < d.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case dl := <-d.queue:
+					d.deliver(ctx, dl)
+				case <-d.stop:
+					d.flush(ctx)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		d.drop("dispatcher was stopped")
+	}
+}
+
+// Close stops Run after delivery of queued events
+func (d *Dispatcher) Close() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+// flush delivers queued events until the queue is empty or the context is done
+func (d *Dispatcher) flush(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dl := <-d.queue:
+			d.deliver(ctx, dl)
+		default:
+			return
+		}
+	}
+}
+
+// drop buries all queued events as dead letters
+func (d *Dispatcher) drop(reason string) {
+	for {
+		select {
+		case dl := <-d.queue:
+			dl.LastError = reason
+			d.bury(dl)
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends the event retrying with an exponential backoff
+func (d *Dispatcher) deliver(ctx context.Context, dl Delivery) {
+	delay := d.backoff
+	for {
+		dl.Attempts++
+		err := d.send(ctx, dl)
+		if err == nil {
+			if d.observer != nil {
+				d.observer.ObserveDelivery(dl, true)
+			}
+			return
+		}
+		dl.LastError = err.Error()
+
+		if dl.Attempts >= d.retries {
+			d.bury(dl)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			d.bury(dl)
+			return
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
+
+// send makes a single delivery attempt
+func (d *Dispatcher) send(ctx context.Context, dl Delivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(dl.Event.Type))
+	req.Header.Set(SignatureHeader, Sign(d.key, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// bury logs a failed delivery as a dead letter and reports it to the observer
+func (d *Dispatcher) bury(dl Delivery) {
+	logging.Error("webhook delivery failed",
+		logging.Any("event", dl.Event.Type),
+		logging.Hash("secret", dl.Event.SecretID),
+		logging.Int("attempts", dl.Attempts),
+		logging.String("error", dl.LastError),
+	)
+
+	if d.observer != nil {
+		d.observer.ObserveDelivery(dl, false)
+	}
+}
+
+// Sign returns a signature of the body in format sha256=<hex>
+func Sign(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of the body, receivers can use it to authenticate events
+func Verify(key, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(key, body)), []byte(signature))
+}
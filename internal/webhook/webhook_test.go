@@ -0,0 +1,266 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte("webhook_key")
+
+type testReceiver struct {
+	mu     sync.Mutex
+	events []Event
+	fails  int
+	calls  int
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls++
+	if r.calls <= r.fails {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	if !Verify(testKey, body, req.Header.Get(SignatureHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get(EventHeader) != string(e.Type) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, e)
+}
+
+func (r *testReceiver) received() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+type testObserver struct {
+	mu        sync.Mutex
+	delivered int
+	dead      []Delivery
+}
+
+func (o *testObserver) ObserveDelivery(dl Delivery, delivered bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if delivered {
+		o.delivered++
+	} else {
+		o.dead = append(o.dead, dl)
+	}
+}
+
+func (o *testObserver) deadLetters() []Delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Delivery(nil), o.dead...)
+}
+
+// newTestDispatcher creates a dispatcher able to deliver events to local test servers
+func newTestDispatcher(opts ...Option) (*Dispatcher, *testObserver) {
+	obs := &testObserver{}
+	opts = append([]Option{WithClient(NewClient(time.Second, true)), WithObserver(obs)}, opts...)
+	return New(testKey, opts...), obs
+}
+
+// waitFor waits until the condition is met or fails the test after a second
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition wasn't met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	now := time.Date(2020, 2, 1, 10, 10, 10, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		fails    int
+		retries  int
+		received int
+		dead     int
+	}{
+		{
+			name:     "delivered",
+			retries:  3,
+			received: 1,
+		},
+		{
+			name:     "retried",
+			fails:    2,
+			retries:  3,
+			received: 1,
+		},
+		{
+			name:    "dead letter",
+			fails:   3,
+			retries: 3,
+			dead:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := &testReceiver{fails: tt.fails}
+			srv := httptest.NewServer(rcv)
+			defer srv.Close()
+
+			d, obs := newTestDispatcher(WithRetries(tt.retries, time.Millisecond), WithQueue(10, 1))
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				d.Run(ctx)
+				close(done)
+			}()
+
+			d.Notify(srv.URL, Event{Type: EventViewed, SecretID: "0123456789abcdef", Time: now, RemainingViews: 2})
+
+			waitFor(t, func() bool {
+				return len(rcv.received())+len(obs.deadLetters()) > 0
+			})
+			cancel()
+			<-done
+
+			events := rcv.received()
+			assert.Len(t, events, tt.received)
+			if tt.received > 0 {
+				assert.Equal(t, Event{Type: EventViewed, SecretID: "0123456789abcdef", Time: now, RemainingViews: 2}, events[0])
+			}
+
+			assert.Equal(t, tt.received, obs.delivered)
+			dead := obs.deadLetters()
+			assert.Len(t, dead, tt.dead)
+			if tt.dead > 0 {
+				assert.Equal(t, tt.retries, dead[0].Attempts)
+				assert.Equal(t, "unexpected response status 500", dead[0].LastError)
+			}
+		})
+	}
+}
+
+func TestDispatcher_QueueFull(t *testing.T) {
+	d, obs := newTestDispatcher(WithQueue(1, 1))
+
+	// nobody reads the queue
+	for i := 0; i < 4; i++ {
+		d.Notify("http://localhost", Event{Type: EventBurned})
+	}
+
+	dead := obs.deadLetters()
+	assert.Len(t, dead, 3)
+	assert.Equal(t, "delivery queue is full", dead[0].LastError)
+}
+
+func TestDispatcher_Close(t *testing.T) {
+	rcv := &testReceiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	d, obs := newTestDispatcher(WithQueue(10, 2))
+	for i := 0; i < 5; i++ {
+		d.Notify(srv.URL, Event{Type: EventBurned})
+	}
+
+	// queued events are delivered before Run returns
+	d.Close()
+	d.Run(context.Background())
+	assert.Len(t, rcv.received(), 5)
+	assert.Empty(t, obs.deadLetters())
+
+	// events can't be delivered after the context is done
+	d, obs = newTestDispatcher(WithQueue(10, 2))
+	for i := 0; i < 3; i++ {
+		d.Notify(srv.URL, Event{Type: EventBurned})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Close()
+	d.Run(ctx)
+	assert.Len(t, rcv.received(), 5)
+	assert.Len(t, obs.deadLetters(), 3)
+}
+
+func TestDispatcher_PrivateAddress(t *testing.T) {
+	rcv := &testReceiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	obs := &testObserver{}
+	d := New(testKey, WithRetries(1, time.Millisecond), WithObserver(obs))
+	d.Notify(srv.URL, Event{Type: EventViewed})
+	d.Close()
+	d.Run(context.Background())
+
+	// the test server listens on a loopback address
+	assert.Empty(t, rcv.received())
+	dead := obs.deadLetters()
+	if assert.Len(t, dead, 1) {
+		assert.Contains(t, dead[0].LastError, ErrForbiddenAddress.Error())
+	}
+}
+
+func Test_checkAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{address: "93.184.216.34:443", allowed: true},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443", allowed: true},
+		{address: "127.0.0.1:80"},
+		{address: "169.254.169.254:80"},
+		{address: "10.1.2.3:80"},
+		{address: "172.16.0.1:80"},
+		{address: "192.168.1.1:80"},
+		{address: "100.64.0.1:80"},
+		{address: "0.0.0.0:80"},
+		{address: "[::1]:80"},
+		{address: "[::ffff:127.0.0.1]:80"},
+		{address: "[fd00::1]:80"},
+		{address: "[fe80::1]:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := checkAddress("tcp", tt.address, nil)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, ErrForbiddenAddress, err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"event":"viewed"}`)
+	sig := Sign(testKey, body)
+
+	assert.True(t, Verify(testKey, body, sig))
+	assert.False(t, Verify([]byte("other"), body, sig))
+	assert.False(t, Verify(testKey, []byte(`{"event":"burned"}`), sig))
+}
@@ -0,0 +1,68 @@
+package secret
+
+import (
+	"errors"
+
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/handler"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+)
+
+// migrateRetries is a number of attempts to migrate a concurrently modified secret
+const migrateRetries = 5
+
+// migrateKeyHashes replaces plain key hashes of secrets, file chunks and tombstones
+// stored by earlier versions with key verifiers.
+//
+// Secrets of all tenants having API keys are migrated too.
+func migrateKeyHashes(db database.Database, keys *tenant.KeyFile) error {
+	var migrated int
+	var err error
+	for _, ns := range tenantDatabases(db, keys) {
+		err = ns.db.ForEachSecret(func(hash string) error {
+			ok, err := migrateSecret(ns.db, hash)
+			if ok {
+				migrated++
+			}
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	if migrated > 0 {
+		logging.Info("key hashes of secrets were migrated to key verifiers", logging.Int("secrets", migrated))
+	}
+	return err
+}
+
+// migrateSecret replaces plain key hashes of the secret with key verifiers.
+//
+// Returns true if the secret was changed.
+func migrateSecret(db database.Database, hash string) (bool, error) {
+	for attempt := 0; attempt < migrateRetries; attempt++ {
+		s, err := db.GetSecret(hash)
+		if err != nil {
+			// the secret could be deleted after the scan
+			logging.Warn("secret skipped", logging.Hash("secret", hash), logging.Err(err))
+			return false, nil
+		}
+
+		changed, err := handler.MigrateKeyHashes(&s.SecretBase)
+		if err != nil {
+			logging.Warn("secret skipped", logging.Hash("secret", hash), logging.Err(err))
+			return false, nil
+		}
+		if !changed {
+			return false, nil
+		}
+
+		err = db.UpdateSecret(hash, *s)
+		if err == database.ErrSecretModified {
+			continue
+		}
+		return err == nil, err
+	}
+	return false, errors.New("secret " + hash + " was modified too many times during migration")
+}
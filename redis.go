@@ -0,0 +1,140 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ilyakaznacheev/secret/internal/certs"
+	"github.com/ilyakaznacheev/secret/internal/config"
+	"github.com/ilyakaznacheev/secret/internal/database"
+)
+
+// openRedis creates a connection of the configured Redis deployment
+func openRedis(conf config.RedisConfig) (*database.RedisDB, error) {
+	if err := checkRedisConfig(conf); err != nil {
+		return nil, fmt.Errorf("invalid redis settings: %v", err)
+	}
+	opts, err := redisOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.Mode {
+	case "sentinel":
+		return database.NewRedisFailoverDB(conf.MasterName, conf.Addrs, opts...)
+	case "cluster":
+		return database.NewRedisClusterDB(conf.Addrs, opts...)
+	default:
+		if conf.URL != "" {
+			return database.NewRedisDBWithOpts(conf.URL, opts...)
+		}
+		return database.NewRedisDB(net.JoinHostPort(conf.Host, conf.Port), opts...)
+	}
+}
+
+// redisOptions returns connection options of the settings
+func redisOptions(conf config.RedisConfig) ([]database.RedisOption, error) {
+	opts := []database.RedisOption{
+		database.WithRedisAuth(conf.Username, conf.Password),
+		database.WithRedisDB(conf.DB),
+		database.WithRedisPool(conf.PoolSize),
+		database.WithRedisTimeouts(conf.DialTimeout, conf.ReadTimeout, conf.WriteTimeout),
+		database.WithRedisRetries(conf.MaxRetries),
+	}
+	if !redisTLS(conf) {
+		return opts, nil
+	}
+
+	serverName := conf.TLSServerName
+	if serverName == "" && conf.URL == "" {
+		serverName = conf.Host
+	}
+	tlsConfig, err := certs.ClientConfig(conf.TLSCA, conf.TLSCert, conf.TLSKey, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("redis TLS: %v", err)
+	}
+	return append(opts, database.WithRedisTLS(tlsConfig)), nil
+}
+
+// redisTLS reports whether TLS is enabled by the flag or the URL scheme
+func redisTLS(conf config.RedisConfig) bool {
+	return conf.TLS || strings.HasPrefix(conf.URL, "rediss://")
+}
+
+// checkRedisConfig reports conflicting and missing settings
+func checkRedisConfig(conf config.RedisConfig) error {
+	switch conf.Mode {
+	case "single":
+		if len(conf.Addrs) > 0 || conf.MasterName != "" {
+			return errors.New("REDIS_ADDRS and REDIS_MASTER_NAME are used only in sentinel and cluster modes")
+		}
+		if conf.URL != "" && (conf.Host != "" || conf.Port != "") {
+			return errors.New("REDIS_URL can't be used with REDIS_HOST and REDIS_PORT")
+		}
+	case "sentinel", "cluster":
+		if conf.URL != "" || conf.Host != "" || conf.Port != "" {
+			return fmt.Errorf("REDIS_URL, REDIS_HOST and REDIS_PORT are used only in single mode, set REDIS_ADDRS in %s mode", conf.Mode)
+		}
+		if len(conf.Addrs) == 0 {
+			return fmt.Errorf("REDIS_ADDRS is required in %s mode", conf.Mode)
+		}
+		if conf.Mode == "sentinel" && conf.MasterName == "" {
+			return errors.New("REDIS_MASTER_NAME is required in sentinel mode")
+		}
+		if conf.Mode == "cluster" && conf.MasterName != "" {
+			return errors.New("REDIS_MASTER_NAME is used only in sentinel mode")
+		}
+		if conf.Mode == "cluster" && conf.DB != 0 {
+			return errors.New("REDIS_DB must be 0 in cluster mode")
+		}
+		if redisTLS(conf) && conf.TLSServerName == "" {
+			return fmt.Errorf("REDIS_TLS_SERVER_NAME is required with TLS in %s mode, because nodes are discovered at runtime", conf.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown REDIS_MODE %q, expected single, sentinel or cluster", conf.Mode)
+	}
+
+	if conf.URL != "" {
+		u, err := url.Parse(conf.URL)
+		if err != nil {
+			return fmt.Errorf("REDIS_URL: %v", err)
+		}
+		if conf.TLS && u.Scheme == "redis" {
+			return errors.New("REDIS_TLS conflicts with the redis:// scheme of REDIS_URL, use rediss://")
+		}
+		if _, ok := u.User.Password(); ok && conf.Password != "" {
+			return errors.New("REDIS_PASSWORD conflicts with the password of REDIS_URL")
+		}
+		if strings.Trim(u.Path, "/") != "" && conf.DB != 0 {
+			return errors.New("REDIS_DB conflicts with the database of REDIS_URL")
+		}
+	}
+
+	if !redisTLS(conf) && (conf.TLSCA != "" || conf.TLSCert != "" || conf.TLSKey != "" || conf.TLSServerName != "") {
+		return errors.New("REDIS_TLS_* settings are set, but TLS is disabled, set REDIS_TLS or use a rediss:// URL")
+	}
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		return errors.New("REDIS_TLS_CERT and REDIS_TLS_KEY must be set together")
+	}
+	if conf.Username != "" && conf.Password == "" {
+		if u, err := url.Parse(conf.URL); conf.URL == "" || err != nil || !hasPassword(u) {
+			return errors.New("REDIS_USERNAME requires a password")
+		}
+	}
+	if conf.DB < 0 || conf.PoolSize < 0 || conf.MaxRetries < 0 {
+		return errors.New("REDIS_DB, REDIS_POOL_SIZE and REDIS_MAX_RETRIES can't be negative")
+	}
+	if conf.DialTimeout < 0 || conf.ReadTimeout < 0 || conf.WriteTimeout < 0 {
+		return errors.New("redis timeouts can't be negative")
+	}
+	return nil
+}
+
+// hasPassword reports whether the URL contains a password
+func hasPassword(u *url.URL) bool {
+	_, ok := u.User.Password()
+	return ok
+}
@@ -0,0 +1,124 @@
+package secret
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilyakaznacheev/secret/internal/config"
+	"github.com/ilyakaznacheev/secret/internal/models"
+)
+
+func TestCheckRedisConfig(t *testing.T) {
+	single := config.RedisConfig{Mode: "single", Host: "localhost", Port: "6379"}
+	sentinel := config.RedisConfig{Mode: "sentinel", Addrs: []string{"sentinel:26379"}, MasterName: "main"}
+	cluster := config.RedisConfig{Mode: "cluster", Addrs: []string{"node-1:6379", "node-2:6379"}}
+
+	for name, tc := range map[string]struct {
+		conf   config.RedisConfig
+		update func(c *config.RedisConfig)
+		err    string
+	}{
+		"single":   {conf: single},
+		"sentinel": {conf: sentinel},
+		"cluster":  {conf: cluster},
+		"url": {conf: single, update: func(c *config.RedisConfig) {
+			c.Host, c.Port, c.URL = "", "", "rediss://:pass@redis:6380/2"
+			c.Username, c.TLSCA = "app", "ca.crt"
+		}},
+		"tls": {conf: cluster, update: func(c *config.RedisConfig) {
+			c.TLS, c.TLSServerName, c.TLSCert, c.TLSKey = true, "*.redis.internal", "tls.crt", "tls.key"
+			c.Username, c.Password = "app", "pass"
+		}},
+		"unknown mode": {conf: single, update: func(c *config.RedisConfig) { c.Mode = "replica" },
+			err: `unknown REDIS_MODE "replica", expected single, sentinel or cluster`},
+		"url with host": {conf: single, update: func(c *config.RedisConfig) { c.URL = "redis://redis:6379" },
+			err: "REDIS_URL can't be used with REDIS_HOST and REDIS_PORT"},
+		"single with addrs": {conf: single, update: func(c *config.RedisConfig) { c.Addrs = []string{"redis:6379"} },
+			err: "REDIS_ADDRS and REDIS_MASTER_NAME are used only in sentinel and cluster modes"},
+		"sentinel with host": {conf: sentinel, update: func(c *config.RedisConfig) { c.Host = "redis" },
+			err: "REDIS_URL, REDIS_HOST and REDIS_PORT are used only in single mode, set REDIS_ADDRS in sentinel mode"},
+		"sentinel without master": {conf: sentinel, update: func(c *config.RedisConfig) { c.MasterName = "" },
+			err: "REDIS_MASTER_NAME is required in sentinel mode"},
+		"cluster without addrs": {conf: cluster, update: func(c *config.RedisConfig) { c.Addrs = nil },
+			err: "REDIS_ADDRS is required in cluster mode"},
+		"cluster with db": {conf: cluster, update: func(c *config.RedisConfig) { c.DB = 1 },
+			err: "REDIS_DB must be 0 in cluster mode"},
+		"cluster tls without server name": {conf: cluster, update: func(c *config.RedisConfig) { c.TLS = true },
+			err: "REDIS_TLS_SERVER_NAME is required with TLS in cluster mode, because nodes are discovered at runtime"},
+		"tls with redis scheme": {conf: single, update: func(c *config.RedisConfig) {
+			c.Host, c.Port, c.URL, c.TLS = "", "", "redis://redis:6379", true
+		}, err: "REDIS_TLS conflicts with the redis:// scheme of REDIS_URL, use rediss://"},
+		"password twice": {conf: single, update: func(c *config.RedisConfig) {
+			c.Host, c.Port, c.URL, c.Password = "", "", "redis://:pass@redis:6379", "other"
+		}, err: "REDIS_PASSWORD conflicts with the password of REDIS_URL"},
+		"db twice": {conf: single, update: func(c *config.RedisConfig) {
+			c.Host, c.Port, c.URL, c.DB = "", "", "redis://redis:6379/1", 2
+		}, err: "REDIS_DB conflicts with the database of REDIS_URL"},
+		"tls files without tls": {conf: single, update: func(c *config.RedisConfig) { c.TLSCA = "ca.crt" },
+			err: "REDIS_TLS_* settings are set, but TLS is disabled, set REDIS_TLS or use a rediss:// URL"},
+		"cert without key": {conf: single, update: func(c *config.RedisConfig) { c.TLS, c.TLSCert = true, "tls.crt" },
+			err: "REDIS_TLS_CERT and REDIS_TLS_KEY must be set together"},
+		"username without password": {conf: single, update: func(c *config.RedisConfig) { c.Username = "app" },
+			err: "REDIS_USERNAME requires a password"},
+		"negative pool": {conf: single, update: func(c *config.RedisConfig) { c.PoolSize = -1 },
+			err: "REDIS_DB, REDIS_POOL_SIZE and REDIS_MAX_RETRIES can't be negative"},
+		"negative timeout": {conf: single, update: func(c *config.RedisConfig) { c.ReadTimeout = -time.Second },
+			err: "redis timeouts can't be negative"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := tc.conf
+			if tc.update != nil {
+				tc.update(&conf)
+			}
+			err := checkRedisConfig(conf)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestOpenRedis(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	mr.RequireAuth("pass")
+
+	conf := config.RedisConfig{
+		Mode:         "single",
+		Host:         mr.Host(),
+		Port:         mr.Port(),
+		Password:     "pass",
+		DB:           3,
+		PoolSize:     2,
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		MaxRetries:   1,
+	}
+	db, err := openRedis(conf)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.CreateSecret("db", models.Secret{SecretBase: models.SecretBase{RemainingViews: 1}}))
+	assert.Equal(t, []string{"secret:{db}"}, mr.DB(3).Keys())
+	assert.Empty(t, mr.DB(0).Keys())
+
+	conf.Password = "wrong"
+	_, err = openRedis(conf)
+	assert.Error(t, err)
+
+	conf.Password, conf.TLS, conf.TLSCA = "pass", true, "missing.crt"
+	_, err = openRedis(conf)
+	assert.Error(t, err)
+
+	conf.TLS = false
+	_, err = openRedis(conf)
+	assert.EqualError(t, err, "invalid redis settings: REDIS_TLS_* settings are set, but TLS is disabled, set REDIS_TLS or use a rediss:// URL")
+}
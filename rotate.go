@@ -0,0 +1,111 @@
+package secret
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/ilyakaznacheev/secret/internal/config"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/keyring"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+)
+
+// rotateRetries is a number of attempts to re-wrap a concurrently modified secret
+const rotateRetries = 5
+
+// RotateKeys re-wraps data keys of all secrets with the primary key-encryption key.
+//
+// Only data keys are re-encrypted, secret payloads are never decrypted.
+// Secrets of all tenants having API keys are rotated too.
+func RotateKeys(conf config.Config) error {
+	if err := setupLogging(conf.Log); err != nil {
+		return err
+	}
+
+	kr, err := keyring.Load(conf.Keyring.Keys, conf.Keyring.File, conf.Keyring.Primary)
+	if err != nil {
+		return err
+	}
+	if kr == nil {
+		return keyring.ErrEmpty
+	}
+
+	db, err := newDatabase(conf)
+	if err != nil {
+		return err
+	}
+
+	var keys *tenant.KeyFile
+	if conf.Tenant.KeysFile != "" {
+		if keys, err = tenant.LoadKeyFile(conf.Tenant.KeysFile); err != nil {
+			return err
+		}
+	}
+
+	var rotated, total int
+	for _, ns := range tenantDatabases(db, keys) {
+		err = ns.db.ForEachSecret(func(hash string) error {
+			// file chunks are encrypted with keys stored in their secrets, tombstones have no keys
+			if models.IsChunk(hash) || models.IsTombstone(hash) {
+				return nil
+			}
+			total++
+			ok, err := rewrapSecret(ns.db, kr, hash)
+			if err != nil {
+				return err
+			}
+			if ok {
+				rotated++
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	logging.Info("secrets were re-wrapped",
+		logging.Int("rotated", rotated),
+		logging.Int("total", total),
+		logging.String("key", kr.Primary()),
+	)
+	return err
+}
+
+// rewrapSecret re-wraps a data key of the secret with the primary key.
+//
+// Returns true if the secret was changed.
+func rewrapSecret(db database.Database, kr *keyring.Keyring, hash string) (bool, error) {
+	for attempt := 0; attempt < rotateRetries; attempt++ {
+		s, err := db.GetSecret(hash)
+		if err != nil {
+			// the secret could be deleted after the scan
+			logging.Warn("secret skipped", logging.Hash("secret", hash), logging.Err(err))
+			return false, nil
+		}
+
+		// nothing to do for secrets without wrapped keys or already wrapped with the primary key
+		if s.DataKey == "" || s.KeyID == kr.Primary() {
+			return false, nil
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(s.DataKey)
+		if err != nil {
+			return false, err
+		}
+		keyID, wrapped, err := kr.Rewrap(s.KeyID, wrapped)
+		if err != nil {
+			return false, err
+		}
+		s.DataKey = base64.StdEncoding.EncodeToString(wrapped)
+		s.KeyID = keyID
+
+		err = db.UpdateSecret(hash, *s)
+		if err == database.ErrSecretModified {
+			continue
+		}
+		return err == nil, err
+	}
+	return false, errors.New("secret " + hash + " was modified too many times during rotation")
+}
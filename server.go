@@ -1,44 +1,534 @@
 package secret
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/secret/internal/certs"
+	"github.com/ilyakaznacheev/secret/internal/clientip"
 	"github.com/ilyakaznacheev/secret/internal/config"
 	"github.com/ilyakaznacheev/secret/internal/database"
 	"github.com/ilyakaznacheev/secret/internal/handler"
+	"github.com/ilyakaznacheev/secret/internal/health"
+	"github.com/ilyakaznacheev/secret/internal/janitor"
+	"github.com/ilyakaznacheev/secret/internal/keyring"
+	"github.com/ilyakaznacheev/secret/internal/logging"
 	"github.com/ilyakaznacheev/secret/internal/monitoring"
+	"github.com/ilyakaznacheev/secret/internal/ratelimit"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+	"github.com/ilyakaznacheev/secret/internal/webhook"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Run start the server
+// Run starts the server and shuts it down gracefully on SIGINT or SIGTERM
 func Run(conf config.Config) error {
+	if err := setupLogging(conf.Log); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%s", conf.Server.Host, conf.Server.Port))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	return Serve(ctx, conf, ln)
+}
+
+// Serve serves the API on the listener until the context is done.
+//
+// Then it shuts down gracefully: stops accepting connections, drains in-flight requests,
+// stops background jobs, flushes pending webhook and audit events and closes the database.
+// The whole shutdown is limited by the shutdown timeout.
+//
+// Prometheus metrics are registered in a registry of the server, so Serve can be called repeatedly.
+func Serve(ctx context.Context, conf config.Config, ln net.Listener) error {
+	defer ln.Close()
+
+	policy := handler.Policy{
+		MaxBytes:            conf.Policy.MaxBytes,
+		MaxViews:            conf.Policy.MaxViews,
+		MaxTTL:              conf.Policy.MaxTTL,
+		DefaultTTL:          conf.Policy.DefaultTTL,
+		ForbidNeverExpire:   !conf.Policy.AllowNeverExpire,
+		AllowedContentTypes: conf.Policy.AllowedContentTypes,
+	}
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("invalid secret policy: %v", err)
+	}
+
+	db, err := newDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	opts := []handler.Option{
+		handler.WithPolicy(policy),
+		handler.WithPassphraseAttempts(conf.Policy.PassphraseAttempts),
+		handler.WithFileLimits(conf.File.MaxBytes, conf.File.ChunkSize),
+		handler.WithFingerprintKey([]byte(conf.Audit.Key)),
+	}
+	kr, err := keyring.Load(conf.Keyring.Keys, conf.Keyring.File, conf.Keyring.Primary)
+	if err != nil {
+		return err
+	}
+	if kr != nil {
+		opts = append(opts, handler.WithKeyring(kr))
+	}
+
+	var keys *tenant.KeyFile
+	if conf.Tenant.KeysFile != "" {
+		if keys, err = tenant.LoadKeyFile(conf.Tenant.KeysFile); err != nil {
+			return fmt.Errorf("API keys: %v", err)
+		}
+		opts = append(opts, handler.WithTenants(func(name string) handler.Database {
+			return database.Namespace(db, name)
+		}))
+	}
+	if err := migrateKeyHashes(db, keys); err != nil {
+		return err
+	}
+
+	// janitors are stopped before the dispatcher and the audit log, so their events are flushed too
 	var (
-		db  *database.RedisDB
-		err error
+		jobs                          sync.WaitGroup
+		jobCtx, stopJobs              = context.WithCancel(context.Background())
+		dispatcherDone                = make(chan struct{})
+		dispatcherCtx, stopDispatcher = context.WithCancel(context.Background())
+		auditDone                     = make(chan struct{})
+		auditCtx, stopAudit           = context.WithCancel(context.Background())
 	)
-	if conf.Redis.URL != "" {
-		db, err = database.NewRedisDBWithOpts(conf.Redis.URL)
+	defer stopJobs()
+	defer stopDispatcher()
+	defer stopAudit()
+
+	var dispatcher *webhook.Dispatcher
+	if conf.Webhook.Secret != "" {
+		dispatcher = newDispatcher(conf.Webhook, reg)
+		go func() {
+			dispatcher.Run(dispatcherCtx)
+			close(dispatcherDone)
+		}()
+		opts = append(opts, handler.WithNotifier(dispatcher))
+	} else {
+		close(dispatcherDone)
+	}
+
+	auditLog, err := newAuditLog(conf.Audit, db)
+	if err != nil {
+		return err
+	}
+	if auditLog != nil {
+		go func() {
+			auditLog.Run(auditCtx)
+			close(auditDone)
+		}()
+		opts = append(opts, handler.WithAuditor(auditLog))
+	} else {
+		close(auditDone)
+	}
+
+	h := handler.NewSecretHandler(db, opts...)
+
+	probes := health.New(conf.Server.ReadyTimeout)
+	if p, ok := db.(database.Pinger); ok {
+		probes.Add("storage", p.Ping)
 	} else {
-		db, err = database.NewRedisDB(conf.Redis.Host + ":" + conf.Redis.Port)
+		probes.Add("storage", func(context.Context) error { return nil })
 	}
+
+	if conf.Janitor.Interval > 0 {
+		if rdb, ok := db.(*database.RedisDB); ok && (dispatcher != nil || auditLog != nil) {
+			// keep expired secrets until the next sweeps, so their expiration is reported
+			rdb.SetExpirationGrace(2 * conf.Janitor.Interval)
+		}
+		metrics := monitoring.NewJanitorMetrics(reg)
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			watchTenants(jobCtx, db, keys, conf.Janitor.Interval, func(ns namespace) {
+				j := newJanitor(conf.Janitor, ns.db, metrics)
+				j.SetFingerprintKey([]byte(conf.Audit.Key))
+				if dispatcher != nil {
+					j.SetNotifier(dispatcher)
+				}
+				if auditLog != nil {
+					j.SetAuditor(auditLog, ns.tenant)
+				}
+				jobs.Add(1)
+				go func() {
+					defer jobs.Done()
+					j.Run(jobCtx)
+				}()
+			})
+		}()
+	}
+
+	limiter, err := newLimiter(conf.RateLimit, db, reg)
 	if err != nil {
 		return err
 	}
+	auth, err := newAuth(conf.Tenant, keys, limiter, reg)
+	if err != nil {
+		return err
+	}
+	// route adds authentication, rate limiting and monitoring to the endpoint handler
+	route := func(hf gin.HandlerFunc, endpoint string, create bool) gin.HandlerFunc {
+		return monitoring.MetricsMiddleware(reg, auth(hf, endpoint, create), endpoint)
+	}
 
-	h := handler.NewSecretHandler(db)
+	proxies, err := clientip.New(conf.Server.TrustedProxies, conf.Server.ForwardedHeader)
+	if err != nil {
+		return err
+	}
 
-	router := gin.Default()
+	router := gin.New()
+	// gin trusts forwarding headers of any client
+	router.ForwardedByClientIP = false
+	router.Use(proxies.Middleware(), logging.AccessLog(logging.Default()), logging.Recovery(logging.Default()))
 
 	router.GET("/", handler.RedirectTo(conf.Redirect.Root))
 
 	v1 := router.Group("/v1")
-	v1.POST("/secret", monitoring.MetricsMiddleware(h.PostSecret, "secret_post"))
-	v1.GET("/secret/:hash", monitoring.MetricsMiddleware(h.GetSecret, "secret_get"))
+	v1.POST("/secret", route(h.PostSecret, "secret_post", true))
+	v1.GET("/secret/:hash", route(h.GetSecret, "secret_get", false))
+	v1.HEAD("/secret/:hash", route(h.HeadSecret, "secret_head", false))
+	v1.GET("/secret/:hash/file", route(h.GetSecretFile, "secret_file", false))
+	v1.GET("/secret/:hash/meta", route(h.GetSecretMeta, "secret_meta", false))
+	v1.GET("/secret/:hash/status", route(h.GetSecretStatus, "secret_status", false))
+	v1.DELETE("/secret/:hash", route(h.DeleteSecret, "secret_delete", false))
 	v1.GET("/", handler.RedirectTo(conf.Redirect.API))
 
-	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/metrics", gin.WrapH(promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))))
+	router.GET("/healthz", probes.Live)
+	router.GET("/readyz", probes.Ready)
+
+	srv := &http.Server{
+		Handler:      router,
+		ReadTimeout:  conf.Server.ReadTimeout,
+		WriteTimeout: conf.Server.WriteTimeout,
+		IdleTimeout:  conf.Server.IdleTimeout,
+	}
+	if srv.TLSConfig, err = newTLSConfig(conf.Server); err != nil {
+		return err
+	}
 
 	// Run service
-	return router.Run(fmt.Sprintf("%s:%s", conf.Server.Host, conf.Server.Port))
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ServeTLS(ln, "", "")
+		} else {
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+	logging.Info("server is listening", logging.String("address", ln.Addr().String()))
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logging.Info("server is shutting down")
+	probes.Shutdown()
+	if conf.Server.ShutdownDelay > 0 {
+		time.Sleep(conf.Server.ShutdownDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
+	defer cancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logging.Error("requests weren't drained", logging.Err(err))
+	}
+
+	stopJobs()
+	jobs.Wait()
+
+	if dispatcher != nil {
+		dispatcher.Close()
+	}
+	select {
+	case <-dispatcherDone:
+	case <-shutdownCtx.Done():
+		// abort deliveries, undelivered events are logged as dead letters
+		stopDispatcher()
+		<-dispatcherDone
+	}
+
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	select {
+	case <-auditDone:
+	case <-shutdownCtx.Done():
+		// events still queued are logged as lost
+		stopAudit()
+		<-auditDone
+	}
+
+	logging.Info("server was stopped")
+	return err
+}
+
+// setupLogging replaces the default logger with the configured one
+func setupLogging(conf config.LogConfig) error {
+	level, err := logging.ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	redactor, err := logging.NewRedactor(conf.Redaction, conf.FingerprintKey)
+	if err != nil {
+		return err
+	}
+	logger, err := logging.New(os.Stderr, level, conf.Format, redactor)
+	if err != nil {
+		return err
+	}
+	logging.SetDefault(logger)
+	return nil
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM.
+//
+// Only the first signal is handled, the next one terminates the process.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sig)
+		select {
+		case s := <-sig:
+			logging.Info("signal received", logging.String("signal", s.String()))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// newTLSConfig creates a TLS configuration with certificates reloaded on change.
+//
+// Returns nil if TLS isn't configured.
+func newTLSConfig(conf config.ServerConfig) (*tls.Config, error) {
+	if conf.TLSCert == "" && conf.TLSKey == "" {
+		if conf.TLSClientCA != "" {
+			return nil, errors.New("client certificates can't be verified without TLS")
+		}
+		return nil, nil
+	}
+
+	clientAuth, err := certs.ParseClientAuth(conf.TLSClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := certs.New(conf.TLSCert, conf.TLSKey, conf.TLSClientCA, clientAuth)
+	if err != nil {
+		return nil, err
+	}
+	return reloader.TLSConfig(), nil
+}
+
+// closeDatabase closes the database connection if the driver has one
+func closeDatabase(db database.Database) {
+	c, ok := db.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		logging.Error("database can't be closed", logging.Err(err))
+	}
+}
+
+// newJanitor creates an expired secret sweeper.
+//
+// Replicas using Redis or SQL storage share a lock, so only one of them sweeps at a time.
+func newJanitor(conf config.JanitorConfig, db database.Database, observer janitor.Observer) *janitor.Janitor {
+	var locker janitor.Locker
+	switch d := db.(type) {
+	case *database.RedisDB:
+		locker = d.NewLock("janitor")
+	case *database.SQLDB:
+		locker = d.NewLock("janitor")
+	}
+	return janitor.New(db, locker, observer, conf.Interval, conf.BatchSize)
+}
+
+// newAuth creates a middleware of API key authentication, rate limits and tenant quotas.
+//
+// API keys are required for secret creation, and for other endpoints only if configured.
+// Without API keys the middleware only limits the rate.
+func newAuth(conf config.TenantConfig, keys *tenant.KeyFile, limiter *ratelimit.Limiter, reg prometheus.Registerer) (func(hf gin.HandlerFunc, endpoint string, create bool) gin.HandlerFunc, error) {
+	if keys == nil {
+		return func(hf gin.HandlerFunc, endpoint string, _ bool) gin.HandlerFunc {
+			return limiter.Middleware(hf, endpoint)
+		}, nil
+	}
+
+	quota, err := tenant.NewQuota(conf.Quotas, conf.DefaultQuota)
+	if err != nil {
+		return nil, err
+	}
+	authenticator := tenant.NewAuthenticator(keys)
+	metrics := monitoring.NewTenantMetrics(reg, tenant.FromContext)
+
+	return func(hf gin.HandlerFunc, endpoint string, create bool) gin.HandlerFunc {
+		if create {
+			hf = limiter.QuotaMiddleware(hf, endpoint, quota)
+		}
+		hf = metrics.Middleware(hf, endpoint)
+		// clients are rate limited by their API keys, so the key is checked first
+		hf = limiter.Middleware(hf, endpoint)
+		if create || conf.ReadRequired {
+			return authenticator.Required(hf)
+		}
+		return authenticator.Optional(hf)
+	}, nil
+}
+
+// namespace is a database namespace of the tenant, the default namespace has no tenant
+type namespace struct {
+	tenant string
+	db     database.Database
+}
+
+// tenantDatabases returns the default database and namespaces of tenants having API keys.
+//
+// Databases without native namespaces keep secrets of tenants in the default namespace, so only it is returned.
+func tenantDatabases(db database.Database, keys *tenant.KeyFile) []namespace {
+	nss := []namespace{{db: db}}
+	if _, ok := db.(database.Namespacer); !ok || keys == nil {
+		return nss
+	}
+	for _, name := range keys.Tenants() {
+		nss = append(nss, namespace{tenant: name, db: database.Namespace(db, name)})
+	}
+	return nss
+}
+
+// watchTenants calls start once for every namespace of tenantDatabases.
+//
+// The key file is checked every interval until the context is done,
+// so namespaces of tenants added after the start are started too.
+func watchTenants(ctx context.Context, db database.Database, keys *tenant.KeyFile, interval time.Duration, start func(ns namespace)) {
+	started := make(map[string]bool)
+	check := func() {
+		for _, ns := range tenantDatabases(db, keys) {
+			if !started[ns.tenant] {
+				started[ns.tenant] = true
+				start(ns)
+			}
+		}
+	}
+	check()
+	if keys == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// newLimiter creates a request rate limiter.
+//
+// Redis store shares buckets between replicas, so it requires Redis storage.
+func newLimiter(conf config.RateLimitConfig, db database.Database, reg prometheus.Registerer) (*ratelimit.Limiter, error) {
+	rules, err := ratelimit.ParseRules(conf.Routes)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit: %v", err)
+	}
+
+	var store ratelimit.Store
+	switch conf.Store {
+	case "memory":
+		store = ratelimit.NewMemoryStore()
+	case "redis":
+		rdb, ok := db.(*database.RedisDB)
+		if !ok {
+			return nil, fmt.Errorf("rate limit store redis requires storage driver %s", database.DriverRedis)
+		}
+		store = rdb.NewTokenBucket()
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", conf.Store)
+	}
+	return ratelimit.New(store, rules, tenant.ClientKey, monitoring.NewRateLimitMetrics(reg)), nil
+}
+
+// newDispatcher creates a webhook event dispatcher
+func newDispatcher(conf config.WebhookConfig, reg prometheus.Registerer) *webhook.Dispatcher {
+	return webhook.New([]byte(conf.Secret),
+		webhook.WithClient(webhook.NewClient(conf.Timeout, conf.AllowPrivate)),
+		webhook.WithRetries(conf.Retries, conf.Backoff),
+		webhook.WithQueue(conf.QueueSize, conf.Workers),
+		webhook.WithObserver(monitoring.NewWebhookMetrics(reg)),
+	)
+}
+
+// newDatabase creates a database connection of the configured storage driver
+// and migrates its data to the actual layout
+func newDatabase(conf config.Config) (database.Database, error) {
+	db, err := openDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := db.(database.Migrator); ok {
+		moved, err := m.Migrate()
+		if err != nil {
+			return nil, err
+		}
+		if moved > 0 {
+			logging.Info("secrets were migrated to the actual storage layout", logging.Int("secrets", moved))
+		}
+	}
+	return db, nil
+}
+
+// openDatabase creates a database connection of the configured storage driver
+func openDatabase(conf config.Config) (database.Database, error) {
+	switch conf.Storage.Driver {
+	case database.DriverRedis:
+		db, err := openRedis(conf.Redis)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case database.DriverMemory:
+		return database.NewMemoryDB(), nil
+	case database.DriverBolt:
+		return database.NewBoltDB(conf.Storage.Path)
+	case database.DriverPostgres, database.DriverSQLite:
+		return database.NewSQLDB(conf.Storage.Driver, conf.Storage.DSN)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", conf.Storage.Driver)
+	}
 }
@@ -0,0 +1,341 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilyakaznacheev/secret/internal/config"
+	"github.com/ilyakaznacheev/secret/internal/database"
+	"github.com/ilyakaznacheev/secret/internal/health"
+	"github.com/ilyakaznacheev/secret/internal/logging"
+	"github.com/ilyakaznacheev/secret/internal/models"
+	"github.com/ilyakaznacheev/secret/internal/ratelimit"
+	"github.com/ilyakaznacheev/secret/internal/tenant"
+)
+
+// writeTestCert writes a self-signed server certificate of 127.0.0.1 and its key as PEM files
+func writeTestCert(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "secret"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert
+}
+
+// TestServe starts the server with TLS on a random port and stops it with the context.
+func TestServe(t *testing.T) {
+	os.Setenv("STORAGE_DRIVER", "memory")
+	defer os.Unsetenv("STORAGE_DRIVER")
+
+	var conf config.Config
+	require.NoError(t, cleanenv.ReadEnv(&conf))
+	conf.Server.ShutdownTimeout = 5 * time.Second
+
+	dir, err := ioutil.TempDir("", "secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf.Audit.File = filepath.Join(dir, "audit.jsonl")
+	conf.Audit.Source = "replica-1"
+	conf.Audit.Key = "audit key"
+	conf.Server.TLSCert = filepath.Join(dir, "tls.crt")
+	conf.Server.TLSKey = filepath.Join(dir, "tls.key")
+	pool := x509.NewCertPool()
+	pool.AddCert(writeTestCert(t, conf.Server.TLSCert, conf.Server.TLSKey))
+
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, logging.LevelDebug, logging.FormatJSON, &logging.Redactor{})
+	require.NoError(t, err)
+	defer logging.SetDefault(logging.Default())
+	logging.SetDefault(logger)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := "https://" + ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, conf, ln) }()
+
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	resp, err := client.PostForm(addr+"/v1/secret", url.Values{
+		"secret":           {"some text"},
+		"expireAfterViews": {"1"},
+		"expireAfter":      {"0"},
+	})
+	require.NoError(t, err)
+	var created models.SecretResponse
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Get(addr + "/v1/secret/" + created.Hash)
+	require.NoError(t, err)
+	var got models.SecretResponse
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "some text", got.SecretText)
+
+	resp, err = client.Get(addr + "/readyz")
+	require.NoError(t, err)
+	var ready health.Report
+	err = json.NewDecoder(resp.Body).Decode(&ready)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, health.StatusOK, ready.Checks["storage"].Status)
+
+	resp, err = client.Get(addr + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("server wasn't stopped")
+	}
+
+	_, err = net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	assert.Error(t, err, "listener must be closed")
+
+	// secret tokens never reach the logs
+	assert.Contains(t, logs.String(), `"msg":"request"`)
+	assert.NotContains(t, logs.String(), created.Hash)
+	assert.NotContains(t, logs.String(), created.Hash[:16])
+
+	// the audit trail is flushed on shutdown
+	var report bytes.Buffer
+	require.NoError(t, Audit(conf, []string{"verify"}, &report))
+	assert.Equal(t, conf.Audit.File+": 3 entries of 1 sources (replica-1) in 1 chains are valid\n", report.String())
+
+	conf.Audit.Key = "wrong key"
+	assert.Error(t, Audit(conf, []string{"verify", conf.Audit.File}, &report))
+	assert.Error(t, Audit(conf, []string{"check"}, &report))
+}
+
+// TestServe_Restart starts and stops the server twice in the same process
+func TestServe_Restart(t *testing.T) {
+	os.Setenv("STORAGE_DRIVER", "memory")
+	defer os.Unsetenv("STORAGE_DRIVER")
+
+	var conf config.Config
+	require.NoError(t, cleanenv.ReadEnv(&conf))
+	conf.Server.ShutdownTimeout = 5 * time.Second
+	conf.Webhook.Secret = "webhook secret"
+
+	dir, err := ioutil.TempDir("", "secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf.Tenant.KeysFile = filepath.Join(dir, "keys")
+
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- Serve(ctx, conf, ln) }()
+
+		resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, string(body), "secret_janitor_sweep_number")
+
+		cancel()
+		select {
+		case err := <-served:
+			assert.NoError(t, err, "start %d", i+1)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("server wasn't stopped on start %d", i+1)
+		}
+	}
+}
+
+// TestNewAuth checks that requests are authenticated before they are rate limited,
+// so API keys sharing an address have their own buckets
+func TestNewAuth(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	dir, err := ioutil.TempDir("", "secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keys, err := tenant.LoadKeyFile(filepath.Join(dir, "keys"))
+	require.NoError(t, err)
+	ci, err := keys.Create("acme", "ci")
+	require.NoError(t, err)
+	deploy, err := keys.Create("acme", "deploy")
+	require.NoError(t, err)
+
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), map[string]ratelimit.Rule{
+		"secret_post": {Limit: 1, Period: time.Hour},
+	}, tenant.ClientKey, nil)
+	auth, err := newAuth(config.TenantConfig{}, keys, limiter, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/", auth(func(c *gin.Context) { c.Status(http.StatusOK) }, "secret_post", true))
+	serve := func(key string) int {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		req.Header.Set(tenant.KeyHeader, key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(ci))
+	assert.Equal(t, http.StatusOK, serve(deploy))
+	assert.Equal(t, http.StatusTooManyRequests, serve(ci))
+	assert.Equal(t, http.StatusTooManyRequests, serve(deploy))
+}
+
+func TestWatchTenants(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	db, err := database.NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keys, err := tenant.LoadKeyFile(filepath.Join(dir, "keys"))
+	require.NoError(t, err)
+	_, err = keys.Create("acme", "ci")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan string, 10)
+	done := make(chan struct{})
+	go func() {
+		watchTenants(ctx, db, keys, 10*time.Millisecond, func(ns namespace) { started <- ns.tenant })
+		close(done)
+	}()
+	next := func() string {
+		select {
+		case name := <-started:
+			return name
+		case <-time.After(5 * time.Second):
+			t.Fatal("namespace wasn't started")
+			return ""
+		}
+	}
+
+	assert.Equal(t, "", next())
+	assert.Equal(t, "acme", next())
+
+	// tenants added to the running service are swept too, every namespace is started once
+	_, err = keys.Create("acme", "deploy")
+	require.NoError(t, err)
+	_, err = keys.Create("beta", "ci")
+	require.NoError(t, err)
+	assert.Equal(t, "beta", next())
+
+	cancel()
+	<-done
+	assert.Empty(t, started)
+}
+
+func TestMigrateKeyHashes(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	db, err := database.NewRedisDB(mr.Addr())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keys, err := tenant.LoadKeyFile(filepath.Join(dir, "keys"))
+	require.NoError(t, err)
+	_, err = keys.Create("acme", "ci")
+	require.NoError(t, err)
+
+	plain := fmt.Sprintf("%x", sha256.Sum256([]byte("some key")))
+	acme := database.Namespace(db, "acme")
+	require.NoError(t, db.CreateSecret("default", models.Secret{SecretBase: models.SecretBase{KeyHash: plain, ManageHash: plain}}))
+	require.NoError(t, db.CreateSecret(models.ChunkID("default", 0), models.Secret{SecretBase: models.SecretBase{KeyHash: plain}}))
+	require.NoError(t, acme.CreateSecret("tenant", models.Secret{SecretBase: models.SecretBase{KeyHash: plain}}))
+	require.NoError(t, db.CreateSecret("legacy", models.Secret{}))
+
+	require.NoError(t, migrateKeyHashes(db, keys))
+
+	for _, s := range []struct {
+		db   database.Database
+		hash string
+	}{{db, "default"}, {db, models.ChunkID("default", 0)}, {acme, "tenant"}} {
+		got, err := s.db.GetSecret(s.hash)
+		require.NoError(t, err)
+		assert.NotEqual(t, plain, got.KeyHash, s.hash)
+		assert.True(t, strings.HasPrefix(got.KeyHash, "$"), s.hash)
+	}
+	got, err := db.GetSecret("default")
+	require.NoError(t, err)
+	assert.Equal(t, got.KeyHash, got.ManageHash)
+	got, err = db.GetSecret("legacy")
+	require.NoError(t, err)
+	assert.Empty(t, got.KeyHash)
+
+	// migrated secrets are left as is
+	migrated, err := db.GetSecret("default")
+	require.NoError(t, err)
+	require.NoError(t, migrateKeyHashes(db, keys))
+	got, err = db.GetSecret("default")
+	require.NoError(t, err)
+	assert.Equal(t, migrated, got)
+}